@@ -0,0 +1,366 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// ALERTS_FILE is the SQLite file in the storage dir that keeps alert subscriptions.
+const ALERTS_FILE = "alerts.sqlite"
+
+// Alert is a chat's subscription to a gym's count crossing a threshold.
+type Alert struct {
+	ID        int64
+	ChatID    int64
+	Gym       string
+	Below     bool
+	Threshold int
+	// Expires is when the subscription ends, zero for never.
+	Expires time.Time
+	// QuietFrom and QuietTo are the offsets since midnight between which
+	// no alerts are sent; equal offsets mean no quiet hours.
+	QuietFrom time.Duration
+	QuietTo   time.Duration
+	// Location is the chat's timezone, which the quiet hours are in; nil
+	// for the timezone of the time checked.
+	Location *time.Location
+	// Armed is cleared once the alert fires and set again when the count
+	// moves back past the threshold by more than the hysteresis.
+	Armed bool
+}
+
+func (a Alert) String() string {
+	direction := "above"
+	if a.Below {
+		direction = "below"
+	}
+	s := fmt.Sprintf("%s %s %d", a.Gym, direction, a.Threshold)
+	if !a.Expires.IsZero() {
+		expires := a.Expires
+		if a.Location != nil {
+			expires = expires.In(a.Location)
+		}
+		s += " until " + expires.Format("Mon 15:04")
+	}
+	if a.QuietFrom != a.QuietTo {
+		s += fmt.Sprintf(" (quiet %s–%s)", clock(a.QuietFrom), clock(a.QuietTo))
+	}
+	return s
+}
+
+// crossed reports whether the count is past the alert's threshold.
+func (a Alert) crossed(count int) bool {
+	if a.Below {
+		return count < a.Threshold
+	}
+	return count > a.Threshold
+}
+
+// rearmed reports whether the count moved back far enough to arm the alert again.
+func (a Alert) rearmed(count int) bool {
+	hysteresis := max(2, a.Threshold/10)
+	if a.Below {
+		return count >= a.Threshold+hysteresis
+	}
+	return count <= a.Threshold-hysteresis
+}
+
+// quiet reports whether t falls within the alert's quiet hours.
+func (a Alert) quiet(t time.Time) bool {
+	if a.QuietFrom == a.QuietTo {
+		return false
+	}
+	if a.Location != nil {
+		t = t.In(a.Location)
+	}
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if a.QuietFrom < a.QuietTo {
+		return sinceMidnight >= a.QuietFrom && sinceMidnight < a.QuietTo
+	}
+	// Quiet hours over midnight, e.g. 22:00–07:00
+	return sinceMidnight >= a.QuietFrom || sinceMidnight < a.QuietTo
+}
+
+// Message is the notification sent when the alert fires for the counter.
+func (a Alert) Message(counter Counter) string {
+	verb := "went above"
+	if a.Below {
+		verb = "dropped below"
+	}
+	return fmt.Sprintf("%s %s %d: %d of %d on the wall now.", counter.Label(a.Gym), verb, a.Threshold, counter.Count, counter.Capacity)
+}
+
+// Alerts keeps the alert subscriptions of all chats.
+type Alerts struct {
+	db *sql.DB
+	// mu guards defaults, which a config reload swaps.
+	mu       sync.RWMutex
+	defaults AlertDefaults
+}
+
+// NewAlerts creates a new Alerts instance with its SQLite file inside storageDir.
+func NewAlerts(storageDir string) (*Alerts, error) {
+	if err := os.MkdirAll(storageDir, 0o755); err != nil {
+		return nil, fmt.Errorf("create storage dir %q: %w", storageDir, err)
+	}
+
+	db, err := sql.Open("sqlite", filepath.Join(storageDir, ALERTS_FILE))
+	if err != nil {
+		return nil, err
+	}
+
+	createTableQuery := `
+    CREATE TABLE IF NOT EXISTS alerts (
+        id INTEGER PRIMARY KEY AUTOINCREMENT,
+        chat_id INTEGER,
+        gym TEXT,
+        below INTEGER,
+        threshold INTEGER,
+        expires TEXT,
+        quiet_from INTEGER,
+        quiet_to INTEGER,
+        armed INTEGER
+    );`
+	if _, err = db.Exec(createTableQuery); err != nil {
+		return nil, err
+	}
+	if err := addMissingColumns(db, "alerts", map[string]string{"timezone": "TEXT"}); err != nil {
+		return nil, err
+	}
+
+	return &Alerts{db: db}, nil
+}
+
+// Add stores the alert, replacing the chat's previous alert for the same gym and direction.
+func (a *Alerts) Add(alert Alert) (Alert, error) {
+	_, err := a.db.Exec("DELETE FROM alerts WHERE chat_id = ? AND gym = ? AND below = ?", alert.ChatID, alert.Gym, alert.Below)
+	if err != nil {
+		return alert, err
+	}
+
+	var expires, timezone any
+	if !alert.Expires.IsZero() {
+		expires = alert.Expires.Format(time.RFC3339)
+	}
+	if alert.Location != nil {
+		timezone = alert.Location.String()
+	}
+	res, err := a.db.Exec(`
+    INSERT INTO alerts (chat_id, gym, below, threshold, expires, quiet_from, quiet_to, armed, timezone)
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		alert.ChatID, alert.Gym, alert.Below, alert.Threshold, expires,
+		int64(alert.QuietFrom.Minutes()), int64(alert.QuietTo.Minutes()), alert.Armed, timezone)
+	if err != nil {
+		return alert, err
+	}
+
+	alert.ID, err = res.LastInsertId()
+	return alert, err
+}
+
+// Remove deletes the chat's alerts for the gym, or all of them for an empty gym, and returns how many were removed.
+func (a *Alerts) Remove(chatID int64, gym string) (int64, error) {
+	query, args := "DELETE FROM alerts WHERE chat_id = ?", []any{chatID}
+	if gym != "" {
+		query, args = query+" AND gym = ?", append(args, gym)
+	}
+	res, err := a.db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// List returns the chat's alerts that haven't expired by now.
+func (a *Alerts) List(chatID int64, now time.Time) ([]Alert, error) {
+	return a.query(now, "chat_id = ?", chatID)
+}
+
+// Check returns the alerts for the gym that fire on the counter at now,
+// disarming them, and rearms those the counter moved back past.
+func (a *Alerts) Check(gym string, counter Counter, now time.Time) ([]Alert, error) {
+	alerts, err := a.query(now, "gym = ?", gym)
+	if err != nil {
+		return nil, err
+	}
+
+	var fired []Alert
+	for _, alert := range alerts {
+		switch {
+		case alert.Armed && alert.crossed(counter.Count) && !alert.quiet(now):
+			alert.Armed = false
+			fired = append(fired, alert)
+		case !alert.Armed && alert.rearmed(counter.Count):
+			alert.Armed = true
+		default:
+			continue
+		}
+		if _, err := a.db.Exec("UPDATE alerts SET armed = ? WHERE id = ?", alert.Armed, alert.ID); err != nil {
+			return fired, err
+		}
+	}
+	return fired, nil
+}
+
+// query returns the alerts matching the condition, deleting the expired ones first.
+func (a *Alerts) query(now time.Time, cond string, args ...any) ([]Alert, error) {
+	_, err := a.db.Exec("DELETE FROM alerts WHERE expires IS NOT NULL AND datetime(expires) <= datetime(?)", now.Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := a.db.Query(`
+    SELECT id, chat_id, gym, below, threshold, expires, quiet_from, quiet_to, armed, timezone
+    FROM alerts WHERE `+cond+` ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var alerts []Alert
+	for rows.Next() {
+		var alert Alert
+		var expires, timezone sql.NullString
+		var quietFrom, quietTo int64
+		err := rows.Scan(&alert.ID, &alert.ChatID, &alert.Gym, &alert.Below, &alert.Threshold,
+			&expires, &quietFrom, &quietTo, &alert.Armed, &timezone)
+		if err != nil {
+			return nil, err
+		}
+		if timezone.Valid && timezone.String != "" {
+			if alert.Location, err = time.LoadLocation(timezone.String); err != nil {
+				slog.Warn("unknown timezone, using the server's", "component", "alerts", "alert_id", alert.ID, "msg", err)
+			}
+		}
+		if expires.Valid {
+			if alert.Expires, err = time.Parse(time.RFC3339, expires.String); err != nil {
+				return nil, err
+			}
+		}
+		alert.QuietFrom = time.Duration(quietFrom) * time.Minute
+		alert.QuietTo = time.Duration(quietTo) * time.Minute
+		alerts = append(alerts, alert)
+	}
+	return alerts, rows.Err()
+}
+
+// SetDefaults sets the expiry and quiet hours of new alerts that don't set their own.
+func (a *Alerts) SetDefaults(defaults AlertDefaults) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.defaults = defaults
+}
+
+// withDefaults fills in the default expiry and quiet hours the alert leaves unset.
+func (a *Alerts) withDefaults(alert Alert, now time.Time) Alert {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if alert.Expires.IsZero() && a.defaults.Expiry > 0 {
+		alert.Expires = now.Add(a.defaults.Expiry)
+	}
+	if alert.QuietFrom == alert.QuietTo {
+		alert.QuietFrom, alert.QuietTo = a.defaults.QuietFrom, a.defaults.QuietTo
+	}
+	return alert
+}
+
+// parseAlert parses the arguments of "/alert GYM below 30 [tonight|for 3h] [quiet 22-07]",
+// without the gym key, into an alert that is armed unless the last count
+// already crossed the threshold.
+func parseAlert(args []string, last Counter, now time.Time) (Alert, error) {
+	var alert Alert
+	direction := false
+	for i := 0; i < len(args); i++ {
+		arg := strings.ToLower(args[i])
+		next := func() (string, error) {
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("%q needs a value", arg)
+			}
+			i++
+			return strings.ToLower(args[i]), nil
+		}
+
+		switch arg {
+		case "below", "above":
+			val, err := next()
+			if err != nil {
+				return alert, err
+			}
+			alert.Threshold, err = strconv.Atoi(val)
+			if err != nil || alert.Threshold < 0 {
+				return alert, fmt.Errorf("%q is not a number of people", val)
+			}
+			alert.Below = arg == "below"
+			direction = true
+		case "tonight":
+			y, m, d := now.Date()
+			alert.Expires = time.Date(y, m, d+1, 0, 0, 0, 0, now.Location())
+		case "for":
+			val, err := next()
+			if err != nil {
+				return alert, err
+			}
+			d, err := time.ParseDuration(val)
+			if err != nil || d <= 0 {
+				return alert, fmt.Errorf("%q is not a duration like 3h", val)
+			}
+			alert.Expires = now.Add(d)
+		case "quiet":
+			val, err := next()
+			if err != nil {
+				return alert, err
+			}
+			if alert.QuietFrom, alert.QuietTo, err = parseHours(val); err != nil {
+				return alert, fmt.Errorf("%q is not a range of hours like 22-07", val)
+			}
+		default:
+			return alert, fmt.Errorf("unexpected %q", args[i])
+		}
+	}
+
+	if !direction {
+		return alert, errors.New("say below or above how many people")
+	}
+
+	alert.Armed = last.LastUpdate.IsZero() || !alert.crossed(last.Count)
+	return alert, nil
+}
+
+// parseHours parses a range of hours like "22-07" or "22:30-07" into offsets since midnight.
+func parseHours(val string) (from, to time.Duration, err error) {
+	fromVal, toVal, ok := strings.Cut(val, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("%q is not a range of hours", val)
+	}
+	if from, err = parseHour(fromVal); err != nil {
+		return 0, 0, err
+	}
+	to, err = parseHour(toVal)
+	return from, to, err
+}
+
+// parseHour parses "7", "07" or "07:30" into the offset since midnight.
+func parseHour(val string) (time.Duration, error) {
+	if !strings.Contains(val, ":") {
+		val += ":00"
+	}
+	if len(val) == 4 {
+		val = "0" + val
+	}
+	return parseClock(val)
+}
+
+// clock formats an offset since midnight as "HH:MM".
+func clock(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+}
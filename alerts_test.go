@@ -0,0 +1,237 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewAlerts(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "storage")
+	a, err := NewAlerts(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if a == nil {
+		t.Fatal("expected non-nil Alerts instance")
+	}
+}
+
+func TestAlerts_AddListRemove(t *testing.T) {
+	a, err := NewAlerts(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	now := time.Date(2024, 5, 15, 18, 0, 0, 0, time.UTC)
+
+	alerts := []Alert{
+		{ChatID: 1, Gym: "TST", Below: true, Threshold: 30, Armed: true},
+		// replaces the one above
+		{ChatID: 1, Gym: "TST", Below: true, Threshold: 25, Armed: true},
+		{ChatID: 1, Gym: "TST", Threshold: 80, Armed: true, Expires: now.Add(time.Hour)},
+		{ChatID: 1, Gym: "SLB", Below: true, Threshold: 10, Armed: true, QuietFrom: 22 * time.Hour, QuietTo: 7 * time.Hour},
+		{ChatID: 2, Gym: "TST", Below: true, Threshold: 30, Armed: true},
+	}
+	for _, alert := range alerts {
+		if _, err := a.Add(alert); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	list, err := a.List(1, now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got []string
+	for _, alert := range list {
+		got = append(got, alert.String())
+	}
+	want := []string{"TST below 25", "TST above 80 until Wed 19:00", "SLB below 10 (quiet 22:00–07:00)"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] || got[2] != want[2] {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	// The expiring alert is gone an hour later
+	if list, _ := a.List(1, now.Add(time.Hour)); len(list) != 2 {
+		t.Errorf("expected 2 alerts after expiry, got %v", list)
+	}
+
+	if n, err := a.Remove(1, "TST"); err != nil || n != 1 {
+		t.Errorf("expected 1 alert removed, got %d, %v", n, err)
+	}
+	if n, err := a.Remove(1, ""); err != nil || n != 1 {
+		t.Errorf("expected 1 alert removed, got %d, %v", n, err)
+	}
+	if list, _ := a.List(2, now); len(list) != 1 {
+		t.Errorf("expected the other chat's alert to stay, got %v", list)
+	}
+}
+
+func TestAlerts_Check(t *testing.T) {
+	a, err := NewAlerts(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := a.Add(Alert{ChatID: 1, Gym: "TST", Below: true, Threshold: 30, Armed: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	now := time.Date(2024, 5, 15, 18, 0, 0, 0, time.UTC)
+	// Oscillating around the threshold fires once until the count is well
+	// above it again: 33 rearms it, so 27 fires again
+	counts := []int{40, 29, 31, 28, 32, 33, 27}
+	fires := []bool{false, true, false, false, false, false, true}
+	for i, count := range counts {
+		fired, err := a.Check("TST", Counter{Count: count, Capacity: 100}, now)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if (len(fired) == 1) != fires[i] {
+			t.Errorf("count %d: expected fired %v, got %v", count, fires[i], fired)
+		}
+	}
+
+	if fired, _ := a.Check("SLB", Counter{Count: 0}, now); len(fired) != 0 {
+		t.Errorf("expected no alerts for another gym, got %v", fired)
+	}
+}
+
+func TestAlerts_Check_QuietHours(t *testing.T) {
+	a, err := NewAlerts(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	alert := Alert{ChatID: 1, Gym: "TST", Below: true, Threshold: 30, Armed: true, QuietFrom: 22 * time.Hour, QuietTo: 7 * time.Hour}
+	if _, err := a.Add(alert); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	night := time.Date(2024, 5, 15, 23, 0, 0, 0, time.UTC)
+	if fired, _ := a.Check("TST", Counter{Count: 5}, night); len(fired) != 0 {
+		t.Errorf("expected no alerts during quiet hours, got %v", fired)
+	}
+
+	// Still below the threshold once quiet hours are over
+	morning := time.Date(2024, 5, 16, 7, 0, 0, 0, time.UTC)
+	if fired, _ := a.Check("TST", Counter{Count: 5}, morning); len(fired) != 1 {
+		t.Errorf("expected the alert after quiet hours, got %v", fired)
+	}
+}
+
+func TestAlerts_Check_QuietHoursInChatTimezone(t *testing.T) {
+	a, err := NewAlerts(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skip("no tzdata:", err)
+	}
+	alert := Alert{ChatID: 1, Gym: "TST", Below: true, Threshold: 30, Armed: true,
+		QuietFrom: 22 * time.Hour, QuietTo: 7 * time.Hour, Location: tokyo}
+	if _, err := a.Add(alert); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	alerts, err := a.List(1, time.Now())
+	if err != nil || len(alerts) != 1 || alerts[0].Location.String() != "Asia/Tokyo" {
+		t.Fatalf("expected the chat's timezone to be kept, got %v, %v", alerts, err)
+	}
+
+	// 15:00 UTC is midnight in Tokyo
+	night := time.Date(2024, 5, 15, 15, 0, 0, 0, time.UTC)
+	if fired, _ := a.Check("TST", Counter{Count: 5}, night); len(fired) != 0 {
+		t.Errorf("expected no alerts during the chat's quiet hours, got %v", fired)
+	}
+
+	// 23:00 UTC is 08:00 in Tokyo
+	morning := time.Date(2024, 5, 15, 23, 0, 0, 0, time.UTC)
+	if fired, _ := a.Check("TST", Counter{Count: 5}, morning); len(fired) != 1 {
+		t.Errorf("expected the alert after the chat's quiet hours, got %v", fired)
+	}
+}
+
+func TestAlert_Quiet(t *testing.T) {
+	at := func(h int) time.Time { return time.Date(2024, 5, 15, h, 0, 0, 0, time.UTC) }
+
+	overnight := Alert{QuietFrom: 22 * time.Hour, QuietTo: 7 * time.Hour}
+	daytime := Alert{QuietFrom: 9 * time.Hour, QuietTo: 17 * time.Hour}
+	cases := []struct {
+		alert Alert
+		hour  int
+		want  bool
+	}{
+		{overnight, 23, true},
+		{overnight, 3, true},
+		{overnight, 7, false},
+		{overnight, 12, false},
+		{daytime, 12, true},
+		{daytime, 17, false},
+		{Alert{}, 3, false},
+	}
+	for _, tc := range cases {
+		if got := tc.alert.quiet(at(tc.hour)); got != tc.want {
+			t.Errorf("%v at %d:00: expected %v, got %v", tc.alert, tc.hour, tc.want, got)
+		}
+	}
+}
+
+func TestParseAlert(t *testing.T) {
+	now := time.Date(2024, 5, 15, 18, 0, 0, 0, time.UTC)
+	last := Counter{Count: 50, LastUpdate: LastUpdate{Time: now}}
+
+	alert, err := parseAlert([]string{"below", "30", "tonight", "quiet", "22-7"}, last, now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !alert.Below || alert.Threshold != 30 || !alert.Armed {
+		t.Errorf("expected an armed alert below 30, got %+v", alert)
+	}
+	if want := time.Date(2024, 5, 16, 0, 0, 0, 0, time.UTC); !alert.Expires.Equal(want) {
+		t.Errorf("expected expiry at %v, got %v", want, alert.Expires)
+	}
+	if alert.QuietFrom != 22*time.Hour || alert.QuietTo != 7*time.Hour {
+		t.Errorf("expected quiet hours 22–07, got %v–%v", alert.QuietFrom, alert.QuietTo)
+	}
+
+	alert, err = parseAlert([]string{"Above", "40", "for", "3h"}, last, now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if alert.Below || alert.Armed || !alert.Expires.Equal(now.Add(3*time.Hour)) {
+		t.Errorf("expected a disarmed alert above 40 for 3h, got %+v", alert)
+	}
+
+	for _, args := range [][]string{
+		nil,
+		{"tonight"},
+		{"below"},
+		{"below", "lots"},
+		{"below", "30", "for", "ever"},
+		{"below", "30", "quiet", "late"},
+		{"below", "30", "please"},
+	} {
+		if _, err := parseAlert(args, last, now); err == nil {
+			t.Errorf("%q: expected an error, got nil", args)
+		}
+	}
+}
+
+func TestAlerts_WithDefaults(t *testing.T) {
+	alerts, err := NewAlerts(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewAlerts: %v", err)
+	}
+	alerts.SetDefaults(AlertDefaults{Expiry: 6 * time.Hour, QuietFrom: 22 * time.Hour, QuietTo: 7 * time.Hour})
+	now := time.Date(2024, time.June, 3, 12, 0, 0, 0, time.UTC)
+
+	got := alerts.withDefaults(Alert{Below: true, Threshold: 30}, now)
+	if !got.Expires.Equal(now.Add(6*time.Hour)) || got.QuietFrom != 22*time.Hour || got.QuietTo != 7*time.Hour {
+		t.Errorf("expected the defaults to apply, got %+v", got)
+	}
+
+	own := Alert{Below: true, Threshold: 30, Expires: now.Add(time.Hour), QuietFrom: time.Hour, QuietTo: 2 * time.Hour}
+	if got := alerts.withDefaults(own, now); got != own {
+		t.Errorf("expected the alert's own settings to stay, got %+v", got)
+	}
+}
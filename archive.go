@@ -0,0 +1,178 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// archiveTimeFormat names archived pages after the time they were fetched, in
+// UTC. A unique suffix follows it, as fetch times only go to the second.
+const archiveTimeFormat = "20060102T150405Z"
+
+// archivePruneEvery is how often saving a page also removes the expired ones.
+const archivePruneEvery = time.Hour
+
+// Archive keeps the raw pages scraped, gzipped, in a directory per source,
+// named after the time they were fetched. Pages older than the retention
+// are removed.
+type Archive struct {
+	mu         sync.Mutex
+	dir        string
+	retention  time.Duration
+	lastPruned time.Time
+	now        func() time.Time
+}
+
+// ArchivedPage is a page read back from the archive.
+type ArchivedPage struct {
+	Source    string
+	FetchedAt time.Time
+	Path      string
+}
+
+// NewArchive creates an archive in the configured dir. The dir and a
+// source's dir in it are created when the first page is saved.
+func NewArchive(cfg ArchiveConfig) *Archive {
+	return &Archive{dir: cfg.Dir, retention: cfg.Retention, now: time.Now}
+}
+
+// archiveSource is the directory name for a source's pages.
+func archiveSource(name string) string {
+	if name == "" {
+		return "default"
+	}
+	return strings.ToLower(name)
+}
+
+// Save stores the page the source's fetch returned at fetchedAt.
+func (a *Archive) Save(source string, fetchedAt time.Time, page []byte) error {
+	dir := filepath.Join(a.dir, archiveSource(source))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that replay never sees half a page
+	f, err := os.CreateTemp(dir, ".page-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	zw := gzip.NewWriter(f)
+	if _, err := zw.Write(page); err != nil {
+		f.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// Pages fetched in the same second, by different jobs, keep the temporary file's suffix apart
+	suffix := strings.TrimPrefix(filepath.Base(f.Name()), ".page-")
+	name := fetchedAt.UTC().Format(archiveTimeFormat) + "-" + suffix + ".html.gz"
+	if err := os.Rename(f.Name(), filepath.Join(dir, name)); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	prune := a.now().Sub(a.lastPruned) >= archivePruneEvery
+	if prune {
+		a.lastPruned = a.now()
+	}
+	a.mu.Unlock()
+	if prune {
+		if err := a.Prune(); err != nil {
+			slog.Error("can't prune archive", "component", "archive", "msg", err)
+		}
+	}
+	return nil
+}
+
+// Prune removes the pages older than the retention.
+func (a *Archive) Prune() error {
+	pages, err := a.Pages("")
+	if err != nil {
+		return err
+	}
+
+	cutoff := a.now().Add(-a.retention)
+	removed := 0
+	for _, p := range pages {
+		if !p.FetchedAt.Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(p.Path); err != nil {
+			return err
+		}
+		removed++
+	}
+	if removed > 0 {
+		slog.Info("pruned archive", "component", "archive", "pages", removed, "before", cutoff)
+	}
+	return nil
+}
+
+// Pages lists the archived pages of the source, or of all sources if it's
+// empty, oldest first.
+func (a *Archive) Pages(source string) ([]ArchivedPage, error) {
+	pattern := filepath.Join(a.dir, "*", "*.html.gz")
+	if source != "" {
+		pattern = filepath.Join(a.dir, archiveSource(source), "*.html.gz")
+	}
+	paths, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	var pages []ArchivedPage
+	for _, path := range paths {
+		stamp, _, _ := strings.Cut(strings.TrimSuffix(filepath.Base(path), ".html.gz"), "-")
+		fetchedAt, err := time.Parse(archiveTimeFormat, stamp)
+		if err != nil {
+			// Not one of ours
+			continue
+		}
+		pages = append(pages, ArchivedPage{
+			Source:    filepath.Base(filepath.Dir(path)),
+			FetchedAt: fetchedAt,
+			Path:      path,
+		})
+	}
+	sort.SliceStable(pages, func(i, j int) bool {
+		return pages[i].FetchedAt.Before(pages[j].FetchedAt)
+	})
+	return pages, nil
+}
+
+// Read returns the page as it was fetched.
+func (p ArchivedPage) Read() ([]byte, error) {
+	f, err := os.Open(p.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p.Path, err)
+	}
+	defer zr.Close()
+
+	page, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p.Path, err)
+	}
+	return page, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchive_SaveAndRead(t *testing.T) {
+	a := NewArchive(ArchiveConfig{Dir: t.TempDir(), Retention: time.Hour})
+	t1 := time.Date(2024, time.May, 30, 10, 5, 0, 0, time.UTC)
+	t2 := t1.Add(5 * time.Minute)
+
+	a.now = func() time.Time { return t2 }
+	if err := a.Save("bldr", t2, []byte("second")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := a.Save("bldr", t1, []byte("first")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := a.Save("", t1, []byte("other")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	pages, err := a.Pages("BLDR")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pages) != 2 {
+		t.Fatalf("expected 2 pages, got %v", pages)
+	}
+	for i, want := range []string{"first", "second"} {
+		page, err := pages[i].Read()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(page) != want {
+			t.Errorf("expected page %d to be %q, got %q", i, want, page)
+		}
+	}
+	if !pages[0].FetchedAt.Equal(t1) || pages[0].Source != "bldr" {
+		t.Errorf("unexpected page %+v", pages[0])
+	}
+
+	if all, _ := a.Pages(""); len(all) != 3 {
+		t.Errorf("expected 3 pages of all sources, got %d", len(all))
+	}
+	if def, _ := a.Pages("default"); len(def) != 1 || def[0].Source != "default" {
+		t.Errorf("expected the unnamed source's page under default, got %v", def)
+	}
+}
+
+func TestArchive_SaveSameSecond(t *testing.T) {
+	dir := t.TempDir()
+	a := NewArchive(ArchiveConfig{Dir: dir, Retention: time.Hour})
+	now := time.Date(2024, time.May, 30, 10, 5, 0, 0, time.UTC)
+	a.now = func() time.Time { return now }
+
+	for _, page := range []string{"global", "per gym"} {
+		if err := a.Save("bldr", now, []byte(page)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	pages, err := a.Pages("bldr")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(pages) != 2 || !pages[0].FetchedAt.Equal(now) || !pages[1].FetchedAt.Equal(now) {
+		t.Errorf("expected both pages fetched at %v, got %v", now, pages)
+	}
+
+	// Pages named before the suffix are still read
+	if err := os.WriteFile(filepath.Join(dir, "bldr", "20240530T100000Z.html.gz"), nil, 0o644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pages, _ := a.Pages("bldr"); len(pages) != 3 || !pages[0].FetchedAt.Equal(now.Add(-5*time.Minute)) {
+		t.Errorf("expected the old-style page first, got %v", pages)
+	}
+}
+
+func TestArchive_Prune(t *testing.T) {
+	dir := t.TempDir()
+	a := NewArchive(ArchiveConfig{Dir: dir, Retention: 24 * time.Hour})
+	now := time.Date(2024, time.May, 30, 10, 0, 0, 0, time.UTC)
+	a.now = func() time.Time { return now }
+
+	old := now.Add(-25 * time.Hour)
+	a.lastPruned = now.Add(-30 * time.Minute)
+	if err := a.Save("", old, []byte("old")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := a.Save("", now, []byte("new")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pages, _ := a.Pages(""); len(pages) != 2 {
+		t.Fatalf("expected pruning to wait an hour, got %d pages", len(pages))
+	}
+
+	if err := a.Prune(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pages, _ := a.Pages("")
+	if len(pages) != 1 || !pages[0].FetchedAt.Equal(now) {
+		t.Errorf("expected only the new page to be left, got %v", pages)
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, "default", old.Format(archiveTimeFormat)+"*")); len(left) != 0 {
+		t.Errorf("expected the old page to be removed, got %v", left)
+	}
+
+	// An hour on, saving prunes too
+	now = now.Add(26 * time.Hour)
+	if err := a.Save("", now, []byte("newer")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if pages, _ := a.Pages(""); len(pages) != 1 {
+		t.Errorf("expected saving to prune the expired page, got %d pages", len(pages))
+	}
+}
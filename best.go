@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// bestWeeks is how many weeks of history /best averages over.
+	bestWeeks = 8
+	// bestWindows is how many of the quietest hours /best recommends.
+	bestWindows = 3
+)
+
+// hourAverage is the average count in the hour starting at Hour.
+type hourAverage struct {
+	Hour    int
+	Average float64
+}
+
+// parseWeekday resolves a /best weekday argument such as "tue", "Tuesday",
+// "today" or "tomorrow". An empty argument means today.
+func parseWeekday(arg string, now time.Time) (time.Weekday, error) {
+	arg = strings.ToLower(arg)
+	switch arg {
+	case "", "today":
+		return now.Weekday(), nil
+	case "tomorrow":
+		return now.AddDate(0, 0, 1).Weekday(), nil
+	}
+
+	for wd := time.Sunday; wd <= time.Saturday; wd++ {
+		name := strings.ToLower(wd.String())
+		if len(arg) >= 3 && strings.HasPrefix(name, arg) {
+			return wd, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown weekday %q", arg)
+}
+
+// hourlyAverages returns the average count per hour of the weekday, leaving
+// out the hours without samples, i.e. when the gym is closed.
+func hourlyAverages(counters []Counter, wd time.Weekday) []hourAverage {
+	profile := NewProfile(counters, time.Hour)
+
+	// Any date on the right weekday will do to look the profile up
+	day := time.Date(2000, 1, 2+int(wd), 0, 0, 0, 0, time.UTC)
+	var hours []hourAverage
+	for h := range 24 {
+		if avg, ok := profile.At(day.Add(time.Duration(h) * time.Hour)); ok {
+			hours = append(hours, hourAverage{Hour: h, Average: avg})
+		}
+	}
+	return hours
+}
+
+// renderBest recommends the quietest hours of the weekday, in time order.
+func renderBest(gym string, wd time.Weekday, capacity int, hours []hourAverage) string {
+	if len(hours) == 0 {
+		return fmt.Sprintf("Not enough data for %s on %s yet.", gym, wd)
+	}
+
+	busiest := hours[0]
+	for _, h := range hours {
+		if h.Average > busiest.Average {
+			busiest = h
+		}
+	}
+
+	quietest := append([]hourAverage(nil), hours...)
+	sort.SliceStable(quietest, func(i, j int) bool { return quietest[i].Average < quietest[j].Average })
+	quietest = quietest[:min(bestWindows, len(quietest))]
+	sort.Slice(quietest, func(i, j int) bool { return quietest[i].Hour < quietest[j].Hour })
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Quietest times at %s on %s:\n", gym, wd)
+	for _, h := range quietest {
+		fmt.Fprintf(&b, "%02d:00–%02d:00 ~%s%s\n", h.Hour, (h.Hour+1)%24, peopleCount(h.Average), percentOf(h.Average, capacity))
+	}
+	fmt.Fprintf(&b, "Busiest around %02d:00 with ~%s.", busiest.Hour, peopleCount(busiest.Average))
+	return b.String()
+}
+
+func peopleCount(avg float64) string {
+	n := int(math.Round(avg))
+	if n == 1 {
+		return "1 person"
+	}
+	return fmt.Sprintf("%d people", n)
+}
+
+func percentOf(avg float64, capacity int) string {
+	if capacity <= 0 {
+		return ""
+	}
+	return fmt.Sprintf(" (%.0f%%)", 100*avg/float64(capacity))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseWeekday(t *testing.T) {
+	// Wednesday
+	now := time.Date(2024, 5, 15, 12, 0, 0, 0, time.UTC)
+	cases := map[string]time.Weekday{
+		"":         time.Wednesday,
+		"today":    time.Wednesday,
+		"Tomorrow": time.Thursday,
+		"sun":      time.Sunday,
+		"Tue":      time.Tuesday,
+		"saturday": time.Saturday,
+	}
+	for arg, want := range cases {
+		got, err := parseWeekday(arg, now)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", arg, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%q: expected %v, got %v", arg, want, got)
+		}
+	}
+
+	for _, arg := range []string{"t", "mo", "someday", "3h"} {
+		if _, err := parseWeekday(arg, now); err == nil {
+			t.Errorf("%q: expected an error, got nil", arg)
+		}
+	}
+}
+
+func TestHourlyAverages(t *testing.T) {
+	wed := time.Date(2024, 5, 15, 0, 0, 0, 0, time.UTC)
+	counters := []Counter{
+		{Count: 10, LastUpdate: LastUpdate{Time: wed.Add(9 * time.Hour)}},
+		{Count: 20, LastUpdate: LastUpdate{Time: wed.Add(9*time.Hour + 30*time.Minute)}},
+		{Count: 40, LastUpdate: LastUpdate{Time: wed.AddDate(0, 0, -7).Add(18 * time.Hour)}},
+		// Thursday doesn't count towards Wednesday
+		{Count: 99, LastUpdate: LastUpdate{Time: wed.AddDate(0, 0, 1).Add(9 * time.Hour)}},
+	}
+
+	got := hourlyAverages(counters, time.Wednesday)
+	want := []hourAverage{{9, 15}, {18, 40}}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestRenderBest(t *testing.T) {
+	hours := []hourAverage{
+		{8, 5}, {9, 12.4}, {12, 30}, {17, 80}, {18, 95}, {21, 20},
+	}
+	want := "Quietest times at TST on Wednesday:\n" +
+		"08:00–09:00 ~5 people (5%)\n" +
+		"09:00–10:00 ~12 people (12%)\n" +
+		"21:00–22:00 ~20 people (20%)\n" +
+		"Busiest around 18:00 with ~95 people."
+	if got := renderBest("TST", time.Wednesday, 100, hours); got != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+
+	if got, want := renderBest("TST", time.Monday, 0, nil), "Not enough data for TST on Monday yet."; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	chartWidth  = 800
+	chartHeight = 400
+	// chartWeeks is how many weeks of history make up the typical curve.
+	chartWeeks = 8
+)
+
+var (
+	colorBackground = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	colorGrid       = color.RGBA{0xe0, 0xe0, 0xe0, 0xff}
+	colorText       = color.RGBA{0x40, 0x40, 0x40, 0xff}
+	colorCapacity   = color.RGBA{0xd0, 0x30, 0x30, 0xff}
+	colorTypical    = color.RGBA{0xa0, 0xa0, 0xa0, 0xff}
+	colorCurrent    = color.RGBA{0x20, 0x60, 0xd0, 0xff}
+)
+
+var errNoChartData = errors.New("no data to chart")
+
+type chartPoint struct {
+	t time.Time
+	v float64
+}
+
+type chartSeries struct {
+	points []chartPoint
+	color  color.RGBA
+	// maxGap is the largest distance between two points that still gets
+	// connected; zero connects every point.
+	maxGap time.Duration
+}
+
+// chart is a line chart of counts over time with a capacity line.
+type chart struct {
+	from, to time.Time
+	capacity int
+	series   []chartSeries
+	// grid is the distance between vertical grid lines, each labelled with label.
+	grid  time.Duration
+	label func(time.Time) string
+}
+
+// occupancyChart builds the chart for /chart: the counts of the given period
+// ("day" or "week") over the typical counts of the weeks before it.
+func occupancyChart(storer Storer, gym, period string, now time.Time) (*chart, string, error) {
+	y, m, d := now.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+
+	var c chart
+	var bucket time.Duration
+	var caption string
+	switch period {
+	case "", "day":
+		c.from, c.to = midnight, midnight.AddDate(0, 0, 1)
+		c.grid = time.Hour
+		c.label = func(t time.Time) string {
+			if t.Hour()%2 != 0 {
+				return ""
+			}
+			return t.Format("15")
+		}
+		bucket = 15 * time.Minute
+		caption = fmt.Sprintf("%s today (blue) vs a typical %s (gray)", gym, now.Weekday())
+	case "week":
+		c.from, c.to = midnight.AddDate(0, 0, -6), midnight.AddDate(0, 0, 1)
+		c.grid = 24 * time.Hour
+		c.label = func(t time.Time) string { return t.Format("Mon") }
+		bucket = time.Hour
+		caption = fmt.Sprintf("%s last 7 days (blue) vs a typical week (gray)", gym)
+	default:
+		return nil, "", fmt.Errorf("unknown period %q, use day or week", period)
+	}
+
+	current, err := storer.Range(c.from, now)
+	if err != nil {
+		return nil, "", err
+	}
+	history, err := storer.Range(c.from.AddDate(0, 0, -7*chartWeeks), c.from)
+	if err != nil {
+		return nil, "", err
+	}
+	current, history = inLocation(current, now.Location()), inLocation(history, now.Location())
+
+	profile := NewProfile(history, bucket)
+	typical := chartSeries{color: colorTypical, maxGap: 2 * bucket}
+	for t := c.from; t.Before(c.to); t = t.Add(bucket) {
+		if avg, ok := profile.At(t); ok {
+			typical.points = append(typical.points, chartPoint{t.Add(bucket / 2), avg})
+		}
+	}
+
+	// Samples are taken every few minutes while the gym is open, so a long gap means it was closed
+	recent := chartSeries{color: colorCurrent, maxGap: time.Hour}
+	for _, counter := range current {
+		recent.points = append(recent.points, chartPoint{counter.LastUpdate.Time, float64(counter.Count)})
+		c.capacity = counter.Capacity
+	}
+	if c.capacity == 0 && len(history) > 0 {
+		c.capacity = history[len(history)-1].Capacity
+	}
+	c.series = []chartSeries{typical, recent}
+
+	// A day is trimmed to the hours with data, i.e. the gym's opening hours
+	if c.grid == time.Hour {
+		first, last := c.to, c.from
+		for _, s := range c.series {
+			for _, p := range s.points {
+				first = minTime(first, p.t)
+				last = maxTime(last, p.t)
+			}
+		}
+		if last.Before(first) {
+			return nil, "", errNoChartData
+		}
+		c.from = first.Truncate(time.Hour)
+		c.to = last.Truncate(time.Hour).Add(time.Hour)
+	}
+	if len(typical.points) == 0 && len(recent.points) == 0 {
+		return nil, "", errNoChartData
+	}
+
+	if c.capacity > 0 {
+		caption += fmt.Sprintf(", capacity %d (red)", c.capacity)
+	}
+	return &c, caption, nil
+}
+
+// PNG renders the chart as a PNG image.
+func (c *chart) PNG() ([]byte, error) {
+	const left, right, top, bottom = 40, 20, 20, 30
+	plotW, plotH := chartWidth-left-right, chartHeight-top-bottom
+
+	yMax := float64(max(c.capacity, 1))
+	for _, s := range c.series {
+		for _, p := range s.points {
+			yMax = max(yMax, p.v)
+		}
+	}
+	step := niceStep(yMax)
+	yMax = math.Ceil(yMax/step) * step
+
+	span := c.to.Sub(c.from)
+	x := func(t time.Time) int {
+		return left + int(float64(plotW)*float64(t.Sub(c.from))/float64(span))
+	}
+	y := func(v float64) int {
+		return top + plotH - int(float64(plotH)*v/yMax)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, chartHeight))
+	draw.Draw(img, img.Bounds(), image.NewUniform(colorBackground), image.Point{}, draw.Src)
+
+	for v := 0.0; v <= yMax; v += step {
+		drawLine(img, left, y(v), left+plotW, y(v), colorGrid, 1)
+		label := fmt.Sprintf("%.0f", v)
+		drawText(img, left-6-7*len(label), y(v)+4, label, colorText)
+	}
+	for t := c.from.Truncate(c.grid); !t.After(c.to); t = t.Add(c.grid) {
+		if t.Before(c.from) {
+			continue
+		}
+		drawLine(img, x(t), top, x(t), top+plotH, colorGrid, 1)
+		if c.grid < 24*time.Hour {
+			drawText(img, x(t)-7, top+plotH+18, c.label(t), colorText)
+		} else if t.Before(c.to) {
+			// Day labels go in the middle of the day
+			drawText(img, x(t.Add(c.grid/2))-10, top+plotH+18, c.label(t), colorText)
+		}
+	}
+
+	if c.capacity > 0 {
+		for px := left; px < left+plotW; px += 12 {
+			drawLine(img, px, y(float64(c.capacity)), min(px+6, left+plotW), y(float64(c.capacity)), colorCapacity, 2)
+		}
+	}
+
+	for _, s := range c.series {
+		for i := 1; i < len(s.points); i++ {
+			a, b := s.points[i-1], s.points[i]
+			if s.maxGap > 0 && b.t.Sub(a.t) > s.maxGap {
+				continue
+			}
+			drawLine(img, x(a.t), y(a.v), x(b.t), y(b.v), s.color, 2)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// niceStep picks a round grid step that splits v into at most ten parts.
+func niceStep(v float64) float64 {
+	for _, step := range []float64{5, 10, 20, 25, 50, 100, 200, 250, 500} {
+		if v/step <= 10 {
+			return step
+		}
+	}
+	return math.Pow(10, math.Ceil(math.Log10(v/10)))
+}
+
+// drawLine draws a line of the given width between two points.
+func drawLine(img *image.RGBA, x0, y0, x1, y1 int, c color.RGBA, width int) {
+	dx, dy := x1-x0, y1-y0
+	steps := max(abs(dx), abs(dy), 1)
+	for i := 0; i <= steps; i++ {
+		px := x0 + dx*i/steps
+		py := y0 + dy*i/steps
+		for ox := range width {
+			for oy := range width {
+				img.SetRGBA(px+ox-width/2, py+oy-width/2, c)
+			}
+		}
+	}
+}
+
+// drawText draws the text with its baseline starting at x, y.
+func drawText(img *image.RGBA, x, y int, text string, c color.RGBA) {
+	d := font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(c),
+		Face: basicfont.Face7x13,
+		Dot:  fixed.P(x, y),
+	}
+	d.DrawString(text)
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image/png"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seedChartStorer fills a stub storer with five weeks of samples every
+// 15 minutes from 08:00 to 22:00, peaking in the evening.
+func seedChartStorer(t *testing.T, now time.Time) *stubStorer {
+	t.Helper()
+	st := newStubStorer(t)
+	y, m, d := now.Date()
+	for day := -35; day <= 0; day++ {
+		open := time.Date(y, m, d+day, 8, 0, 0, 0, now.Location())
+		for ts := open; ts.Hour() < 22 && ts.Before(now); ts = ts.Add(15 * time.Minute) {
+			st.stored = append(st.stored, Counter{
+				Count:      ts.Hour() * 4,
+				Capacity:   100,
+				LastUpdate: LastUpdate{Time: ts},
+			})
+		}
+	}
+	return st
+}
+
+func TestOccupancyChart_Day(t *testing.T) {
+	now := time.Date(2024, 5, 15, 18, 7, 0, 0, time.UTC)
+	st := seedChartStorer(t, now)
+
+	c, caption, err := occupancyChart(st, "TST", "day", now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if want := "TST today (blue) vs a typical Wednesday (gray), capacity 100 (red)"; caption != want {
+		t.Errorf("expected caption %q, got %q", want, caption)
+	}
+	if c.from.Hour() != 8 || c.to.Hour() != 22 {
+		t.Errorf("expected the chart to span opening hours 08–22, got %v–%v", c.from, c.to)
+	}
+	if len(c.series) != 2 {
+		t.Fatalf("expected typical and current series, got %d", len(c.series))
+	}
+	if typical := c.series[0].points; len(typical) != 14*4 {
+		t.Errorf("expected %d typical points, got %d", 14*4, len(typical))
+	}
+	if current := c.series[1].points; len(current) != 41 {
+		t.Errorf("expected 41 points today, got %d", len(current))
+	}
+}
+
+func TestOccupancyChart_Week(t *testing.T) {
+	now := time.Date(2024, 5, 15, 18, 7, 0, 0, time.UTC)
+	st := seedChartStorer(t, now)
+
+	c, caption, err := occupancyChart(st, "TST", "week", now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(caption, "TST last 7 days") {
+		t.Errorf("unexpected caption %q", caption)
+	}
+	if want := time.Date(2024, 5, 9, 0, 0, 0, 0, time.UTC); !c.from.Equal(want) {
+		t.Errorf("expected the chart to start at %v, got %v", want, c.from)
+	}
+	if typical := c.series[0].points; len(typical) != 7*14 {
+		t.Errorf("expected %d typical points, got %d", 7*14, len(typical))
+	}
+}
+
+func TestOccupancyChart_Errors(t *testing.T) {
+	now := time.Now()
+	if _, _, err := occupancyChart(newStubStorer(t), "TST", "day", now); !errors.Is(err, errNoChartData) {
+		t.Errorf("expected errNoChartData, got %v", err)
+	}
+	if _, _, err := occupancyChart(newStubStorer(t), "TST", "month", now); err == nil {
+		t.Error("expected an error for an unknown period, got nil")
+	}
+}
+
+func TestChart_PNG(t *testing.T) {
+	now := time.Date(2024, 5, 15, 18, 7, 0, 0, time.UTC)
+	for _, period := range []string{"day", "week"} {
+		c, _, err := occupancyChart(seedChartStorer(t, now), "TST", period, now)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", period, err)
+		}
+
+		data, err := c.PNG()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", period, err)
+		}
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: can't decode chart: %v", period, err)
+		}
+		if b := img.Bounds(); b.Dx() != chartWidth || b.Dy() != chartHeight {
+			t.Errorf("%s: expected %dx%d image, got %v", period, chartWidth, chartHeight, b)
+		}
+	}
+}
+
+func TestNiceStep(t *testing.T) {
+	cases := map[float64]float64{
+		1:    5,
+		50:   5,
+		51:   10,
+		120:  20,
+		1000: 100,
+		9000: 1000,
+	}
+	for v, want := range cases {
+		if got := niceStep(v); got != want {
+			t.Errorf("niceStep(%v): expected %v, got %v", v, want, got)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// CHECKOUT_SCHEDULE is the crontab the check-out job runs on.
+const CHECKOUT_SCHEDULE = "0 */15 * * * *"
+
+// Notifier sends messages to Telegram chats outside of an update handler.
+type Notifier interface {
+	SendMessage(ctx context.Context, params *bot.SendMessageParams) (*models.Message, error)
+}
+
+// CheckoutJob closes gym sessions that were left open and asks their
+// climbers to confirm or correct the end time.
+type CheckoutJob struct {
+	// mu guards the settings below, which a config reload swaps while the job runs.
+	mu          sync.RWMutex
+	storers     map[string]Storer
+	notifier    Notifier
+	maxDuration time.Duration
+	closing     time.Duration
+	// gymClosing overrides closing for individual gyms.
+	gymClosing map[string]time.Duration
+	// location returns the timezone of a gym, which its closing time is in.
+	location func(gymKey string) *time.Location
+}
+
+func NewCheckoutJob(cfg *Config, storers map[string]Storer, notifier Notifier) *CheckoutJob {
+	return &CheckoutJob{
+		storers:     storers,
+		notifier:    notifier,
+		maxDuration: cfg.MaxSession,
+		closing:     cfg.ClosingTime,
+		gymClosing:  gymClosing(cfg),
+		location:    cfg.GymLocation,
+	}
+}
+
+// AddGym adds a gym discovered after startup.
+func (cj *CheckoutJob) AddGym(gymKey string, storer Storer) {
+	cj.mu.Lock()
+	defer cj.mu.Unlock()
+	storers := maps.Clone(cj.storers)
+	storers[gymKey] = storer
+	cj.storers = storers
+}
+
+// SetGyms swaps the gyms and session settings the job works with.
+func (cj *CheckoutJob) SetGyms(cfg *Config, storers map[string]Storer) {
+	cj.mu.Lock()
+	defer cj.mu.Unlock()
+	cj.storers = storers
+	cj.maxDuration = cfg.MaxSession
+	cj.closing = cfg.ClosingTime
+	cj.gymClosing = gymClosing(cfg)
+	cj.location = cfg.GymLocation
+}
+
+// gymClosing collects the closing times of the gyms that have their own.
+func gymClosing(cfg *Config) map[string]time.Duration {
+	closing := make(map[string]time.Duration)
+	for gymKey, gc := range cfg.Gyms {
+		if gc.ClosingTime > 0 {
+			closing[gymKey] = gc.ClosingTime
+		}
+	}
+	return closing
+}
+
+func (cj *CheckoutJob) Execute(ctx context.Context) error {
+	logger := slog.Default().With("component", "checkout job")
+
+	cj.mu.RLock()
+	storers, maxDuration, defaultClosing, gymClosing, location := cj.storers, cj.maxDuration, cj.closing, cj.gymClosing, cj.location
+	cj.mu.RUnlock()
+
+	now := time.Now()
+	var firstErr error
+	for gymKey, storer := range storers {
+		closing, ok := gymClosing[gymKey]
+		if !ok {
+			closing = defaultClosing
+		}
+		closed, err := storer.GetGym().CloseStale(now, maxDuration, closing, location(gymKey))
+		if err != nil {
+			logger.Error("failed to close stale sessions", "gym", gymKey, "msg", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+
+		for _, s := range closed {
+			logger.Info("auto-closed session", "gym", gymKey, "session", s.ID, "user_id", s.Climber.ID, "end", s.End)
+			if s.Climber.ChatID == 0 {
+				continue
+			}
+			if _, err := cj.notifier.SendMessage(ctx, checkoutMessage(s)); err != nil {
+				logger.Error("failed to notify climber", "gym", gymKey, "session", s.ID, "msg", err)
+			}
+		}
+	}
+	return firstErr
+}
+
+func (cj *CheckoutJob) Description() string {
+	cj.mu.RLock()
+	defer cj.mu.RUnlock()
+	return fmt.Sprintf("Climber Count Check-out Job for %d gym(s)", len(cj.storers))
+}
+
+// checkoutMessage asks the climber to confirm an auto-closed session or
+// pick how long they actually stayed.
+func checkoutMessage(s Session) *bot.SendMessageParams {
+	text := fmt.Sprintf("%s, looks like you forgot to check out of %s. I closed your session from %s at %s (%s). Is that right?",
+		s.Climber.Name(), s.Gym, s.Start.Format("Mon 15:04"), s.End.Format("15:04"), formatDuration(s.Duration))
+
+	buttons := []models.InlineKeyboardButton{
+		{Text: "Yes", CallbackData: sessionCallbackData(s.Gym, s.ID, "ok")},
+	}
+	for _, d := range []time.Duration{time.Hour, 90 * time.Minute, 2 * time.Hour, 3 * time.Hour} {
+		if d >= s.Duration {
+			break
+		}
+		buttons = append(buttons, models.InlineKeyboardButton{
+			Text:         formatDuration(d),
+			CallbackData: sessionCallbackData(s.Gym, s.ID, strconv.Itoa(int(d.Minutes()))),
+		})
+	}
+
+	return &bot.SendMessageParams{
+		ChatID:      s.Climber.ChatID,
+		Text:        text,
+		ReplyMarkup: &models.InlineKeyboardMarkup{InlineKeyboard: [][]models.InlineKeyboardButton{buttons}},
+	}
+}
+
+// sessionCallbackData encodes a reply to checkoutMessage as
+// "session_<gym>_<id>_<choice>", where choice is "ok" or a duration in minutes.
+func sessionCallbackData(gymKey string, id int64, choice string) string {
+	return fmt.Sprintf("session_%s_%d_%s", gymKey, id, choice)
+}
+
+// parseSessionCallbackData reverses sessionCallbackData.
+func parseSessionCallbackData(data string) (gymKey string, id int64, choice string, err error) {
+	rest, ok := strings.CutPrefix(data, "session_")
+	if !ok {
+		return "", 0, "", fmt.Errorf("invalid session callback %q", data)
+	}
+
+	i := strings.LastIndex(rest, "_")
+	if i < 0 {
+		return "", 0, "", fmt.Errorf("invalid session callback %q", data)
+	}
+	rest, choice = rest[:i], rest[i+1:]
+
+	i = strings.LastIndex(rest, "_")
+	if i < 0 {
+		return "", 0, "", fmt.Errorf("invalid session callback %q", data)
+	}
+	gymKey = rest[:i]
+	id, err = strconv.ParseInt(rest[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, "", fmt.Errorf("invalid session callback %q: %w", data, err)
+	}
+
+	return gymKey, id, choice, nil
+}
+
+// formatDuration renders d in hours and minutes, e.g. "1h30m" or "45m".
+func formatDuration(d time.Duration) string {
+	d = d.Round(time.Minute)
+	h, m := int(d.Hours()), int(d.Minutes())%60
+	switch {
+	case h == 0:
+		return fmt.Sprintf("%dm", m)
+	case m == 0:
+		return fmt.Sprintf("%dh", h)
+	default:
+		return fmt.Sprintf("%dh%dm", h, m)
+	}
+}
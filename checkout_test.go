@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// stubNotifier records every message instead of sending it to Telegram.
+type stubNotifier struct {
+	sent []*bot.SendMessageParams
+}
+
+func (n *stubNotifier) SendMessage(_ context.Context, params *bot.SendMessageParams) (*models.Message, error) {
+	n.sent = append(n.sent, params)
+	return &models.Message{}, nil
+}
+
+func TestCheckoutJob_Execute(t *testing.T) {
+	st := newStubStorer(t)
+	if err := st.NewGym(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	start := time.Now().Add(-5 * time.Hour).Format(time.RFC3339)
+	_, err := st.gym.db.Exec("INSERT INTO sessions (gym, user_id, username, chat_id, started_at) VALUES (?, ?, ?, ?, ?)",
+		"TST", alice.ID, alice.Username, alice.ChatID, start)
+	if err != nil {
+		t.Fatalf("unexpected error seeding session: %v", err)
+	}
+
+	n := &stubNotifier{}
+	cj := NewCheckoutJob(&Config{MaxSession: 4 * time.Hour}, map[string]Storer{"TST": st}, n)
+	if err := cj.Execute(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(n.sent) != 1 {
+		t.Fatalf("expected 1 notification, got %d", len(n.sent))
+	}
+	if n.sent[0].ChatID != alice.ChatID {
+		t.Errorf("expected notification to chat %d, got %v", alice.ChatID, n.sent[0].ChatID)
+	}
+	if !strings.Contains(n.sent[0].Text, "@alice") || !strings.Contains(n.sent[0].Text, "(4h)") {
+		t.Errorf("unexpected notification text %q", n.sent[0].Text)
+	}
+
+	// Nothing is left to close on the next run
+	if err := cj.Execute(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(n.sent) != 1 {
+		t.Errorf("expected no new notifications, got %d", len(n.sent)-1)
+	}
+}
+
+func TestCheckoutJob_Description(t *testing.T) {
+	cj := NewCheckoutJob(&Config{}, map[string]Storer{"TST": newStubStorer(t)}, &stubNotifier{})
+	want := "Climber Count Check-out Job for 1 gym(s)"
+	if got := cj.Description(); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestCheckoutMessage_Buttons(t *testing.T) {
+	s := Session{
+		ID:       7,
+		Gym:      "TST",
+		Climber:  alice,
+		Start:    time.Date(2024, 5, 1, 18, 0, 0, 0, time.UTC),
+		End:      time.Date(2024, 5, 1, 20, 0, 0, 0, time.UTC),
+		Duration: 2 * time.Hour,
+	}
+	params := checkoutMessage(s)
+
+	markup, ok := params.ReplyMarkup.(*models.InlineKeyboardMarkup)
+	if !ok {
+		t.Fatalf("expected inline keyboard, got %T", params.ReplyMarkup)
+	}
+	var got []string
+	for _, b := range markup.InlineKeyboard[0] {
+		got = append(got, b.Text+"="+b.CallbackData)
+	}
+	want := []string{"Yes=session_TST_7_ok", "1h=session_TST_7_60", "1h30m=session_TST_7_90"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("expected buttons %v, got %v", want, got)
+	}
+}
+
+func TestParseSessionCallbackData(t *testing.T) {
+	gymKey, id, choice, err := parseSessionCallbackData(sessionCallbackData("A_B", 42, "90"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if gymKey != "A_B" || id != 42 || choice != "90" {
+		t.Errorf("unexpected result %q %d %q", gymKey, id, choice)
+	}
+
+	for _, data := range []string{"gym_in", "session_", "session_TST_x_ok", "session_ok"} {
+		if _, _, _, err := parseSessionCallbackData(data); err == nil {
+			t.Errorf("expected an error for %q, got nil", data)
+		}
+	}
+}
+
+func TestFormatDuration(t *testing.T) {
+	cases := map[time.Duration]string{
+		45 * time.Minute:                "45m",
+		2 * time.Hour:                   "2h",
+		90 * time.Minute:                "1h30m",
+		4*time.Hour + 29*time.Second:    "4h",
+		time.Hour + 59*time.Minute + 40: "1h59m",
+	}
+	for d, want := range cases {
+		if got := formatDuration(d); got != want {
+			t.Errorf("formatDuration(%v): expected %q, got %q", d, want, got)
+		}
+	}
+}
@@ -1,27 +1,50 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"log/slog"
+	"net"
 	"net/http"
-	"strings"
-	"unicode"
+	"regexp"
+	"time"
 
 	"golang.org/x/net/html"
 )
 
 const USER_AGENT = "Mozilla/5.0 (Windows NT 6.1; Win64; x64; rv:47.0) Gecko/20100101 Firefox/47.0"
 
-type ClientRoundTripper struct{}
+// ClientRoundTripper logs requests made through next, or through
+// http.DefaultTransport when next is nil.
+type ClientRoundTripper struct {
+	next http.RoundTripper
+}
+
+// NewClientRoundTripper makes a transport that gives up on connecting and on
+// waiting for the response headers after the config's timeouts.
+func NewClientRoundTripper(hc HTTPConfig) ClientRoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if hc.ConnectTimeout > 0 {
+		transport.DialContext = (&net.Dialer{Timeout: hc.ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext
+		transport.TLSHandshakeTimeout = hc.ConnectTimeout
+	}
+	transport.ResponseHeaderTimeout = hc.ReadTimeout
+	return ClientRoundTripper{next: transport}
+}
 
 func (crt ClientRoundTripper) RoundTrip(req *http.Request) (resp *http.Response, err error) {
 	logger := slog.Default().With("component", "client")
 	logger.Info("sending request", "url", req.URL)
 
-	resp, err = http.DefaultTransport.RoundTrip(req)
+	next := crt.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	resp, err = next.RoundTrip(req)
 	if err != nil {
 		logger.Error("bad reply", "msg", err)
 		return
@@ -36,98 +59,216 @@ type HTTPClient interface {
 }
 
 type Client struct {
-	req    *http.Request
+	url    string
 	client HTTPClient
+	source Source
+	// location returns the timezone of a gym, to read its update times in.
+	location func(gymKey string) *time.Location
+	// gymName returns the configured display name of a gym, as rockgympro
+	// pages only give the gym keys.
+	gymName func(gymKey string) string
+	// archive, if set, keeps every page fetched.
+	archive *Archive
 }
 
+// NewClient creates a client for the organization set by PGK and FID.
 func NewClient(cfg *Config) *Client {
-	url := fmt.Sprintf("https://portal.rockgympro.com/portal/public/%s/occupancy?iframeid=occupancyCounter&fId=%s", cfg.PGK, cfg.FID)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
+	return NewSourceClient(cfg, Source{PGK: cfg.PGK, FID: cfg.FID})
+}
 
-	req.Header.Set("Accept", "text/html")
-	req.Header.Set("User-Agent", USER_AGENT)
+// NewSourceClient creates a client for the source's organization with the
+// config's timeouts and retries.
+func NewSourceClient(cfg *Config, src Source) *Client {
+	url := fmt.Sprintf("https://portal.rockgympro.com/portal/public/%s/occupancy?iframeid=occupancyCounter&fId=%s", src.PGK, src.FID)
+	rt := NewClientRoundTripper(cfg.HTTP)
+	c := &Client{url, NewRetryClient(&http.Client{Transport: rt}, cfg.HTTP, cfg.Retry, src.Name), src, cfg.GymLocation, cfg.GymName, nil}
+	if cfg.Archive.Dir != "" {
+		c.archive = NewArchive(cfg.Archive)
+	}
+	return c
+}
 
-	rt := ClientRoundTripper{}
-	return &Client{req, &http.Client{Transport: rt}}
+// Name returns the name of the client's source.
+func (c *Client) Name() string {
+	return c.source.Name
 }
 
-func (c *Client) Counters() (*Counters, error) {
+func (c *Client) Counters(ctx context.Context) (*Counters, error) {
 	logger := slog.Default().With("component", "client")
 	counters := NewCounters()
 
-	body, err := c.fetch()
+	body, fetchedAt, err := c.fetch(ctx)
 	if err != nil {
 		logger.Error("can't fetch page", "msg", err)
 		return counters, err
 	}
 	defer body.Close()
 
-	doc, err := html.Parse(body)
+	page, err := io.ReadAll(body)
 	if err != nil {
-		logger.Error("can't parse page", "msg", err)
+		logger.Error("can't read page", "msg", err)
 		return counters, err
 	}
 
-	data := parse(doc)
+	if c.archive != nil {
+		if err := c.archive.Save(c.source.Name, fetchedAt, page); err != nil {
+			logger.Error("can't archive page", "msg", err)
+		}
+	}
+
+	return c.pageCounters(page, fetchedAt)
+}
+
+// pageCounters reads the counters out of a page fetched at fetchedAt.
+func (c *Client) pageCounters(page []byte, fetchedAt time.Time) (*Counters, error) {
+	logger := slog.Default().With("component", "client")
+	counters := NewCounters()
+
+	doc, err := html.Parse(bytes.NewReader(page))
+	if err != nil {
+		logger.Error("can't parse page", "msg", err)
+		return counters, &StructureError{err}
+	}
 
-	err = json.Unmarshal([]byte(data), counters)
+	data, err := parse(doc)
+	if err != nil {
+		err = pageError(page, err)
+		logger.Error("can't read occupancy data", "msg", err)
+		return counters, &StructureError{err}
+	}
+	if data == "" {
+		return counters, &StructureError{ErrNoData}
+	}
+
+	if err := json.Unmarshal([]byte(data), counters); err != nil {
+		return counters, &StructureError{err}
+	}
 
-	return counters, err
+	resolved := make(Counters, len(*counters))
+	for key, counter := range *counters {
+		key = c.source.GymKey(key)
+		counter.LastUpdate.Resolve(fetchedAt, c.location(key))
+		if counter.Name == "" {
+			counter.Name = c.gymName(key)
+		}
+		resolved[key] = counter
+	}
+	*counters = resolved
+	return counters, nil
 }
 
-func (c *Client) fetch() (io.ReadCloser, error) {
-	resp, err := c.client.Do(c.req)
+// fetch returns the body of the page and when the server says it sent it.
+func (c *Client) fetch(ctx context.Context) (io.ReadCloser, time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.url, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("User-Agent", USER_AGENT)
+
+	resp, err := c.client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, time.Time{}, err
 	}
 
 	if resp.StatusCode != http.StatusOK {
 		resp.Body.Close()
-		return nil, fmt.Errorf("failed to fetch URL: %s, status: %d", c.req.RequestURI, resp.StatusCode)
+		return nil, time.Time{}, fmt.Errorf("failed to fetch URL: %s, status: %d", req.RequestURI, resp.StatusCode)
 	}
 
-	return resp.Body, nil
+	return resp.Body, responseTime(resp), nil
 }
 
-func parse(n *html.Node) (data string) {
-	if n.Type == html.TextNode && strings.Contains(n.Data, "var data = ") {
-		data = extract(n.Data)
-		return
+// responseTime returns the time in the response's Date header, or the
+// current time if it has none.
+func responseTime(resp *http.Response) time.Time {
+	if t, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		return t
 	}
-	for c := n.FirstChild; c != nil; c = c.NextSibling {
-		if d := parse(c); d != "" {
-			data = d
-			break
-		}
+	return time.Now()
+}
+
+// ErrNoData is returned when the page has no occupancy data in it.
+var ErrNoData = errors.New("no occupancy data in the page")
+
+// ErrBodyTooLarge is returned when reading a response body past the size limit.
+var ErrBodyTooLarge = errors.New("response body too large")
+
+// limitedBody fails reads past the size limit rather than cutting the body short.
+type limitedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+// limitBody limits the body to limit bytes, unless limit is 0.
+func limitBody(body io.ReadCloser, limit int64) io.ReadCloser {
+	if limit <= 0 {
+		return body
 	}
-	return
+	return &limitedBody{body, limit}
 }
 
-func extract(str string) string {
-	var b strings.Builder
-	// 640 ought to be enough
-	b.Grow(640)
-	skip := true
-	for _, ch := range str {
-		if ch == '=' {
-			skip = false
-			continue
-		}
-		if skip {
-			continue
-		}
-		if ch == ';' {
-			break
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	if lb.left <= 0 {
+		// Only the end of the body is fine at the limit
+		var b [1]byte
+		n, err := lb.ReadCloser.Read(b[:])
+		if n > 0 {
+			return 0, ErrBodyTooLarge
 		}
-		if ch == '\'' {
-			ch = '"'
-		}
-		if !unicode.IsSpace(ch) {
-			b.WriteRune(ch)
+		return 0, err
+	}
+	if int64(len(p)) > lb.left {
+		p = p[:lb.left]
+	}
+	n, err := lb.ReadCloser.Read(p)
+	lb.left -= int64(n)
+	return n, err
+}
+
+// pageError points a syntax error in the page's script to its line and
+// column in the page.
+func pageError(page []byte, err error) error {
+	se, ok := err.(*jsSyntaxError)
+	if !ok {
+		return err
+	}
+	start := bytes.Index(page, []byte(se.Src))
+	if start < 0 {
+		return err
+	}
+	line, col := position(string(page), start+se.Offset)
+	return fmt.Errorf("%s at line %d, column %d of the page", se.Msg, line, col)
+}
+
+// dataVar is where the occupancy object starts in the page's script.
+var dataVar = regexp.MustCompile(`var\s+data\s*=`)
+
+// parse finds the script with the occupancy data in the page and returns
+// the data as JSON, or an empty string if there is no such script.
+func parse(n *html.Node) (string, error) {
+	if n.Type == html.TextNode && dataVar.MatchString(n.Data) {
+		return extract(n.Data)
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if data, err := parse(c); data != "" || err != nil {
+			return data, err
 		}
 	}
-	return strings.ReplaceAll(b.String(), "},}", "}}")
+	return "", nil
+}
+
+// extract converts the object assigned to the data variable in the script to JSON.
+func extract(script string) (string, error) {
+	loc := dataVar.FindStringIndex(script)
+	if loc == nil {
+		return "", &jsSyntaxError{Msg: "no data variable", Src: script}
+	}
+	data, _, err := jsToJSON(script[loc[1]:])
+	if se, ok := err.(*jsSyntaxError); ok {
+		// Point into the script rather than the part after the variable
+		se.Offset += loc[1]
+		se.Src = script
+	}
+	return data, err
 }
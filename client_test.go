@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/net/html"
 )
@@ -46,6 +49,7 @@ func TestExtract(t *testing.T) {
 		name     string
 		input    string
 		expected string
+		wantErr  bool
 	}{
 		{
 			name: "Basic input",
@@ -62,12 +66,12 @@ func TestExtract(t *testing.T) {
 				'subLabel' : 'Current climber count',
 				'lastUpdate' : 'Last updated:&nbsp8 mins ago (10:09 AM)'
 			},    };`,
-			expected: `{"SBG":{"capacity":60,"count":8,"subLabel":"Currentclimbercount","lastUpdate":"Lastupdated:&nbspnow(10:16AM)"},"SBL":{"capacity":100,"count":3,"subLabel":"Currentclimbercount","lastUpdate":"Lastupdated:&nbsp8minsago(10:09AM)"}}`,
+			expected: `{"SBG":{"capacity":60,"count":8,"subLabel":"Current climber count","lastUpdate":"Last updated:&nbspnow  (10:16 AM)"},"SBL":{"capacity":100,"count":3,"subLabel":"Current climber count","lastUpdate":"Last updated:&nbsp8 mins ago (10:09 AM)"}}`,
 		},
 		{
-			name:     "Empty input",
-			input:    "",
-			expected: "",
+			name:    "Empty input",
+			input:   "",
+			wantErr: true,
 		},
 		{
 			name: "Input without equal sign",
@@ -84,13 +88,23 @@ func TestExtract(t *testing.T) {
 				'subLabel' : 'Current climber count',
 				'lastUpdate' : 'Last updated:&nbsp8 mins ago (10:09 AM)'
 			},    };`,
-			expected: "",
+			wantErr: true,
 		},
 		{
 			name: "Input with only semicolon",
 			input: `
 				;`,
-			expected: "",
+			wantErr: true,
+		},
+		{
+			name:     "Names with apostrophes and semicolons",
+			input:    `var data = {"SBG": {'count': 8, 'subLabel': "Climbers' count; live", lastUpdate: 'It\'s now'}};`,
+			expected: `{"SBG":{"count":8,"subLabel":"Climbers' count; live","lastUpdate":"It's now"}}`,
+		},
+		{
+			name:    "Unterminated object",
+			input:   `var data = {'SBG' : {'count' : 8,`,
+			wantErr: true,
 		},
 		{
 			name: "Input with unicode spaces",
@@ -107,13 +121,22 @@ func TestExtract(t *testing.T) {
 				'subLabel' : 'Current climber count',
 				'lastUpdate' : 'Last updated:&nbsp8 mins ago (10:09 AM)'
 			},    };`,
-			expected: `{"SBG":{"capacity":60,"count":8,"subLabel":"Currentclimbercount","lastUpdate":"Lastupdated:&nbspnow(10:16AM)"},"SBL":{"capacity":100,"count":3,"subLabel":"Currentclimbercount","lastUpdate":"Lastupdated:&nbsp8minsago(10:09AM)"}}`,
+			expected: `{"SBG":{"capacity":60,"count":8,"subLabel":"Current climber count","lastUpdate":"Last updated:&nbspnow  (10:16 AM)"},"SBL":{"capacity":100,"count":3,"subLabel":"Current climber count","lastUpdate":"Last updated:&nbsp8 mins ago (10:09 AM)"}}`,
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			result := extract(tc.input)
+			result, err := extract(tc.input)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("expected an error but got %q", result)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
 			if result != tc.expected {
 				t.Errorf("expected %q but got %q", tc.expected, result)
 			}
@@ -157,8 +180,11 @@ func TestParse(t *testing.T) {
 		t.Fatalf("Failed to parse HTML: %v", err)
 	}
 
-	result := parse(doc)
-	expected := `{"SBG":{"capacity":60,"count":8,"subLabel":"Currentclimbercount","lastUpdate":"Lastupdated:&nbspnow(10:16AM)"},"SBL":{"capacity":100,"count":3,"subLabel":"Currentclimbercount","lastUpdate":"Lastupdated:&nbsp8minsago(10:09AM)"}}`
+	result, err := parse(doc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `{"SBG":{"capacity":60,"count":8,"subLabel":"Current climber count","lastUpdate":"Last updated:&nbspnow  (10:16 AM)"},"SBL":{"capacity":100,"count":3,"subLabel":"Current climber count","lastUpdate":"Last updated:&nbsp8 mins ago (10:09 AM)"}}`
 
 	if result != expected {
 		t.Errorf("expected %q but got %q", expected, result)
@@ -216,7 +242,7 @@ func TestFetch(t *testing.T) {
 			client := NewClient(cfg)
 			client.client = mockClient
 
-			body, err := client.fetch()
+			body, _, err := client.fetch(context.Background())
 
 			if tt.expectedError != "" {
 				if err == nil || err.Error() != tt.expectedError {
@@ -301,7 +327,7 @@ func TestCounters_Success(t *testing.T) {
 		},
 	}
 
-	counters, err := c.Counters()
+	counters, err := c.Counters(context.Background())
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -315,7 +341,7 @@ func TestCounters_FetchError(t *testing.T) {
 	c := NewClient(cfg)
 	c.client = &MockClient{err: errors.New("network error")}
 
-	_, err := c.Counters()
+	_, err := c.Counters(context.Background())
 	if err == nil {
 		t.Fatal("expected error when fetch fails")
 	}
@@ -332,8 +358,205 @@ func TestCounters_NoOccupancyData(t *testing.T) {
 		},
 	}
 
-	_, err := c.Counters()
+	_, err := c.Counters(context.Background())
 	if err == nil {
 		t.Fatal("expected error when page contains no occupancy data")
 	}
 }
+
+func TestClient_CountersNamespaced(t *testing.T) {
+	c := NewSourceClient(&Config{}, Source{Name: "bldr", PGK: "p", FID: "f"})
+	c.client = &MockClient{
+		resp: &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(minimalOccupancyHTML("SLB", 5, 50))),
+		},
+	}
+
+	counters, err := c.Counters(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := (*counters)["BLDR-SLB"]; !ok || len(*counters) != 1 {
+		t.Errorf("expected only BLDR-SLB, got %v", *counters)
+	}
+}
+
+func TestClient_CountersConfiguredName(t *testing.T) {
+	cfg := &Config{Gyms: map[string]GymConfig{"BLDR-SLB": {Name: "Stone Gardens"}}}
+	c := NewSourceClient(cfg, Source{Name: "bldr", PGK: "p", FID: "f"})
+	c.client = &MockClient{
+		resp: &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(minimalOccupancyHTML("SLB", 5, 50))),
+		},
+	}
+
+	counters, err := c.Counters(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := counters.Counter("BLDR-SLB").Name; got != "Stone Gardens" {
+		t.Errorf("expected the configured name, got %q", got)
+	}
+}
+
+func TestFetchCounters_PartialFailure(t *testing.T) {
+	ok := NewSourceClient(&Config{}, Source{Name: "bldr", PGK: "p", FID: "f"})
+	ok.client = &MockClient{
+		resp: &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(minimalOccupancyHTML("SLB", 5, 50))),
+		},
+	}
+	down := NewSourceClient(&Config{}, Source{Name: "rope", PGK: "p", FID: "f"})
+	down.client = &MockClient{err: errors.New("network error")}
+
+	counters, err := fetchCounters(context.Background(), []OccupancyProvider{ok, down})
+	if err == nil || !strings.Contains(err.Error(), "source rope") {
+		t.Errorf("expected an error for source rope, got %v", err)
+	}
+	if got := counters.Counter("BLDR-SLB"); got.Count != 5 {
+		t.Errorf("expected BLDR-SLB count 5, got %+v", got)
+	}
+}
+
+type ctxKey struct{}
+
+func TestCounters_FreshRequestWithContext(t *testing.T) {
+	c := NewClient(&Config{PGK: "pgk", FID: "fid"})
+	mock := &MockClient{err: errors.New("network error")}
+	c.client = mock
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "first")
+	c.Counters(ctx)
+	first := mock.req
+	c.Counters(context.Background())
+
+	if first == mock.req {
+		t.Error("expected a new request for every call")
+	}
+	if first.Context().Value(ctxKey{}) != "first" {
+		t.Error("expected the request to carry the caller's context")
+	}
+}
+
+func TestCounters_Timeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	c := NewClient(&Config{HTTP: HTTPConfig{Timeout: 50 * time.Millisecond}})
+	c.url = srv.URL
+
+	start := time.Now()
+	if _, err := c.Counters(context.Background()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to be exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected to give up after the timeout, took %v", elapsed)
+	}
+}
+
+func TestCounters_ReadTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	c := NewClient(&Config{HTTP: HTTPConfig{ReadTimeout: 50 * time.Millisecond}})
+	c.url = srv.URL
+
+	if _, err := c.Counters(context.Background()); err == nil || !strings.Contains(err.Error(), "timeout awaiting response headers") {
+		t.Errorf("expected a response header timeout, got %v", err)
+	}
+}
+
+func TestCounters_BodyTooLarge(t *testing.T) {
+	page := minimalOccupancyHTML("TST", 5, 50)
+	c := NewClient(&Config{HTTP: HTTPConfig{MaxBodySize: int64(len(page)) - 1}})
+	c.client.(*RetryClient).next = &MockClient{resp: &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(page))}}
+
+	if _, err := c.Counters(context.Background()); !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("expected ErrBodyTooLarge, got %v", err)
+	}
+
+	// A body right at the limit is fine
+	c = NewClient(&Config{HTTP: HTTPConfig{MaxBodySize: int64(len(page))}})
+	c.client.(*RetryClient).next = &MockClient{resp: &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(page))}}
+	if _, err := c.Counters(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCounters_SyntaxErrorPosition(t *testing.T) {
+	page := "<html><body>\n<script>\nvar data = {\n  'SBG' : {'count' : 8,, },\n};\n</script></body></html>"
+	c := NewClient(&Config{})
+	c.client = &MockClient{resp: &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(page))}}
+
+	_, err := c.Counters(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "at line 4, column 24 of the page") {
+		t.Errorf("expected the error to point into the page, got %v", err)
+	}
+}
+
+func TestCounters_LastUpdateAnchoredToResponse(t *testing.T) {
+	page := `<html><body><script>
+var data = {
+  'AAA' : {'capacity' : 50, 'count' : 5, 'lastUpdate' : 'Last updated:&nbsp8 mins ago (6:52 PM)'},
+  'BBB' : {'capacity' : 50, 'count' : 6, 'lastUpdate' : 'Today 6:42 PM'},
+  'CCC' : {'capacity' : 50, 'count' : 7, 'lastUpdate' : 'at some point'},
+};
+</script></body></html>`
+	tz := time.FixedZone("EDT", -4*60*60)
+	cfg := &Config{Gyms: map[string]GymConfig{"BBB": {Location: tz}}}
+	c := NewClient(cfg)
+	c.client = &MockClient{resp: &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Date": {"Fri, 18 Oct 2024 23:00:00 GMT"}},
+		Body:       io.NopCloser(strings.NewReader(page)),
+	}}
+
+	counters, err := c.Counters(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	fetched := time.Date(2024, time.October, 18, 23, 0, 0, 0, time.UTC)
+	if got := counters.Counter("AAA").LastUpdate; !got.Time.Equal(fetched.Add(-8 * time.Minute)) {
+		t.Errorf("expected AAA 8 minutes before the response, got %v", got.Time)
+	}
+	if got := counters.Counter("BBB").LastUpdate; !got.Time.Equal(time.Date(2024, time.October, 18, 18, 42, 0, 0, tz)) {
+		t.Errorf("expected BBB at 6:42 PM in its timezone, got %v", got.Time)
+	}
+	if got := counters.Counter("CCC").LastUpdate; !got.Approx || !got.Time.Equal(fetched) || got.Raw != "at some point" {
+		t.Errorf("expected CCC flagged as approximate at the response time, got %+v", got)
+	}
+}
+
+func TestCounters_Archive(t *testing.T) {
+	page := minimalOccupancyHTML("TST", 5, 50)
+	c := NewSourceClient(&Config{Archive: ArchiveConfig{Dir: t.TempDir(), Retention: time.Hour}}, Source{Name: "bldr"})
+	c.client = &MockClient{resp: &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Date": {"Thu, 30 May 2024 10:00:00 GMT"}},
+		Body:       io.NopCloser(strings.NewReader(page)),
+	}}
+	c.archive.now = func() time.Time { return time.Date(2024, time.May, 30, 10, 0, 0, 0, time.UTC) }
+
+	if _, err := c.Counters(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	pages, err := c.archive.Pages("bldr")
+	if err != nil || len(pages) != 1 {
+		t.Fatalf("expected one archived page, got %v, %v", pages, err)
+	}
+	if want := time.Date(2024, time.May, 30, 10, 0, 0, 0, time.UTC); !pages[0].FetchedAt.Equal(want) {
+		t.Errorf("expected the page to be keyed by %v, got %v", want, pages[0].FetchedAt)
+	}
+	if got, _ := pages[0].Read(); string(got) != page {
+		t.Errorf("expected the raw page, got %q", got)
+	}
+}
@@ -1,24 +1,267 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"os"
+	"strconv"
 	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
+// Defaults for scraping: timeouts, the size limit and retries.
+const (
+	defaultConnectTimeout = 10 * time.Second
+	defaultReadTimeout    = 30 * time.Second
+	defaultFetchTimeout   = 2 * time.Minute
+	defaultMaxBodySize    = 4 << 20
+
+	defaultRetryAttempts   = 3
+	defaultRetryMinDelay   = time.Second
+	defaultRetryMaxDelay   = 30 * time.Second
+	defaultBreakerFailures = 5
+	defaultBreakerCooldown = 5 * time.Minute
+
+	defaultArchiveRetention = 30 * 24 * time.Hour
+
+	defaultInactiveAfter = 24 * time.Hour
+
+	defaultHealthStale    = 3 * time.Hour
+	defaultHealthThrottle = time.Hour
+)
+
+// defaultMaxSession is how long a gym session may stay open before the
+// check-out job closes it.
+const defaultMaxSession = 4 * time.Hour
+
 type Config struct {
-	PGK      string
-	FID      string
-	Gym      string
-	BotToken string
-	Storage  string
+	PGK         string
+	FID         string
+	Gym         string
+	BotToken    string
+	Storage     string
+	Schedule    map[string]string
+	MaxSession  time.Duration
+	ClosingTime time.Duration
+	// Sources are the rockgympro organizations to follow. Without any in the
+	// config file, PGK and FID make up the only one.
+	Sources []Source
+	// Gyms holds the settings of individual gyms, by gym key.
+	Gyms map[string]GymConfig
+	// InactiveAfter is how long a gym may be missing from its source's page
+	// before it's marked inactive.
+	InactiveAfter time.Duration
+	Alerts        AlertDefaults
+	HTTP          HTTPConfig
+	Retry         RetryConfig
+	// MetricsAddr is where to serve metrics, if anywhere.
+	MetricsAddr string
+	Archive     ArchiveConfig
+	// AdminChat is the chat to report scraper problems to, if any.
+	AdminChat int64
+	Health    HealthConfig
+}
+
+// HealthConfig tunes the scraper health checks.
+type HealthConfig struct {
+	// Stale is how long a gym's update time may stay the same before it counts as stuck.
+	Stale time.Duration
+	// Throttle is how long to wait before reporting the same problem again.
+	Throttle time.Duration
+}
+
+// ArchiveConfig sets where to keep the raw pages scraped, if anywhere, and for how long.
+type ArchiveConfig struct {
+	Dir       string
+	Retention time.Duration
+}
+
+// HTTPConfig limits how long scraping may take and how much it may read.
+// Zero values mean no limit.
+type HTTPConfig struct {
+	// ConnectTimeout limits connecting, including the TLS handshake.
+	ConnectTimeout time.Duration
+	// ReadTimeout limits waiting for the response headers once the request is sent.
+	ReadTimeout time.Duration
+	// Timeout limits a whole scrape of a source, retries included.
+	Timeout     time.Duration
+	MaxBodySize int64
+}
+
+// withTimeout returns ctx limited to the config's total timeout.
+func (hc HTTPConfig) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if hc.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, hc.Timeout)
+}
+
+// RetryConfig controls how failed scrapes are retried and when to stop
+// scraping for a while. Attempts below 2 mean no retries and no
+// BreakerFailures mean the breaker never opens.
+type RetryConfig struct {
+	Attempts        int
+	MinDelay        time.Duration
+	MaxDelay        time.Duration
+	BreakerFailures int
+	BreakerCooldown time.Duration
+}
+
+// Source is a rockgympro organization. The gym keys of a named source are
+// prefixed with its name, e.g. "BLDR-SLB", so that the gyms of different
+// organizations can share an abbreviation.
+type Source struct {
+	Name string
+	PGK  string
+	FID  string
+	// Schedule adds jobs that fetch counters from this source only.
 	Schedule map[string]string
+	// JSON, when set, makes this a JSON endpoint rather than a rockgympro organization.
+	JSON *JSONSource
+}
+
+// JSONSource is a JSON HTTP endpoint with the occupancy of a single gym.
+// Count, Capacity, Updated and Name are dot-separated paths into the response,
+// e.g. "data.locations.0.count".
+type JSONSource struct {
+	URL      string `yaml:"url"`
+	Gym      string `yaml:"gym"`
+	Count    string `yaml:"count"`
+	Capacity string `yaml:"capacity"`
+	Updated  string `yaml:"updated"`
+	Name     string `yaml:"name"`
+}
+
+// GymKey returns the key the source's gym goes by.
+func (src Source) GymKey(key string) string {
+	if src.Name == "" {
+		return key
+	}
+	return strings.ToUpper(src.Name) + "-" + key
+}
+
+// Owns reports whether the gym key belongs to one of the source's gyms.
+func (src Source) Owns(gymKey string) bool {
+	return src.Name == "" || strings.HasPrefix(gymKey, strings.ToUpper(src.Name)+"-")
+}
+
+// GymConfig holds the settings of a single gym that differ from the global ones.
+type GymConfig struct {
+	// Name is how bot replies call the gym, e.g. "Brooklyn Boulders".
+	Name string
+	// Schedule adds jobs that fetch counters for this gym only.
+	Schedule    map[string]string
+	ClosingTime time.Duration
+	// Location is the gym's timezone, which the update times on its page are in.
+	Location *time.Location
+}
+
+// AlertDefaults apply to new alerts that don't set their own expiry or quiet hours.
+type AlertDefaults struct {
+	Expiry    time.Duration
+	QuietFrom time.Duration
+	QuietTo   time.Duration
 }
 
+// fileConfig is the layout of the config file.
+type fileConfig struct {
+	PGK      string            `yaml:"pgk"`
+	FID      string            `yaml:"fid"`
+	Gym      string            `yaml:"gym"`
+	BotToken string            `yaml:"bot_token"`
+	Storage  string            `yaml:"storage"`
+	Schedule map[string]string `yaml:"schedule"`
+	Sources  []struct {
+		Name     string            `yaml:"name"`
+		PGK      string            `yaml:"pgk"`
+		FID      string            `yaml:"fid"`
+		Schedule map[string]string `yaml:"schedule"`
+		JSON     *JSONSource       `yaml:"json"`
+	} `yaml:"sources"`
+	Sessions struct {
+		MaxDuration string `yaml:"max_duration"`
+		ClosingTime string `yaml:"closing_time"`
+	} `yaml:"sessions"`
+	InactiveAfter string `yaml:"inactive_after"`
+	Gyms          map[string]struct {
+		Name        string            `yaml:"name"`
+		Schedule    map[string]string `yaml:"schedule"`
+		ClosingTime string            `yaml:"closing_time"`
+		Timezone    string            `yaml:"timezone"`
+	} `yaml:"gyms"`
+	Alerts struct {
+		Expiry string `yaml:"expiry"`
+		Quiet  string `yaml:"quiet"`
+	} `yaml:"alerts"`
+	HTTP struct {
+		ConnectTimeout string `yaml:"connect_timeout"`
+		ReadTimeout    string `yaml:"read_timeout"`
+		Timeout        string `yaml:"timeout"`
+		MaxBodySize    *int64 `yaml:"max_body_size"`
+	} `yaml:"http"`
+	Retry struct {
+		Attempts *int   `yaml:"attempts"`
+		MinDelay string `yaml:"min_delay"`
+		MaxDelay string `yaml:"max_delay"`
+	} `yaml:"retry"`
+	Breaker struct {
+		Failures *int   `yaml:"failures"`
+		Cooldown string `yaml:"cooldown"`
+	} `yaml:"breaker"`
+	MetricsAddr string `yaml:"metrics_addr"`
+	Archive     struct {
+		Dir       string `yaml:"dir"`
+		Retention string `yaml:"retention"`
+	} `yaml:"archive"`
+	AdminChat int64 `yaml:"admin_chat"`
+	Health    struct {
+		Stale    string `yaml:"stale"`
+		Throttle string `yaml:"throttle"`
+	} `yaml:"health"`
+}
+
+// NewConfig loads the config file named by the CONFIG env var, if any, and the env vars.
 func NewConfig() (*Config, error) {
+	return LoadConfig(os.Getenv("CONFIG"))
+}
+
+// LoadConfig loads the config from the YAML file at path, unless path is
+// empty, with env vars overriding the file's values.
+func LoadConfig(path string) (*Config, error) {
 	cfg := Config{
-		Schedule: make(map[string]string),
+		Schedule:      make(map[string]string),
+		MaxSession:    defaultMaxSession,
+		Gyms:          make(map[string]GymConfig),
+		InactiveAfter: defaultInactiveAfter,
+		HTTP: HTTPConfig{
+			ConnectTimeout: defaultConnectTimeout,
+			ReadTimeout:    defaultReadTimeout,
+			Timeout:        defaultFetchTimeout,
+			MaxBodySize:    defaultMaxBodySize,
+		},
+		Retry: RetryConfig{
+			Attempts:        defaultRetryAttempts,
+			MinDelay:        defaultRetryMinDelay,
+			MaxDelay:        defaultRetryMaxDelay,
+			BreakerFailures: defaultBreakerFailures,
+			BreakerCooldown: defaultBreakerCooldown,
+		},
+		Archive: ArchiveConfig{Retention: defaultArchiveRetention},
+		Health:  HealthConfig{Stale: defaultHealthStale, Throttle: defaultHealthThrottle},
+	}
+
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return &cfg, fmt.Errorf("config file %s: %w", path, err)
+		}
 	}
+
 	envVars := map[string]*string{
 		"PGK":       &cfg.PGK,
 		"FID":       &cfg.FID,
@@ -28,11 +271,16 @@ func NewConfig() (*Config, error) {
 	}
 
 	for key, ptr := range envVars {
-		val, ok := os.LookupEnv(key)
-		if key != "STORAGE" && !ok {
+		if val, ok := os.LookupEnv(key); ok {
+			*ptr = val
+		}
+		optional := key == "STORAGE" || (len(cfg.Sources) > 0 && (key == "PGK" || key == "FID"))
+		if !optional && *ptr == "" {
+			if path != "" {
+				return &cfg, fmt.Errorf("the required env var %q is not set, nor is %q in the config file", key, strings.ToLower(key))
+			}
 			return &cfg, fmt.Errorf("the required env var %q is not set", key)
 		}
-		*ptr = val
 	}
 
 	if val, ok := os.LookupEnv("SCHEDULE"); ok {
@@ -40,9 +288,241 @@ func NewConfig() (*Config, error) {
 			if strings.Contains(subVal, "=") {
 				kv := strings.SplitN(subVal, "=", 2)
 				cfg.Schedule[kv[0]] = kv[1]
+			} else {
+				slog.Warn("skipping malformed schedule entry", "component", "config", "entry", subVal)
+			}
+		}
+	}
+
+	if val, ok := os.LookupEnv("MAX_SESSION"); ok {
+		d, err := parsePositiveDuration(val)
+		if err != nil {
+			return &cfg, fmt.Errorf("the env var %q must be a positive duration, got %q", "MAX_SESSION", val)
+		}
+		cfg.MaxSession = d
+	}
+
+	if val, ok := os.LookupEnv("CLOSING_TIME"); ok {
+		d, err := parseClock(val)
+		if err != nil {
+			return &cfg, fmt.Errorf("the env var %q must be a time of day like 22:30, got %q", "CLOSING_TIME", val)
+		}
+		cfg.ClosingTime = d
+	}
+
+	if val, ok := os.LookupEnv("METRICS_ADDR"); ok {
+		cfg.MetricsAddr = val
+	}
+
+	if val, ok := os.LookupEnv("ARCHIVE_DIR"); ok {
+		cfg.Archive.Dir = val
+	}
+
+	if val, ok := os.LookupEnv("ADMIN_CHAT"); ok {
+		// Empty turns off reporting to the chat from the config file
+		var id int64
+		if val != "" {
+			var err error
+			if id, err = strconv.ParseInt(val, 10, 64); err != nil {
+				return &cfg, fmt.Errorf("the env var %q must be a chat ID, got %q", "ADMIN_CHAT", val)
 			}
 		}
+		cfg.AdminChat = id
+	}
+
+	if len(cfg.Sources) == 0 {
+		cfg.Sources = []Source{{PGK: cfg.PGK, FID: cfg.FID}}
 	}
 
 	return &cfg, nil
 }
+
+// GymClosingTime returns the closing time of the gym, falling back to the global one.
+func (cfg *Config) GymClosingTime(gymKey string) time.Duration {
+	if gc, ok := cfg.Gyms[gymKey]; ok && gc.ClosingTime > 0 {
+		return gc.ClosingTime
+	}
+	return cfg.ClosingTime
+}
+
+// GymName returns the display name of the gym, or "" if it has none.
+func (cfg *Config) GymName(gymKey string) string {
+	return cfg.Gyms[gymKey].Name
+}
+
+// GymLocation returns the timezone of the gym, falling back to the local one.
+func (cfg *Config) GymLocation(gymKey string) *time.Location {
+	if gc, ok := cfg.Gyms[gymKey]; ok && gc.Location != nil {
+		return gc.Location
+	}
+	return time.Local
+}
+
+// loadFile reads the YAML config file into cfg, naming the offending key on errors.
+func (cfg *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var fc fileConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&fc); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	cfg.PGK, cfg.FID, cfg.Gym, cfg.BotToken, cfg.Storage = fc.PGK, fc.FID, fc.Gym, fc.BotToken, fc.Storage
+	for key, crontab := range fc.Schedule {
+		cfg.Schedule[key] = crontab
+	}
+
+	for i, src := range fc.Sources {
+		switch {
+		case src.JSON != nil && (src.JSON.URL == "" || src.JSON.Gym == "" || src.JSON.Count == ""):
+			return fmt.Errorf("sources[%d].json: url, gym and count are required", i)
+		case src.JSON == nil && (src.PGK == "" || src.FID == ""):
+			return fmt.Errorf("sources[%d]: both pgk and fid are required", i)
+		}
+		if src.JSON != nil {
+			// Bot commands uppercase the gym they are given, as rockgympro keys are
+			src.JSON.Gym = strings.ToUpper(src.JSON.Gym)
+		}
+		cfg.Sources = append(cfg.Sources, Source{Name: src.Name, PGK: src.PGK, FID: src.FID, Schedule: src.Schedule, JSON: src.JSON})
+	}
+
+	if val := fc.Sessions.MaxDuration; val != "" {
+		if cfg.MaxSession, err = parsePositiveDuration(val); err != nil {
+			return fmt.Errorf("sessions.max_duration: must be a positive duration like 4h, got %q", val)
+		}
+	}
+	if val := fc.Sessions.ClosingTime; val != "" {
+		if cfg.ClosingTime, err = parseClock(val); err != nil {
+			return fmt.Errorf("sessions.closing_time: must be a time of day like 22:30, got %q", val)
+		}
+	}
+
+	if val := fc.InactiveAfter; val != "" {
+		if cfg.InactiveAfter, err = parsePositiveDuration(val); err != nil {
+			return fmt.Errorf("inactive_after: must be a positive duration like 24h, got %q", val)
+		}
+	}
+
+	for key, g := range fc.Gyms {
+		gc := GymConfig{Name: g.Name, Schedule: g.Schedule}
+		if val := g.ClosingTime; val != "" {
+			if gc.ClosingTime, err = parseClock(val); err != nil {
+				return fmt.Errorf("gyms.%s.closing_time: must be a time of day like 22:30, got %q", key, val)
+			}
+		}
+		if val := g.Timezone; val != "" {
+			if gc.Location, err = time.LoadLocation(val); err != nil {
+				return fmt.Errorf("gyms.%s.timezone: must be a timezone like America/New_York, got %q", key, val)
+			}
+		}
+		cfg.Gyms[strings.ToUpper(key)] = gc
+	}
+
+	if val := fc.Alerts.Expiry; val != "" {
+		if cfg.Alerts.Expiry, err = parsePositiveDuration(val); err != nil {
+			return fmt.Errorf("alerts.expiry: must be a positive duration like 3h, got %q", val)
+		}
+	}
+	if val := fc.Alerts.Quiet; val != "" {
+		if cfg.Alerts.QuietFrom, cfg.Alerts.QuietTo, err = parseHours(val); err != nil {
+			return fmt.Errorf("alerts.quiet: must be a range of hours like 22-07, got %q", val)
+		}
+	}
+
+	for _, t := range []struct {
+		key, val string
+		d        *time.Duration
+	}{
+		{"connect_timeout", fc.HTTP.ConnectTimeout, &cfg.HTTP.ConnectTimeout},
+		{"read_timeout", fc.HTTP.ReadTimeout, &cfg.HTTP.ReadTimeout},
+		{"timeout", fc.HTTP.Timeout, &cfg.HTTP.Timeout},
+	} {
+		if t.val == "" {
+			continue
+		}
+		if *t.d, err = parsePositiveDuration(t.val); err != nil {
+			return fmt.Errorf("http.%s: must be a positive duration like 30s, got %q", t.key, t.val)
+		}
+	}
+	if n := fc.HTTP.MaxBodySize; n != nil {
+		if *n <= 0 {
+			return fmt.Errorf("http.max_body_size: must be a positive number of bytes, got %d", *n)
+		}
+		cfg.HTTP.MaxBodySize = *n
+	}
+
+	if n := fc.Retry.Attempts; n != nil {
+		if *n < 1 {
+			return fmt.Errorf("retry.attempts: must be at least 1, got %d", *n)
+		}
+		cfg.Retry.Attempts = *n
+	}
+	if val := fc.Retry.MinDelay; val != "" {
+		if cfg.Retry.MinDelay, err = parsePositiveDuration(val); err != nil {
+			return fmt.Errorf("retry.min_delay: must be a positive duration like 1s, got %q", val)
+		}
+	}
+	if val := fc.Retry.MaxDelay; val != "" {
+		if cfg.Retry.MaxDelay, err = parsePositiveDuration(val); err != nil {
+			return fmt.Errorf("retry.max_delay: must be a positive duration like 30s, got %q", val)
+		}
+	}
+	if cfg.Retry.MaxDelay < cfg.Retry.MinDelay {
+		return fmt.Errorf("retry.max_delay: must not be less than min_delay %s", cfg.Retry.MinDelay)
+	}
+	if n := fc.Breaker.Failures; n != nil {
+		if *n < 0 {
+			return fmt.Errorf("breaker.failures: must not be negative, got %d", *n)
+		}
+		cfg.Retry.BreakerFailures = *n
+	}
+	if val := fc.Breaker.Cooldown; val != "" {
+		if cfg.Retry.BreakerCooldown, err = parsePositiveDuration(val); err != nil {
+			return fmt.Errorf("breaker.cooldown: must be a positive duration like 5m, got %q", val)
+		}
+	}
+	cfg.MetricsAddr = fc.MetricsAddr
+
+	cfg.Archive.Dir = fc.Archive.Dir
+	if val := fc.Archive.Retention; val != "" {
+		if cfg.Archive.Retention, err = parsePositiveDuration(val); err != nil {
+			return fmt.Errorf("archive.retention: must be a positive duration like 720h, got %q", val)
+		}
+	}
+
+	cfg.AdminChat = fc.AdminChat
+	if val := fc.Health.Stale; val != "" {
+		if cfg.Health.Stale, err = parsePositiveDuration(val); err != nil {
+			return fmt.Errorf("health.stale: must be a positive duration like 3h, got %q", val)
+		}
+	}
+	if val := fc.Health.Throttle; val != "" {
+		if cfg.Health.Throttle, err = parsePositiveDuration(val); err != nil {
+			return fmt.Errorf("health.throttle: must be a positive duration like 1h, got %q", val)
+		}
+	}
+
+	return nil
+}
+
+func parsePositiveDuration(val string) (time.Duration, error) {
+	d, err := time.ParseDuration(val)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("duration %q is not positive", val)
+	}
+	return d, err
+}
+
+// parseClock parses a 24-hour "HH:MM" time of day into the offset since midnight.
+func parseClock(val string) (time.Duration, error) {
+	t, err := time.Parse("15:04", val)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
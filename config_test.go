@@ -2,8 +2,11 @@ package main
 
 import (
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 func setEnvVars(t *testing.T, envVars map[string]string) {
@@ -188,3 +191,345 @@ func TestNewConfig_WithMalformedEnvVar(t *testing.T) {
 		t.Errorf("did not expect task2 in Schedule, got %v", cfg.Schedule)
 	}
 }
+
+func TestNewConfig_Sessions(t *testing.T) {
+	envVars := map[string]string{
+		"PGK":          "pgk_value",
+		"FID":          "fid_value",
+		"GYM":          "gym_value",
+		"BOT_TOKEN":    "bot_token_value",
+		"MAX_SESSION":  "3h30m",
+		"CLOSING_TIME": "22:45",
+	}
+	setEnvVars(t, envVars)
+	defer unsetEnvVars(t, envVars)
+
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cfg.MaxSession != 3*time.Hour+30*time.Minute {
+		t.Errorf("expected MaxSession 3h30m, got %v", cfg.MaxSession)
+	}
+	if cfg.ClosingTime != 22*time.Hour+45*time.Minute {
+		t.Errorf("expected ClosingTime 22:45, got %v", cfg.ClosingTime)
+	}
+}
+
+func TestNewConfig_SessionsDefaults(t *testing.T) {
+	envVars := map[string]string{
+		"PGK":       "pgk_value",
+		"FID":       "fid_value",
+		"GYM":       "gym_value",
+		"BOT_TOKEN": "bot_token_value",
+	}
+	setEnvVars(t, envVars)
+	defer unsetEnvVars(t, envVars)
+
+	cfg, err := NewConfig()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cfg.MaxSession != defaultMaxSession {
+		t.Errorf("expected default MaxSession %v, got %v", defaultMaxSession, cfg.MaxSession)
+	}
+	if cfg.ClosingTime != 0 {
+		t.Errorf("expected no ClosingTime, got %v", cfg.ClosingTime)
+	}
+}
+
+func TestNewConfig_MalformedSessions(t *testing.T) {
+	for key, val := range map[string]string{"MAX_SESSION": "four hours", "CLOSING_TIME": "10pm"} {
+		envVars := map[string]string{
+			"PGK":       "pgk_value",
+			"FID":       "fid_value",
+			"GYM":       "gym_value",
+			"BOT_TOKEN": "bot_token_value",
+			key:         val,
+		}
+		setEnvVars(t, envVars)
+
+		if _, err := NewConfig(); err == nil {
+			t.Errorf("expected an error for %s=%q, got nil", key, val)
+		}
+
+		unsetEnvVars(t, envVars)
+	}
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("can't write config file: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfig_File(t *testing.T) {
+	path := writeConfigFile(t, `
+pgk: pgk_value
+fid: fid_value
+gym: SLB
+bot_token: bot_token_value
+storage: /data
+schedule:
+  every-minute: "0 * * * * *"
+sessions:
+  max_duration: 3h
+  closing_time: "22:00"
+inactive_after: 72h
+gyms:
+  sbg:
+    name: Stone Gardens
+    schedule:
+      peak: "0 */5 17-20 * * *"
+    closing_time: "23:00"
+    timezone: UTC
+alerts:
+  expiry: 6h
+  quiet: 22-07
+http:
+  connect_timeout: 5s
+  timeout: 1m
+  max_body_size: 1048576
+retry:
+  attempts: 4
+  min_delay: 2s
+breaker:
+  failures: 0
+metrics_addr: ":9090"
+archive:
+  dir: /data/archive
+  retention: 168h
+admin_chat: -1001234567890
+health:
+  stale: 2h
+`)
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := &Config{
+		PGK:         "pgk_value",
+		FID:         "fid_value",
+		Gym:         "SLB",
+		BotToken:    "bot_token_value",
+		Storage:     "/data",
+		Schedule:    map[string]string{"every-minute": "0 * * * * *"},
+		MaxSession:  3 * time.Hour,
+		ClosingTime: 22 * time.Hour,
+		Sources:     []Source{{PGK: "pgk_value", FID: "fid_value"}},
+		Gyms: map[string]GymConfig{
+			"SBG": {Name: "Stone Gardens", Schedule: map[string]string{"peak": "0 */5 17-20 * * *"}, ClosingTime: 23 * time.Hour, Location: time.UTC},
+		},
+		InactiveAfter: 72 * time.Hour,
+		Alerts:        AlertDefaults{Expiry: 6 * time.Hour, QuietFrom: 22 * time.Hour, QuietTo: 7 * time.Hour},
+		HTTP: HTTPConfig{
+			ConnectTimeout: 5 * time.Second,
+			ReadTimeout:    defaultReadTimeout,
+			Timeout:        time.Minute,
+			MaxBodySize:    1 << 20,
+		},
+		Retry: RetryConfig{
+			Attempts:        4,
+			MinDelay:        2 * time.Second,
+			MaxDelay:        defaultRetryMaxDelay,
+			BreakerFailures: 0,
+			BreakerCooldown: defaultBreakerCooldown,
+		},
+		MetricsAddr: ":9090",
+		Archive:     ArchiveConfig{Dir: "/data/archive", Retention: 7 * 24 * time.Hour},
+		AdminChat:   -1001234567890,
+		Health:      HealthConfig{Stale: 2 * time.Hour, Throttle: defaultHealthThrottle},
+	}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("expected config %+v, got %+v", want, cfg)
+	}
+	if got := cfg.GymClosingTime("SBG"); got != 23*time.Hour {
+		t.Errorf("expected SBG to close at 23:00, got %v", got)
+	}
+	if got := cfg.GymClosingTime("SLB"); got != 22*time.Hour {
+		t.Errorf("expected SLB to close at 22:00, got %v", got)
+	}
+	if got := cfg.GymName("SLB"); got != "" {
+		t.Errorf("expected SLB to have no name, got %q", got)
+	}
+	if got := cfg.GymLocation("SBG"); got != time.UTC {
+		t.Errorf("expected SBG in UTC, got %v", got)
+	}
+	if got := cfg.GymLocation("SLB"); got != time.Local {
+		t.Errorf("expected SLB in the local timezone, got %v", got)
+	}
+}
+
+func TestLoadConfig_EnvOverridesFile(t *testing.T) {
+	path := writeConfigFile(t, `
+pgk: pgk_value
+fid: fid_value
+gym: SLB
+bot_token: bot_token_value
+schedule:
+  every-minute: "0 * * * * *"
+`)
+	envVars := map[string]string{
+		"GYM":      "SBG",
+		"SCHEDULE": "every-minute=30 * * * * *",
+	}
+	setEnvVars(t, envVars)
+	defer unsetEnvVars(t, envVars)
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Gym != "SBG" {
+		t.Errorf("expected GYM from env %q, got %q", "SBG", cfg.Gym)
+	}
+	if cfg.PGK != "pgk_value" {
+		t.Errorf("expected PGK from file %q, got %q", "pgk_value", cfg.PGK)
+	}
+	if got := cfg.Schedule["every-minute"]; got != "30 * * * * *" {
+		t.Errorf("expected schedule from env %q, got %q", "30 * * * * *", got)
+	}
+}
+
+func TestLoadConfig_EmptyEnvOverridesFile(t *testing.T) {
+	path := writeConfigFile(t, `
+pgk: pgk_value
+fid: fid_value
+gym: SLB
+bot_token: bot_token_value
+storage: /data
+metrics_addr: ":9090"
+admin_chat: 42
+archive:
+  dir: /archive
+`)
+	envVars := map[string]string{"STORAGE": "", "METRICS_ADDR": "", "ADMIN_CHAT": "", "ARCHIVE_DIR": ""}
+	setEnvVars(t, envVars)
+	defer unsetEnvVars(t, envVars)
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.Storage != "" || cfg.MetricsAddr != "" || cfg.AdminChat != 0 || cfg.Archive.Dir != "" {
+		t.Errorf("expected the empty env vars to clear the file's values, got storage %q, metrics %q, admin chat %d, archive %q",
+			cfg.Storage, cfg.MetricsAddr, cfg.AdminChat, cfg.Archive.Dir)
+	}
+}
+
+func TestLoadConfig_FileErrors(t *testing.T) {
+	required := "pgk: p\nfid: f\ngym: g\nbot_token: t\n"
+	cases := []struct {
+		content string
+		want    string
+	}{
+		{required + "sessions:\n  max_duration: forever\n", "sessions.max_duration"},
+		{required + "sessions:\n  closing_time: 10pm\n", "sessions.closing_time"},
+		{required + "gyms:\n  SLB:\n    closing_time: late\n", "gyms.SLB.closing_time"},
+		{required + "gyms:\n  SLB:\n    timezone: Mars/Olympus\n", "gyms.SLB.timezone"},
+		{required + "archive:\n  retention: forever\n", "archive.retention"},
+		{required + "health:\n  throttle: never\n", "health.throttle"},
+		{required + "inactive_after: soon\n", "inactive_after"},
+		{required + "alerts:\n  expiry: -1h\n", "alerts.expiry"},
+		{required + "alerts:\n  quiet: nights\n", "alerts.quiet"},
+		{required + "http:\n  read_timeout: 0s\n", "http.read_timeout"},
+		{required + "http:\n  max_body_size: -1\n", "http.max_body_size"},
+		{required + "retry:\n  attempts: 0\n", "retry.attempts"},
+		{required + "retry:\n  min_delay: 1m\n  max_delay: 1s\n", "retry.max_delay"},
+		{required + "breaker:\n  cooldown: soon\n", "breaker.cooldown"},
+		{required + "schedul:\n  a: b\n", "schedul"},
+		{"pgk: p\nfid: f\ngym: g\n", `"bot_token"`},
+		{"gym: g\nbot_token: t\nsources:\n  - name: a\n    pgk: p\n", "sources[0]"},
+	}
+	for _, tc := range cases {
+		_, err := LoadConfig(writeConfigFile(t, tc.content))
+		if err == nil {
+			t.Errorf("expected an error mentioning %q, got nil", tc.want)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("expected error mentioning %q, got %q", tc.want, err)
+		}
+	}
+}
+
+func TestLoadConfig_MissingFile(t *testing.T) {
+	if _, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Fatal("expected an error for a missing config file, got nil")
+	}
+}
+
+func TestLoadConfig_Sources(t *testing.T) {
+	path := writeConfigFile(t, `
+gym: BLDR-SLB
+bot_token: bot_token_value
+sources:
+  - name: bldr
+    pgk: pgk_one
+    fid: fid_one
+    schedule:
+      often: "0 */5 * * * *"
+  - name: rope
+    pgk: pgk_two
+    fid: fid_two
+`)
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []Source{
+		{Name: "bldr", PGK: "pgk_one", FID: "fid_one", Schedule: map[string]string{"often": "0 */5 * * * *"}},
+		{Name: "rope", PGK: "pgk_two", FID: "fid_two"},
+	}
+	if !reflect.DeepEqual(cfg.Sources, want) {
+		t.Errorf("expected sources %+v, got %+v", want, cfg.Sources)
+	}
+}
+
+func TestLoadConfig_JSONGymUppercased(t *testing.T) {
+	path := writeConfigFile(t, `
+gym: BB-DOWNTOWN
+bot_token: bot_token_value
+sources:
+  - name: bb
+    json:
+      url: https://example.com/occupancy
+      gym: downtown
+      count: count
+`)
+
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	src := cfg.Sources[0]
+	if got := src.GymKey(src.JSON.Gym); got != "BB-DOWNTOWN" {
+		t.Errorf("expected the gym key as bot commands spell it, got %q", got)
+	}
+}
+
+func TestSource_GymKey(t *testing.T) {
+	named := Source{Name: "bldr"}
+	if got := named.GymKey("SLB"); got != "BLDR-SLB" {
+		t.Errorf("expected BLDR-SLB, got %q", got)
+	}
+	if !named.Owns("BLDR-SLB") || named.Owns("ROPE-SLB") || named.Owns("SLB") {
+		t.Error("expected a named source to own only its prefixed gyms")
+	}
+
+	unnamed := Source{}
+	if got := unnamed.GymKey("SLB"); got != "SLB" {
+		t.Errorf("expected SLB, got %q", got)
+	}
+	if !unnamed.Owns("SLB") {
+		t.Error("expected an unnamed source to own every gym")
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"log/slog"
 	"regexp"
 	"strconv"
 	"strings"
@@ -28,6 +30,48 @@ type Counter struct {
 	Count      int        `json:"count"`
 	Capacity   int        `json:"capacity"`
 	LastUpdate LastUpdate `json:"lastUpdate"`
+	// Name is the gym's display name, if the page gives one.
+	Name string `json:"name"`
+	// Extra holds the other numeric fields of the gym's entry in the page.
+	Extra map[string]float64 `json:"-"`
+}
+
+// UnmarshalJSON reads the known fields and keeps any other numeric ones in Extra.
+func (c *Counter) UnmarshalJSON(data []byte) error {
+	type counter Counter
+	if err := json.Unmarshal(data, (*counter)(c)); err != nil {
+		return err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	c.Extra = nil
+	for k, raw := range fields {
+		switch k {
+		case "count", "capacity", "lastUpdate", "name":
+			continue
+		}
+		var v float64
+		if json.Unmarshal(raw, &v) != nil {
+			continue
+		}
+		if c.Extra == nil {
+			c.Extra = make(map[string]float64)
+		}
+		c.Extra[k] = v
+	}
+	return nil
+}
+
+// Label returns how to refer to the gym with the given key, e.g.
+// "Brooklyn Boulders (BKB)", or just the key if the gym has no name.
+func (c Counter) Label(gymKey string) string {
+	if c.Name == "" {
+		return gymKey
+	}
+	return fmt.Sprintf("%s (%s)", c.Name, gymKey)
 }
 
 func (c Counter) String() string {
@@ -47,40 +91,81 @@ func (c Counter) String() string {
 	return fmt.Sprintf("%s there've been %s %s on the wall", lastUpdate, peopleCount, peopleCounter)
 }
 
+// inLocation returns copies of the counters with their update times in loc.
+func inLocation(counters []Counter, loc *time.Location) []Counter {
+	out := make([]Counter, len(counters))
+	for i, c := range counters {
+		c.LastUpdate.Time = c.LastUpdate.In(loc)
+		out[i] = c
+	}
+	return out
+}
+
+// LastUpdate is when the gym's counter was last updated. Raw keeps the
+// update time as the page gave it, e.g. "8 mins ago (10:09 AM)", until it
+// can be resolved against the fetch time and the gym's timezone.
 type LastUpdate struct {
 	time.Time
+	Raw string
+	// Approx is set when Raw couldn't be read and Time is the fetch time instead.
+	Approx bool
 }
 
-var reRelative = regexp.MustCompile(`(?i)(\d+)?\s?(day|hour|min|mins|days|hours)s?ago`)
-var reNow = regexp.MustCompile(`(?i)now`)
+var reRelative = regexp.MustCompile(`(?i)(\d+)?\s*(day|hour|min|mins|days|hours)s?\s*ago`)
+var reNow = regexp.MustCompile(`(?i)\bnow\b`)
+var reClock = regexp.MustCompile(`(?i)\b(\d{1,2}):(\d{2})\s*([ap]\.?m\.?)?`)
+var reYesterday = regexp.MustCompile(`(?i)\byesterday\b`)
+var reDate = regexp.MustCompile(`(?i)\b(jan|feb|mar|apr|may|jun|jul|aug|sep|oct|nov|dec)[a-z]*\.?\s+(\d{1,2})\b(?:,?\s+(\d{4})\b)?`)
 
+// UnmarshalJSON only keeps the raw update time, for Resolve to work out
+// once the fetch time and the gym's timezone are known.
 func (lu *LastUpdate) UnmarshalJSON(data []byte) error {
 	str := strings.Trim(string(data), `"`)
-	if str == "" || str == "null" {
-		lu.Time = time.Time{}
-		return nil
+	*lu = LastUpdate{}
+	if str != "" && str != "null" {
+		lu.Raw = str
 	}
+	return nil
+}
 
-	now := time.Now()
-	if reNow.MatchString(str) {
+// Resolve works out the update time from Raw, taking relative times from
+// now, the fetch time, and reading clock times in loc. If Raw can't be read
+// the update time is taken to be now and marked as approximate. Update
+// times without Raw are left as they are.
+func (lu *LastUpdate) Resolve(now time.Time, loc *time.Location) {
+	if lu.Raw == "" {
+		return
+	}
+
+	t, err := parseLastUpdate(lu.Raw, now.In(loc))
+	if err != nil {
+		slog.Warn("can't read update time", "component", "counter", "raw", lu.Raw, "msg", err)
 		lu.Time = now.Truncate(time.Minute)
-		return nil
+		lu.Approx = true
+		return
 	}
+	lu.Time = t
+	lu.Approx = false
+}
+
+// parseLastUpdate reads an update time like "now", "8 mins ago",
+// "Today 6:42 PM", "Yesterday 9:15 PM", "Oct 18, 3:10 PM" or "(10:16 AM)".
+// Relative times win over clock times, as they don't depend on the gym's
+// timezone being right.
+func parseLastUpdate(str string, now time.Time) (time.Time, error) {
+	str = strings.NewReplacer("&nbsp;", " ", "&nbsp", " ").Replace(str)
 
-	matches := reRelative.FindStringSubmatch(str)
-	if len(matches) >= 3 {
+	if matches := reRelative.FindStringSubmatch(str); matches != nil {
 		n := 1
 		if matches[1] != "" {
 			var err error
-			n, err = strconv.Atoi(matches[1])
-			if err != nil {
-				return err
+			if n, err = strconv.Atoi(matches[1]); err != nil {
+				return time.Time{}, err
 			}
 		}
 
-		unit := strings.ToLower(matches[2])
 		var d time.Duration
-		switch unit {
+		switch unit := strings.ToLower(matches[2]); unit {
 		case "day", "days":
 			d = time.Hour * 24 * time.Duration(n)
 		case "hour", "hours":
@@ -88,21 +173,60 @@ func (lu *LastUpdate) UnmarshalJSON(data []byte) error {
 		case "min", "mins":
 			d = time.Minute * time.Duration(n)
 		default:
-			return fmt.Errorf("unrecognized time unit: %s", unit)
+			return time.Time{}, fmt.Errorf("unrecognized time unit: %s", unit)
 		}
+		return now.Add(-d).Truncate(time.Minute), nil
+	}
 
-		lu.Time = now.Add(-d).Truncate(time.Minute)
-		return nil
+	if reNow.MatchString(str) {
+		return now.Truncate(time.Minute), nil
 	}
 
-	return fmt.Errorf("invalid time format: %s", str)
-}
+	clock := reClock.FindStringSubmatch(str)
+	if clock == nil {
+		return time.Time{}, fmt.Errorf("invalid time format: %s", str)
+	}
+	hour, _ := strconv.Atoi(clock[1])
+	minute, _ := strconv.Atoi(clock[2])
+	if ampm := strings.ToLower(strings.ReplaceAll(clock[3], ".", "")); ampm != "" {
+		if hour < 1 || hour > 12 {
+			return time.Time{}, fmt.Errorf("invalid hour: %s", str)
+		}
+		hour %= 12
+		if ampm == "pm" {
+			hour += 12
+		}
+	}
+	if hour > 23 || minute > 59 {
+		return time.Time{}, fmt.Errorf("invalid time of day: %s", str)
+	}
 
-// Equal helper added to support equality comparison in tests
-func (lu LastUpdate) Equal(t time.Time) bool {
-	return lu.Year() == t.Year() &&
-		lu.Month() == t.Month() &&
-		lu.Day() == t.Day() &&
-		lu.Hour() == t.Hour() &&
-		lu.Minute() == t.Minute()
+	year, month, day := now.Date()
+	if date := reDate.FindStringSubmatch(str); date != nil {
+		m, _ := time.Parse("Jan", date[1][:1]+strings.ToLower(date[1][1:]))
+		month = m.Month()
+		day, _ = strconv.Atoi(date[2])
+		if date[3] != "" {
+			year, _ = strconv.Atoi(date[3])
+		}
+		t := time.Date(year, month, day, hour, minute, 0, 0, now.Location())
+		if t.Month() != month {
+			return time.Time{}, fmt.Errorf("invalid date: %s", str)
+		}
+		// Without a year the date is the latest one not in the future
+		if date[3] == "" && t.After(now.Add(24*time.Hour)) {
+			t = t.AddDate(-1, 0, 0)
+		}
+		return t, nil
+	}
+
+	t := time.Date(year, month, day, hour, minute, 0, 0, now.Location())
+	if reYesterday.MatchString(str) {
+		return t.AddDate(0, 0, -1), nil
+	}
+	// A bare clock time ahead of now is from before midnight
+	if !strings.Contains(strings.ToLower(str), "today") && t.After(now.Add(time.Hour)) {
+		t = t.AddDate(0, 0, -1)
+	}
+	return t, nil
 }
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -11,87 +13,77 @@ func TestLastUpdate_UnmarshalJSON(t *testing.T) {
 		name     string
 		input    string
 		expected time.Time
-		hasError bool
+		approx   bool
 	}{
 		{
 			name:     "Valid time with one day ago",
 			input:    `"Lastupdated:&nbsp1dayago"`,
 			expected: time.Now().Add(-24 * time.Hour).Truncate(time.Minute),
-			hasError: false,
 		},
 		{
 			name:     "Valid time with two days ago",
 			input:    `"Lastupdated:&nbsp2daysago"`,
 			expected: time.Now().Add(-48 * time.Hour).Truncate(time.Minute),
-			hasError: false,
 		},
 		{
 			name:     "Valid time with one hour ago",
 			input:    `"Lastupdated:&nbsp1hourago"`,
 			expected: time.Now().Add(-1 * time.Hour).Truncate(time.Minute),
-			hasError: false,
 		},
 		{
 			name:     "Valid time with three hours ago",
 			input:    `"Lastupdated:&nbsp3hoursago"`,
 			expected: time.Now().Add(-3 * time.Hour).Truncate(time.Minute),
-			hasError: false,
 		},
 		{
 			name:     "Valid time with one minute ago",
 			input:    `"Lastupdated:&nbsp1minago"`,
 			expected: time.Now().Add(-1 * time.Minute).Truncate(time.Minute),
-			hasError: false,
 		},
 		{
 			name:     "Valid time with twelve minutes ago",
 			input:    `"Lastupdated:&nbsp12minsago"`,
 			expected: time.Now().Add(-12 * time.Minute).Truncate(time.Minute),
-			hasError: false,
 		},
 		{
 			name:     "Valid time with now",
 			input:    `"Lastupdated:&nbspnow "`,
 			expected: time.Now().Truncate(time.Minute),
-			hasError: false,
 		},
 		{
 			name:     "Null input",
 			input:    `null`,
 			expected: time.Time{},
-			hasError: false,
 		},
 		{
 			name:     "Empty string input",
 			input:    `""`,
 			expected: time.Time{},
-			hasError: false,
 		},
 		{
 			name:     "Invalid time format",
 			input:    `"Lastupdated:&nbsp12xxago"`,
-			expected: time.Time{},
-			hasError: true,
+			expected: time.Now().Truncate(time.Minute),
+			approx:   true,
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			var lu LastUpdate
-			err := lu.UnmarshalJSON([]byte(tc.input))
-
-			if tc.hasError {
-				if err == nil {
-					t.Errorf("expected error but got nil")
-				}
-			} else {
-				if err != nil {
-					t.Errorf("expected no error but got %v", err)
-				}
-
-				if !lu.Equal(tc.expected) {
-					t.Errorf("expected %v but got %v", tc.expected, lu)
-				}
+			if err := lu.UnmarshalJSON([]byte(tc.input)); err != nil {
+				t.Fatalf("expected no error but got %v", err)
+			}
+			if !lu.IsZero() || lu.Approx {
+				t.Errorf("expected unmarshal to leave resolving to Resolve, got %v", lu)
+			}
+			lu.Resolve(time.Now(), time.Local)
+
+			if !lu.Time.Equal(tc.expected) {
+				t.Errorf("expected %v but got %v", tc.expected, lu)
+			}
+			if lu.Approx != tc.approx {
+				t.Errorf("expected approx %v but got %v", tc.approx, lu.Approx)
 			}
 		})
 	}
@@ -102,13 +94,13 @@ func TestCounter_String(t *testing.T) {
 		counter Counter
 		want    string
 	}{
-		{Counter{Count: 1, LastUpdate: LastUpdate{time.Now().Add(-2000000 * time.Hour)}}, "a long time ago there've been one person on the wall"},
-		{Counter{Count: 2, LastUpdate: LastUpdate{time.Now()}}, "a few seconds ago there've been 2 people on the wall"},
-		{Counter{Count: 11, LastUpdate: LastUpdate{time.Now()}}, "a few seconds ago there've been 11 people on the wall"},
-		{Counter{Count: 21, LastUpdate: LastUpdate{time.Now()}}, "a few seconds ago there've been 21 person on the wall"},
-		{Counter{Count: 0, LastUpdate: LastUpdate{time.Now().Add(-2000000 * time.Hour)}}, "a long time ago there've been zero people on the wall"},
-		{Counter{Count: 100, LastUpdate: LastUpdate{time.Now().Add(-3 * time.Minute)}}, "3 minutes ago there've been 100 people on the wall"},
-		{Counter{Count: 101, LastUpdate: LastUpdate{time.Now().Add(-2 * time.Hour)}}, "2 hours ago there've been 101 person on the wall"},
+		{Counter{Count: 1, LastUpdate: LastUpdate{Time: time.Now().Add(-2000000 * time.Hour)}}, "a long time ago there've been one person on the wall"},
+		{Counter{Count: 2, LastUpdate: LastUpdate{Time: time.Now()}}, "a few seconds ago there've been 2 people on the wall"},
+		{Counter{Count: 11, LastUpdate: LastUpdate{Time: time.Now()}}, "a few seconds ago there've been 11 people on the wall"},
+		{Counter{Count: 21, LastUpdate: LastUpdate{Time: time.Now()}}, "a few seconds ago there've been 21 person on the wall"},
+		{Counter{Count: 0, LastUpdate: LastUpdate{Time: time.Now().Add(-2000000 * time.Hour)}}, "a long time ago there've been zero people on the wall"},
+		{Counter{Count: 100, LastUpdate: LastUpdate{Time: time.Now().Add(-3 * time.Minute)}}, "3 minutes ago there've been 100 people on the wall"},
+		{Counter{Count: 101, LastUpdate: LastUpdate{Time: time.Now().Add(-2 * time.Hour)}}, "2 hours ago there've been 101 person on the wall"},
 	}
 
 	for _, tt := range tests {
@@ -137,13 +129,111 @@ func TestCounters_Counter(t *testing.T) {
 	counters := &Counters{"GymA": expectedCounter}
 
 	retrievedCounter := counters.Counter(gymName)
-	if retrievedCounter != expectedCounter {
+	if !reflect.DeepEqual(retrievedCounter, expectedCounter) {
 		t.Errorf("expected Counter %v, got %v", expectedCounter, retrievedCounter)
 	}
 
 	nonExistentGym := "GymB"
 	retrievedCounter = counters.Counter(nonExistentGym)
-	if (retrievedCounter != Counter{}) {
+	if !reflect.DeepEqual(retrievedCounter, Counter{}) {
 		t.Errorf("expected default Counter for non-existent gym, got %v", retrievedCounter)
 	}
 }
+
+func TestCounter_UnmarshalJSON_NameAndExtra(t *testing.T) {
+	data := `{"count": 8, "capacity": 60, "lastUpdate": "Last updated:&nbspnow", "name": "Brooklyn Boulders",
+		"subLabel": "Current climber count", "waiting": 3, "lanes": 12.5}`
+
+	var c Counter
+	if err := json.Unmarshal([]byte(data), &c); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.Count != 8 || c.Capacity != 60 || c.Name != "Brooklyn Boulders" {
+		t.Errorf("unexpected counter %+v", c)
+	}
+	want := map[string]float64{"waiting": 3, "lanes": 12.5}
+	if !reflect.DeepEqual(c.Extra, want) {
+		t.Errorf("expected extra %v, got %v", want, c.Extra)
+	}
+}
+
+func TestCounter_Label(t *testing.T) {
+	if got := (Counter{Name: "Brooklyn Boulders"}).Label("BKB"); got != "Brooklyn Boulders (BKB)" {
+		t.Errorf("unexpected label %q", got)
+	}
+	if got := (Counter{}).Label("BKB"); got != "BKB" {
+		t.Errorf("expected the bare key, got %q", got)
+	}
+}
+
+func TestParseLastUpdate(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no tz data: %v", err)
+	}
+	now := time.Date(2024, time.October, 18, 19, 0, 30, 0, ny)
+
+	testCases := []struct {
+		input    string
+		expected time.Time
+	}{
+		{"Last updated:&nbspnow  (6:59 PM)", time.Date(2024, time.October, 18, 19, 0, 0, 0, ny)},
+		{"Last updated:&nbsp8 mins ago (6:52 PM)", time.Date(2024, time.October, 18, 18, 52, 0, 0, ny)},
+		{"Today 6:42 PM", time.Date(2024, time.October, 18, 18, 42, 0, 0, ny)},
+		{"Yesterday 9:15 pm", time.Date(2024, time.October, 17, 21, 15, 0, 0, ny)},
+		{"Oct 18, 3:10 PM", time.Date(2024, time.October, 18, 15, 10, 0, 0, ny)},
+		{"October 2, 2023 10:05 AM", time.Date(2023, time.October, 2, 10, 5, 0, 0, ny)},
+		{"Dec 31, 11:30 PM", time.Date(2023, time.December, 31, 23, 30, 0, 0, ny)},
+		{"Last updated: (10:16 AM)", time.Date(2024, time.October, 18, 10, 16, 0, 0, ny)},
+		{"Last updated: (11:58 PM)", time.Date(2024, time.October, 17, 23, 58, 0, 0, ny)},
+		{"17:05", time.Date(2024, time.October, 18, 17, 5, 0, 0, ny)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			got, err := parseLastUpdate(tc.input, now)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !got.Equal(tc.expected) {
+				t.Errorf("expected %v but got %v", tc.expected, got)
+			}
+		})
+	}
+
+	for _, input := range []string{"soon", "Feb 30, 10:00 AM", "13:00 PM", "25:10"} {
+		if got, err := parseLastUpdate(input, now); err == nil {
+			t.Errorf("expected an error for %q, got %v", input, got)
+		}
+	}
+}
+
+func TestLastUpdate_Resolve(t *testing.T) {
+	fetched := time.Date(2024, time.October, 18, 23, 0, 0, 0, time.UTC)
+	tokyo := time.FixedZone("JST", 9*60*60)
+
+	lu := LastUpdate{Raw: "Today 7:45 AM"}
+	lu.Resolve(fetched, tokyo)
+	if want := time.Date(2024, time.October, 19, 7, 45, 0, 0, tokyo); !lu.Time.Equal(want) || lu.Approx {
+		t.Errorf("expected %v, got %v (approx %v)", want, lu.Time, lu.Approx)
+	}
+
+	lu = LastUpdate{Raw: "5 mins ago"}
+	lu.Resolve(fetched, tokyo)
+	if want := fetched.Add(-5 * time.Minute); !lu.Time.Equal(want) {
+		t.Errorf("expected %v, got %v", want, lu.Time)
+	}
+
+	lu = LastUpdate{Raw: "whenever"}
+	lu.Resolve(fetched, tokyo)
+	if !lu.Approx || !lu.Time.Equal(fetched) {
+		t.Errorf("expected an approximate fetch time, got %v (approx %v)", lu.Time, lu.Approx)
+	}
+
+	// Update times that didn't come from a page are left alone
+	lu = LastUpdate{Time: fetched.Add(-time.Hour)}
+	lu.Resolve(fetched, tokyo)
+	if !lu.Time.Equal(fetched.Add(-time.Hour)) || lu.Approx {
+		t.Errorf("expected the time to stay, got %v", lu.Time)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	forecastHorizon = 3 * time.Hour
+	forecastStep    = 30 * time.Minute
+	// forecastWeeks is how many weeks of history make up the typical profile.
+	forecastWeeks = 8
+	// forecastHalfLife is how quickly today's deviation from the typical
+	// profile fades out of the forecast.
+	forecastHalfLife = time.Hour
+	// forecastMaxAge is how old the current count may be to shift the
+	// forecast off the typical profile.
+	forecastMaxAge = 30 * time.Minute
+)
+
+type forecastPoint struct {
+	Time  time.Time
+	Count float64
+}
+
+// Forecast is the predicted count for the next few hours.
+type Forecast struct {
+	Current Counter
+	Points  []forecastPoint
+	// Stale is set when the current count was too old to go by, so the
+	// forecast is the typical profile alone.
+	Stale bool
+}
+
+// NewForecast predicts the count for the next few hours. It follows the
+// typical profile of the same weekday and time from history, shifted by how
+// far the current count and its trend over recent are off that profile,
+// with the shift fading out the further ahead the forecast looks. A current
+// count older than forecastMaxAge doesn't shift it.
+func NewForecast(current Counter, recent, history []Counter, now time.Time) Forecast {
+	f := Forecast{Current: current, Stale: now.Sub(current.LastUpdate.Time) > forecastMaxAge}
+	profile := NewProfile(history, 15*time.Minute)
+
+	typicalNow, ok := profile.At(now)
+	if !ok || f.Stale {
+		typicalNow = float64(current.Count)
+	}
+	offset := float64(current.Count) - typicalNow
+
+	// Trend is how much faster than usual the count has been changing, per hour
+	var trend float64
+	if len(recent) > 1 && !f.Stale {
+		first, last := recent[0], recent[len(recent)-1]
+		if hours := last.LastUpdate.Sub(first.LastUpdate.Time).Hours(); hours > 0 {
+			trend = float64(last.Count-first.Count) / hours
+			typicalFirst, okFirst := profile.At(first.LastUpdate.Time)
+			typicalLast, okLast := profile.At(last.LastUpdate.Time)
+			if okFirst && okLast {
+				trend -= (typicalLast - typicalFirst) / hours
+			}
+		}
+	}
+
+	for t := now.Truncate(forecastStep).Add(forecastStep); !t.After(now.Add(forecastHorizon)); t = t.Add(forecastStep) {
+		typical, ok := profile.At(t)
+		if !ok {
+			// No samples at this time of the week, the gym is usually closed
+			continue
+		}
+		ahead := t.Sub(now)
+		decay := math.Pow(0.5, ahead.Hours()/forecastHalfLife.Hours())
+		count := typical + (offset+trend*ahead.Hours())*decay
+		count = max(count, 0)
+		if current.Capacity > 0 {
+			count = min(count, float64(current.Capacity))
+		}
+		f.Points = append(f.Points, forecastPoint{Time: t, Count: count})
+	}
+
+	return f
+}
+
+// Peak returns the point with the highest predicted count.
+func (f Forecast) Peak() (forecastPoint, bool) {
+	if len(f.Points) == 0 {
+		return forecastPoint{}, false
+	}
+	peak := f.Points[0]
+	for _, p := range f.Points[1:] {
+		if p.Count > peak.Count {
+			peak = p
+		}
+	}
+	return peak, true
+}
+
+// Render describes the forecast for the gym, named as given, e.g. "expected to peak at ~85 around 19:00".
+func (f Forecast) Render(gym string) string {
+	peak, ok := f.Peak()
+	if !ok {
+		return fmt.Sprintf("Not enough data to forecast %s yet.", gym)
+	}
+
+	var b strings.Builder
+	count := float64(f.Current.Count)
+	if f.Stale {
+		fmt.Fprintf(&b, "%s was last counted at %s, too long ago to go by, so this is a usual day.\n",
+			gym, f.Current.LastUpdate.Format("Jan 2 15:04"))
+		count = f.Points[0].Count
+	} else {
+		fmt.Fprintf(&b, "%s now: %d", gym, f.Current.Count)
+		if f.Current.Capacity > 0 {
+			fmt.Fprintf(&b, " of %d", f.Current.Capacity)
+		}
+		b.WriteString(".\n")
+	}
+
+	last := f.Points[len(f.Points)-1]
+	if math.Round(peak.Count) > count {
+		fmt.Fprintf(&b, "Expected to peak at ~%.0f around %s.\n", peak.Count, peak.Time.Format("15:04"))
+	} else {
+		fmt.Fprintf(&b, "Expected to ease off to ~%.0f by %s.\n", last.Count, last.Time.Format("15:04"))
+	}
+
+	points := make([]string, 0, len(f.Points))
+	for _, p := range f.Points {
+		points = append(points, fmt.Sprintf("%s ~%.0f", p.Time.Format("15:04"), p.Count))
+	}
+	b.WriteString(strings.Join(points, ", "))
+	return b.String()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// eveningProfile returns four weeks of Wednesday samples every 15 minutes
+// from 16:00 to 22:00 that rise by 10 an hour to a peak of 80 at 19:00 and
+// fall again afterwards.
+func eveningProfile(wed time.Time) []Counter {
+	var counters []Counter
+	for week := 1; week <= 4; week++ {
+		day := wed.AddDate(0, 0, -7*week)
+		for ts := day.Add(16 * time.Hour); ts.Hour() < 22; ts = ts.Add(15 * time.Minute) {
+			hours := ts.Sub(day.Add(19 * time.Hour)).Hours()
+			counters = append(counters, Counter{
+				Count:      80 - int(math.Abs(hours)*10),
+				Capacity:   100,
+				LastUpdate: LastUpdate{Time: ts},
+			})
+		}
+	}
+	return counters
+}
+
+func TestNewForecast_FollowsProfile(t *testing.T) {
+	wed := time.Date(2024, 5, 15, 0, 0, 0, 0, time.UTC)
+	now := wed.Add(17 * time.Hour)
+	current := Counter{Count: 60, Capacity: 100, LastUpdate: LastUpdate{Time: now}}
+
+	f := NewForecast(current, nil, eveningProfile(wed), now)
+
+	if len(f.Points) != 6 {
+		t.Fatalf("expected 6 points over 3 hours, got %v", f.Points)
+	}
+	peak, ok := f.Peak()
+	if !ok {
+		t.Fatal("expected a peak")
+	}
+	if peak.Time.Hour() != 19 || math.Round(peak.Count) != 80 {
+		t.Errorf("expected a peak of 80 at 19:00, got %v", peak)
+	}
+}
+
+func TestNewForecast_BusierThanUsual(t *testing.T) {
+	wed := time.Date(2024, 5, 15, 0, 0, 0, 0, time.UTC)
+	now := wed.Add(17 * time.Hour)
+	// 20 more than usual and rising 10 an hour faster than usual
+	recent := []Counter{
+		{Count: 60, LastUpdate: LastUpdate{Time: now.Add(-time.Hour)}},
+		{Count: 80, LastUpdate: LastUpdate{Time: now}},
+	}
+	current := Counter{Count: 80, Capacity: 100, LastUpdate: LastUpdate{Time: now}}
+
+	f := NewForecast(current, recent, eveningProfile(wed), now)
+
+	// One half-life ahead: 70 + (20 + 10) / 2
+	if p := f.Points[1]; p.Time.Hour() != 18 || math.Round(p.Count) != 85 {
+		t.Errorf("expected ~85 at 18:00, got %v", p)
+	}
+	for _, p := range f.Points {
+		if p.Count > 100 {
+			t.Errorf("expected the forecast to stay within capacity, got %v", p)
+		}
+	}
+}
+
+func TestNewForecast_SkipsClosedHours(t *testing.T) {
+	wed := time.Date(2024, 5, 15, 0, 0, 0, 0, time.UTC)
+	now := wed.Add(21 * time.Hour)
+	current := Counter{Count: 50, Capacity: 100, LastUpdate: LastUpdate{Time: now}}
+
+	f := NewForecast(current, nil, eveningProfile(wed), now)
+
+	if len(f.Points) != 1 || f.Points[0].Time.Hour() != 21 {
+		t.Errorf("expected only 21:30 before closing, got %v", f.Points)
+	}
+}
+
+func TestNewForecast_StaleCount(t *testing.T) {
+	wed := time.Date(2024, 5, 15, 0, 0, 0, 0, time.UTC)
+	now := wed.Add(17 * time.Hour)
+	// Far above the profile, but from hours ago
+	current := Counter{Count: 100, Capacity: 100, LastUpdate: LastUpdate{Time: now.Add(-3 * time.Hour)}}
+
+	f := NewForecast(current, nil, eveningProfile(wed), now)
+
+	if !f.Stale {
+		t.Fatal("expected the forecast to be marked stale")
+	}
+	if p := f.Points[1]; math.Round(p.Count) != 70 {
+		t.Errorf("expected the typical 70 at 18:00, got %v", p)
+	}
+	if got := f.Render("TST"); !strings.HasPrefix(got, "TST was last counted at May 15 14:00, too long ago to go by") {
+		t.Errorf("expected a stale warning, got %q", got)
+	}
+}
+
+func TestForecast_Render(t *testing.T) {
+	at := func(h, m int) time.Time { return time.Date(2024, 5, 15, h, m, 0, 0, time.UTC) }
+	current := Counter{Count: 60, Capacity: 100}
+
+	rising := Forecast{Current: current, Points: []forecastPoint{
+		{at(18, 0), 70.4}, {at(18, 30), 84.6}, {at(19, 0), 80},
+	}}
+	want := "TST now: 60 of 100.\n" +
+		"Expected to peak at ~85 around 18:30.\n" +
+		"18:00 ~70, 18:30 ~85, 19:00 ~80"
+	if got := rising.Render("TST"); got != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+
+	falling := Forecast{Current: current, Points: []forecastPoint{{at(21, 0), 40}, {at(21, 30), 20}}}
+	if got := falling.Render("TST"); !strings.Contains(got, "Expected to ease off to ~20 by 21:30.") {
+		t.Errorf("unexpected forecast %q", got)
+	}
+
+	if got, want := (Forecast{}).Render("TST"), "Not enough data to forecast TST yet."; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
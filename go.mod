@@ -6,7 +6,9 @@ require (
 	github.com/go-telegram/bot v1.21.0
 	github.com/imbue11235/humanize v1.0.2
 	github.com/reugn/go-quartz v0.15.2
+	golang.org/x/image v0.44.0
 	golang.org/x/net v0.56.0
+	gopkg.in/yaml.v3 v3.0.1
 	modernc.org/sqlite v1.53.0
 )
 
@@ -3,19 +3,56 @@ package main
 import (
 	"database/sql"
 	"errors"
+	"fmt"
+	"log/slog"
 	"time"
 
 	"github.com/imbue11235/humanize"
 	_ "modernc.org/sqlite"
 )
 
+// sessionsVersion is the schema version stored in PRAGMA user_version once
+// legacy in/out rows have been migrated into the sessions table.
+const sessionsVersion = 1
+
+// Climber identifies the Telegram user, and the chat they used, behind a check-in.
+type Climber struct {
+	ID       int64
+	Username string
+	ChatID   int64
+}
+
+// Name returns how to address the climber in a chat.
+func (c Climber) Name() string {
+	if c.Username != "" {
+		return "@" + c.Username
+	}
+	return fmt.Sprintf("climber %d", c.ID)
+}
+
+// Session is a single visit to the gym, from check-in to check-out.
+// End is zero while the session is still open.
+type Session struct {
+	ID       int64
+	Gym      string
+	Climber  Climber
+	Start    time.Time
+	End      time.Time
+	Duration time.Duration
+	Orphan   bool
+	// AutoClosed is set when the session was closed by the check-out job
+	// rather than by the climber.
+	AutoClosed bool
+}
+
 // Gym represents the gym structure with a connection to the SQLite database.
 type Gym struct {
-	db *sql.DB
+	db  *sql.DB
+	key string
 }
 
-// NewGym creates a new Gym instance with the given SQLite database path.
-func NewGym(dbPath string) (*Gym, error) {
+// NewGym creates a new Gym instance for the gym key with the given SQLite database path.
+func NewGym(dbPath, gymKey string) (*Gym, error) {
 	db, err := sql.Open("sqlite", dbPath)
 	if err != nil {
 		return nil, err
@@ -23,74 +60,434 @@ func NewGym(dbPath string) (*Gym, error) {
 
 	// Create table if it doesn't exist
 	createTableQuery := `
-    CREATE TABLE IF NOT EXISTS gym (
+    CREATE TABLE IF NOT EXISTS sessions (
         id INTEGER PRIMARY KEY AUTOINCREMENT,
-        timestamp TEXT,
-        action TEXT
+        gym TEXT,
+        user_id INTEGER,
+        username TEXT,
+        chat_id INTEGER,
+        started_at TEXT,
+        ended_at TEXT,
+        duration INTEGER,
+        orphan INTEGER NOT NULL DEFAULT 0,
+        auto_closed INTEGER NOT NULL DEFAULT 0
     );`
 	_, err = db.Exec(createTableQuery)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Gym{db: db}, nil
+	if err := addMissingColumns(db, "sessions", map[string]string{
+		"auto_closed": "INTEGER NOT NULL DEFAULT 0",
+	}); err != nil {
+		return nil, err
+	}
+
+	g := &Gym{db: db, key: gymKey}
+	if err := g.migrate(); err != nil {
+		return nil, err
+	}
+
+	return g, nil
 }
 
-// In writes an "in" action with the current timestamp to the database.
-func (g *Gym) In() error {
-	last, lastTs, err := g.lastAction()
+// In opens a new session for the climber starting at the current time.
+// A session left open on a previous day is flagged as an orphan.
+func (g *Gym) In(c Climber) error {
+	open, err := g.openSession(c.ID)
 	if err != nil {
 		return err
 	}
 
-	if last == "in" {
-		now := time.Now()
-		sameDay := lastTs.Year() == now.Year() && lastTs.YearDay() == now.YearDay()
+	now := time.Now()
+	if open != nil {
+		sameDay := open.Start.Year() == now.Year() && open.Start.YearDay() == now.YearDay()
 		if sameDay {
 			return errors.New("cannot check in: already checked in without checking out")
 		}
+		if _, err := g.db.Exec("UPDATE sessions SET orphan = 1 WHERE id = ?", open.ID); err != nil {
+			return err
+		}
 	}
 
-	return g.writeAction("in")
+	_, err = g.db.Exec(`
+    INSERT INTO sessions (gym, user_id, username, chat_id, started_at)
+    VALUES (?, ?, ?, ?, ?)`,
+		g.key, c.ID, c.Username, c.ChatID, now.Format(time.RFC3339))
+	return err
 }
 
-// Out writes an "out" action with the current timestamp to the database and returns the time delta since the latest "in" action.
-func (g *Gym) Out() (string, error) {
-	last, lastTs, err := g.lastAction()
+// Out closes the climber's open session at the current time and returns the time delta since it started.
+func (g *Gym) Out(c Climber) (string, error) {
+	open, err := g.openSession(c.ID)
 	if err != nil {
 		return "", err
 	}
-	if last != "in" {
+	if open == nil {
 		return "", errors.New("cannot check out: no active check-in")
 	}
 
-	if err = g.writeAction("out"); err != nil {
+	if err := g.closeSession(open.ID, open.Start, time.Now(), false); err != nil {
 		return "", err
 	}
 
-	return humanize.ExactTime(lastTs).FromNow(), nil
+	return humanize.ExactTime(open.Start).FromNow(), nil
 }
 
-func (g *Gym) lastAction() (string, time.Time, error) {
-	var action, timestampStr string
-	err := g.db.QueryRow("SELECT action, timestamp FROM gym ORDER BY timestamp DESC, id DESC LIMIT 1").Scan(&action, &timestampStr)
+// openSession returns the climber's latest session that is neither closed nor orphaned, or nil.
+func (g *Gym) openSession(userID int64) (*Session, error) {
+	query := `
+    SELECT id, COALESCE(username, ''), COALESCE(chat_id, 0), started_at FROM sessions
+    WHERE user_id = ? AND ended_at IS NULL AND orphan = 0
+    ORDER BY started_at DESC, id DESC LIMIT 1`
+	s := Session{Gym: g.key, Climber: Climber{ID: userID}}
+	var startedAt string
+	err := g.db.QueryRow(query, userID).Scan(&s.ID, &s.Climber.Username, &s.Climber.ChatID, &startedAt)
 	if err == sql.ErrNoRows {
-		return "", time.Time{}, nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.Start, err = time.Parse(time.RFC3339, startedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+// CloseStale closes every open session that has run past maxDuration or
+// past the closing time of the day it started on, in the gym's timezone loc,
+// whichever comes first. A zero closing disables the closing time check. The
+// sessions are ended at that deadline rather than at now and returned flagged
+// as auto-closed, with their times in loc.
+func (g *Gym) CloseStale(now time.Time, maxDuration, closing time.Duration, loc *time.Location) ([]Session, error) {
+	rows, err := g.db.Query(`
+    SELECT id, COALESCE(user_id, 0), COALESCE(username, ''), COALESCE(chat_id, 0), started_at FROM sessions
+    WHERE ended_at IS NULL AND orphan = 0`)
+	if err != nil {
+		return nil, err
+	}
+
+	var open []Session
+	for rows.Next() {
+		s := Session{Gym: g.key}
+		var startedAt string
+		if err := rows.Scan(&s.ID, &s.Climber.ID, &s.Climber.Username, &s.Climber.ChatID, &startedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if s.Start, err = time.Parse(time.RFC3339, startedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		s.Start = s.Start.In(loc)
+		open = append(open, s)
 	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var closed []Session
+	for _, s := range open {
+		end := sessionDeadline(s.Start, maxDuration, closing)
+		if end.IsZero() || now.Before(end) {
+			continue
+		}
+		if err := g.closeSession(s.ID, s.Start, end, true); err != nil {
+			return closed, err
+		}
+		s.End = end
+		s.Duration = end.Sub(s.Start).Truncate(time.Second)
+		s.AutoClosed = true
+		closed = append(closed, s)
+	}
+
+	return closed, nil
+}
+
+// Sessions returns the climber's sessions, oldest first, leaving out orphans.
+func (g *Gym) Sessions(userID int64) ([]Session, error) {
+	rows, err := g.db.Query(`
+    SELECT id, COALESCE(username, ''), COALESCE(chat_id, 0), started_at, ended_at, duration, auto_closed
+    FROM sessions WHERE user_id = ? AND orphan = 0 ORDER BY started_at, id`, userID)
 	if err != nil {
-		return "", time.Time{}, err
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		s := Session{Gym: g.key, Climber: Climber{ID: userID}}
+		var startedAt string
+		var endedAt sql.NullString
+		var duration sql.NullInt64
+		if err := rows.Scan(&s.ID, &s.Climber.Username, &s.Climber.ChatID, &startedAt, &endedAt, &duration, &s.AutoClosed); err != nil {
+			return nil, err
+		}
+		if s.Start, err = time.Parse(time.RFC3339, startedAt); err != nil {
+			return nil, err
+		}
+		if endedAt.Valid {
+			if s.End, err = time.Parse(time.RFC3339, endedAt.String); err != nil {
+				return nil, err
+			}
+			s.Duration = time.Duration(duration.Int64) * time.Second
+		}
+		sessions = append(sessions, s)
+	}
+
+	return sessions, rows.Err()
+}
+
+// Active returns the open sessions started from the chat, oldest first.
+func (g *Gym) Active(chatID int64) ([]Session, error) {
+	rows, err := g.db.Query(`
+    SELECT id, COALESCE(user_id, 0), COALESCE(username, ''), started_at FROM sessions
+    WHERE chat_id = ? AND ended_at IS NULL AND orphan = 0 ORDER BY started_at, id`, chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		s := Session{Gym: g.key, Climber: Climber{ChatID: chatID}}
+		var startedAt string
+		if err := rows.Scan(&s.ID, &s.Climber.ID, &s.Climber.Username, &startedAt); err != nil {
+			return nil, err
+		}
+		if s.Start, err = time.Parse(time.RFC3339, startedAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// Session returns the session with the given id.
+func (g *Gym) Session(id int64) (Session, error) {
+	s := Session{ID: id, Gym: g.key}
+	var startedAt string
+	var endedAt sql.NullString
+	var duration sql.NullInt64
+	err := g.db.QueryRow(`
+    SELECT COALESCE(user_id, 0), COALESCE(username, ''), COALESCE(chat_id, 0), started_at, ended_at, duration, orphan, auto_closed
+    FROM sessions WHERE id = ?`, id).Scan(
+		&s.Climber.ID, &s.Climber.Username, &s.Climber.ChatID, &startedAt, &endedAt, &duration, &s.Orphan, &s.AutoClosed)
+	if err != nil {
+		return s, err
+	}
+
+	if s.Start, err = time.Parse(time.RFC3339, startedAt); err != nil {
+		return s, err
+	}
+	if endedAt.Valid {
+		if s.End, err = time.Parse(time.RFC3339, endedAt.String); err != nil {
+			return s, err
+		}
+		s.Duration = time.Duration(duration.Int64) * time.Second
 	}
 
-	ts, err := time.Parse(time.RFC3339, timestampStr)
+	return s, nil
+}
+
+// SetEnd corrects the end time of a closed session, e.g. after it was auto-closed.
+func (g *Gym) SetEnd(id int64, end time.Time) error {
+	s, err := g.Session(id)
 	if err != nil {
-		return "", time.Time{}, err
+		return err
+	}
+	if s.End.IsZero() {
+		return errors.New("cannot correct session: it is still open")
+	}
+	if !end.After(s.Start) {
+		return errors.New("cannot correct session: end is before start")
 	}
 
-	return action, ts, nil
+	return g.closeSession(id, s.Start, end, s.AutoClosed)
 }
 
-func (g *Gym) writeAction(action string) error {
-	timestamp := time.Now().Format(time.RFC3339)
-	_, err := g.db.Exec("INSERT INTO gym (timestamp, action) VALUES (?, ?)", timestamp, action)
+func (g *Gym) closeSession(id int64, start, end time.Time, autoClosed bool) error {
+	duration := end.Sub(start).Truncate(time.Second)
+	_, err := g.db.Exec("UPDATE sessions SET ended_at = ?, duration = ?, auto_closed = ? WHERE id = ?",
+		end.Format(time.RFC3339), int64(duration.Seconds()), autoClosed, id)
 	return err
 }
+
+// sessionDeadline returns when a session started at start is due to be closed.
+// The closing time is taken in start's location.
+func sessionDeadline(start time.Time, maxDuration, closing time.Duration) time.Time {
+	var deadline time.Time
+	if maxDuration > 0 {
+		deadline = start.Add(maxDuration)
+	}
+	if closing > 0 {
+		y, m, d := start.Date()
+		closeAt := time.Date(y, m, d, 0, 0, 0, 0, start.Location()).Add(closing)
+		// A session started after closing time runs into the next day's closing
+		if !closeAt.After(start) {
+			closeAt = closeAt.AddDate(0, 0, 1)
+		}
+		if deadline.IsZero() || closeAt.Before(deadline) {
+			deadline = closeAt
+		}
+	}
+	return deadline
+}
+
+// migrate pairs the "in" and "out" rows of the legacy gym table into sessions.
+// It runs once per database and records its completion in PRAGMA user_version.
+func (g *Gym) migrate() error {
+	var version int
+	if err := g.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version >= sessionsVersion {
+		return nil
+	}
+
+	var legacy int
+	err := g.db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'gym'").Scan(&legacy)
+	if err != nil {
+		return err
+	}
+
+	if legacy > 0 {
+		// Tables created before check-ins were tracked per climber lack the user columns
+		if err := addMissingColumns(g.db, "gym", map[string]string{
+			"user_id":  "INTEGER",
+			"username": "TEXT",
+			"chat_id":  "INTEGER",
+		}); err != nil {
+			return err
+		}
+	}
+
+	tx, err := g.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if legacy > 0 {
+		if err := g.migrateLegacy(tx); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", sessionsVersion)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateLegacy turns the legacy rows into sessions. An "in" without an "out"
+// after it is flagged as an orphan. Rows from before check-ins were tracked
+// per climber have no user and stay unattributed under user 0, so they don't
+// show up in anyone's /stats.
+func (g *Gym) migrateLegacy(tx *sql.Tx) error {
+	logger := slog.Default().With("component", "gym", "gym", g.key)
+
+	rows, err := tx.Query(`
+    SELECT COALESCE(user_id, 0), COALESCE(username, ''), COALESCE(chat_id, 0), timestamp, action
+    FROM gym ORDER BY user_id, timestamp, id`)
+	if err != nil {
+		return err
+	}
+
+	var sessions []Session
+	open := make(map[int64]int)
+	for rows.Next() {
+		var c Climber
+		var timestamp, action string
+		if err := rows.Scan(&c.ID, &c.Username, &c.ChatID, &timestamp, &action); err != nil {
+			rows.Close()
+			return err
+		}
+		ts, err := time.Parse(time.RFC3339, timestamp)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		idx, isOpen := open[c.ID]
+		switch action {
+		case "in":
+			// An "in" followed by another "in" was never closed
+			if isOpen {
+				sessions[idx].Orphan = true
+			}
+			open[c.ID] = len(sessions)
+			sessions = append(sessions, Session{Gym: g.key, Climber: c, Start: ts})
+		case "out":
+			if !isOpen {
+				logger.Warn("skipping legacy check-out without check-in", "user_id", c.ID, "timestamp", timestamp)
+				continue
+			}
+			sessions[idx].End = ts
+			sessions[idx].Duration = ts.Sub(sessions[idx].Start)
+			delete(open, c.ID)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, idx := range open {
+		sessions[idx].Orphan = true
+	}
+
+	for _, s := range sessions {
+		var endedAt, duration any
+		if !s.End.IsZero() {
+			endedAt = s.End.Format(time.RFC3339)
+			duration = int64(s.Duration.Seconds())
+		}
+		_, err := tx.Exec(`
+        INSERT INTO sessions (gym, user_id, username, chat_id, started_at, ended_at, duration, orphan)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			s.Gym, s.Climber.ID, s.Climber.Username, s.Climber.ChatID,
+			s.Start.Format(time.RFC3339), endedAt, duration, s.Orphan)
+		if err != nil {
+			return err
+		}
+	}
+
+	logger.Info("migrated legacy check-ins", "sessions", len(sessions))
+	return nil
+}
+
+// addMissingColumns adds the given columns to the table unless they already exist.
+func addMissingColumns(db *sql.DB, table string, columns map[string]string) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for name, typ := range columns {
+		if existing[name] {
+			continue
+		}
+		if _, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN " + name + " " + typ); err != nil {
+			return err
+		}
+	}
+	return nil
+}
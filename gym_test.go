@@ -3,29 +3,36 @@ package main
 import (
 	"database/sql"
 	"os"
+	"reflect"
 	"testing"
 	"time"
 
 	_ "modernc.org/sqlite"
 )
 
-// Helper function to read all records from the SQLite database
-func readAllActions(db *sql.DB) ([][]string, error) {
-	rows, err := db.Query("SELECT timestamp, action FROM gym")
+var (
+	alice = Climber{ID: 1, Username: "alice", ChatID: 100}
+	bob   = Climber{ID: 2, Username: "bob", ChatID: 100}
+)
+
+// Helper function to read all sessions from the SQLite database as
+// (start, end, orphan) triples, with end empty for open sessions
+func readAllSessions(db *sql.DB) ([][]string, error) {
+	rows, err := db.Query("SELECT started_at, COALESCE(ended_at, ''), orphan FROM sessions ORDER BY id")
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var actions [][]string
+	var sessions [][]string
 	for rows.Next() {
-		var timestamp, action string
-		if err := rows.Scan(&timestamp, &action); err != nil {
+		var start, end, orphan string
+		if err := rows.Scan(&start, &end, &orphan); err != nil {
 			return nil, err
 		}
-		actions = append(actions, []string{timestamp, action})
+		sessions = append(sessions, []string{start, end, orphan})
 	}
-	return actions, nil
+	return sessions, nil
 }
 
 func TestNewGym(t *testing.T) {
@@ -33,7 +40,7 @@ func TestNewGym(t *testing.T) {
 	os.Remove(dbPath)
 	defer os.Remove(dbPath)
 
-	g, err := NewGym(dbPath)
+	g, err := NewGym(dbPath, "TST")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -48,22 +55,22 @@ func TestGymIn(t *testing.T) {
 	os.Remove(dbPath)
 	defer os.Remove(dbPath)
 
-	g, err := NewGym(dbPath)
+	g, err := NewGym(dbPath, "TST")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
-	if err := g.In(); err != nil {
+	if err := g.In(alice); err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
-	actions, err := readAllActions(g.db)
+	sessions, err := readAllSessions(g.db)
 	if err != nil {
-		t.Fatalf("unexpected error reading actions: %v", err)
+		t.Fatalf("unexpected error reading sessions: %v", err)
 	}
 
-	if len(actions) != 1 || actions[0][1] != "in" {
-		t.Errorf("expected 'in' action but got %v", actions)
+	if len(sessions) != 1 || sessions[0][1] != "" {
+		t.Errorf("expected one open session but got %v", sessions)
 	}
 }
 
@@ -72,13 +79,13 @@ func TestGymOut(t *testing.T) {
 	os.Remove(dbPath)
 	defer os.Remove(dbPath)
 
-	g, err := NewGym(dbPath)
+	g, err := NewGym(dbPath, "TST")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
 	// Out without a prior In should fail
-	if _, err := g.Out(); err == nil {
+	if _, err := g.Out(alice); err == nil {
 		t.Fatal("expected error when calling Out without prior In, got nil")
 	}
 }
@@ -88,26 +95,26 @@ func TestGymInAndOut(t *testing.T) {
 	os.Remove(dbPath)
 	defer os.Remove(dbPath)
 
-	g, err := NewGym(dbPath)
+	g, err := NewGym(dbPath, "TST")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
-	if err := g.In(); err != nil {
+	if err := g.In(alice); err != nil {
 		t.Fatalf("unexpected error on In: %v", err)
 	}
 
-	if _, err := g.Out(); err != nil {
+	if _, err := g.Out(alice); err != nil {
 		t.Fatalf("unexpected error on Out: %v", err)
 	}
 
-	actions, err := readAllActions(g.db)
+	sessions, err := readAllSessions(g.db)
 	if err != nil {
-		t.Fatalf("unexpected error reading actions: %v", err)
+		t.Fatalf("unexpected error reading sessions: %v", err)
 	}
 
-	if len(actions) != 2 || actions[0][1] != "in" || actions[1][1] != "out" {
-		t.Errorf("expected 'in' and 'out' actions but got %v", actions)
+	if len(sessions) != 1 || sessions[0][1] == "" {
+		t.Errorf("expected one closed session but got %v", sessions)
 	}
 }
 
@@ -116,17 +123,17 @@ func TestGymIn_BlocksSecondInSameDay(t *testing.T) {
 	os.Remove(dbPath)
 	defer os.Remove(dbPath)
 
-	g, err := NewGym(dbPath)
+	g, err := NewGym(dbPath, "TST")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
-	if err := g.In(); err != nil {
+	if err := g.In(alice); err != nil {
 		t.Fatalf("unexpected error on first In: %v", err)
 	}
 
 	// Second In on same day (without Out) should be rejected
-	if err := g.In(); err == nil {
+	if err := g.In(alice); err == nil {
 		t.Fatal("expected error on second In same day without Out, got nil")
 	}
 }
@@ -136,31 +143,31 @@ func TestGymIn_AllowsAfterOut(t *testing.T) {
 	os.Remove(dbPath)
 	defer os.Remove(dbPath)
 
-	g, err := NewGym(dbPath)
+	g, err := NewGym(dbPath, "TST")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
-	if err := g.In(); err != nil {
+	if err := g.In(alice); err != nil {
 		t.Fatalf("unexpected error on first In: %v", err)
 	}
 
-	if _, err := g.Out(); err != nil {
+	if _, err := g.Out(alice); err != nil {
 		t.Fatalf("unexpected error on Out: %v", err)
 	}
 
 	// In again after Out should be allowed
-	if err := g.In(); err != nil {
+	if err := g.In(alice); err != nil {
 		t.Fatalf("unexpected error on second In after Out: %v", err)
 	}
 
-	actions, err := readAllActions(g.db)
+	sessions, err := readAllSessions(g.db)
 	if err != nil {
-		t.Fatalf("unexpected error reading actions: %v", err)
+		t.Fatalf("unexpected error reading sessions: %v", err)
 	}
 
-	if len(actions) != 3 || actions[0][1] != "in" || actions[1][1] != "out" || actions[2][1] != "in" {
-		t.Errorf("expected in/out/in sequence but got %v", actions)
+	if len(sessions) != 2 || sessions[0][1] == "" || sessions[1][1] != "" {
+		t.Errorf("expected a closed and an open session but got %v", sessions)
 	}
 }
 
@@ -169,21 +176,21 @@ func TestGymOut_BlocksDoubleOut(t *testing.T) {
 	os.Remove(dbPath)
 	defer os.Remove(dbPath)
 
-	g, err := NewGym(dbPath)
+	g, err := NewGym(dbPath, "TST")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
-	if err := g.In(); err != nil {
+	if err := g.In(alice); err != nil {
 		t.Fatalf("unexpected error on In: %v", err)
 	}
 
-	if _, err := g.Out(); err != nil {
+	if _, err := g.Out(alice); err != nil {
 		t.Fatalf("unexpected error on first Out: %v", err)
 	}
 
 	// Second Out without a new In should fail
-	if _, err := g.Out(); err == nil {
+	if _, err := g.Out(alice); err == nil {
 		t.Fatal("expected error on second Out without In, got nil")
 	}
 }
@@ -193,19 +200,19 @@ func TestOut_TimeDelta(t *testing.T) {
 	os.Remove(dbPath)
 	defer os.Remove(dbPath)
 
-	g, err := NewGym(dbPath)
+	g, err := NewGym(dbPath, "TST")
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
-	// Insert an "in" row with a known past timestamp directly, bypassing In()
+	// Insert an open session with a known past start directly, bypassing In()
 	inTime := time.Now().Add(-2 * time.Second).Format(time.RFC3339)
-	_, err = g.db.Exec("INSERT INTO gym (timestamp, action) VALUES (?, ?)", inTime, "in")
+	_, err = g.db.Exec("INSERT INTO sessions (gym, user_id, started_at) VALUES (?, ?, ?)", "TST", alice.ID, inTime)
 	if err != nil {
-		t.Fatalf("unexpected error seeding 'in' row: %v", err)
+		t.Fatalf("unexpected error seeding session: %v", err)
 	}
 
-	timeDelta, err := g.Out()
+	timeDelta, err := g.Out(alice)
 	if err != nil {
 		t.Fatalf("unexpected error: %v", err)
 	}
@@ -214,3 +221,358 @@ func TestOut_TimeDelta(t *testing.T) {
 		t.Errorf("expected '2 seconds ago' but got %s", timeDelta)
 	}
 }
+
+func TestGymIn_PerClimber(t *testing.T) {
+	dbPath := "test_gym_per_climber.sqlite"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	g, err := NewGym(dbPath, "TST")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := g.In(alice); err != nil {
+		t.Fatalf("unexpected error on alice In: %v", err)
+	}
+
+	// Another climber's check-in must not be blocked by alice's open session
+	if err := g.In(bob); err != nil {
+		t.Fatalf("unexpected error on bob In: %v", err)
+	}
+
+	if _, err := g.Out(bob); err != nil {
+		t.Fatalf("unexpected error on bob Out: %v", err)
+	}
+
+	// alice is still checked in
+	if err := g.In(alice); err == nil {
+		t.Fatal("expected error on second alice In same day without Out, got nil")
+	}
+}
+
+func TestNewGym_MigratesLegacyActions(t *testing.T) {
+	dbPath := "test_gym_legacy.sqlite"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = db.Exec("CREATE TABLE gym (id INTEGER PRIMARY KEY AUTOINCREMENT, timestamp TEXT, action TEXT)")
+	if err != nil {
+		t.Fatalf("unexpected error creating legacy table: %v", err)
+	}
+	legacy := [][2]string{
+		{"2024-05-01T18:00:00Z", "in"},
+		{"2024-05-01T20:00:00Z", "out"},
+		{"2024-05-02T18:00:00Z", "in"},
+		{"2024-05-03T18:00:00Z", "in"},
+		{"2024-05-03T19:30:00Z", "out"},
+		{"2024-05-04T18:00:00Z", "in"},
+	}
+	for _, row := range legacy {
+		if _, err := db.Exec("INSERT INTO gym (timestamp, action) VALUES (?, ?)", row[0], row[1]); err != nil {
+			t.Fatalf("unexpected error seeding legacy row: %v", err)
+		}
+	}
+	db.Close()
+
+	g, err := NewGym(dbPath, "TST")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	sessions, err := readAllSessions(g.db)
+	if err != nil {
+		t.Fatalf("unexpected error reading sessions: %v", err)
+	}
+	expected := [][]string{
+		{"2024-05-01T18:00:00Z", "2024-05-01T20:00:00Z", "0"},
+		{"2024-05-02T18:00:00Z", "", "1"},
+		{"2024-05-03T18:00:00Z", "2024-05-03T19:30:00Z", "0"},
+		{"2024-05-04T18:00:00Z", "", "1"},
+	}
+	if !reflect.DeepEqual(sessions, expected) {
+		t.Errorf("expected sessions %v, got %v", expected, sessions)
+	}
+
+	var duration int
+	if err := g.db.QueryRow("SELECT duration FROM sessions WHERE id = 1").Scan(&duration); err != nil {
+		t.Fatalf("unexpected error reading duration: %v", err)
+	}
+	if duration != 2*60*60 {
+		t.Errorf("expected duration of 2h, got %ds", duration)
+	}
+
+	// Reopening the database must not migrate the legacy rows twice
+	g, err = NewGym(dbPath, "TST")
+	if err != nil {
+		t.Fatalf("unexpected error reopening: %v", err)
+	}
+	sessions, err = readAllSessions(g.db)
+	if err != nil {
+		t.Fatalf("unexpected error reading sessions: %v", err)
+	}
+	if len(sessions) != len(expected) {
+		t.Errorf("expected %d sessions after reopen, got %d", len(expected), len(sessions))
+	}
+}
+
+func TestGymIn_FlagsPreviousDaySessionAsOrphan(t *testing.T) {
+	dbPath := "test_gym_orphan.sqlite"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	g, err := NewGym(dbPath, "TST")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	yesterday := time.Now().AddDate(0, 0, -1).Format(time.RFC3339)
+	_, err = g.db.Exec("INSERT INTO sessions (gym, user_id, started_at) VALUES (?, ?, ?)", "TST", alice.ID, yesterday)
+	if err != nil {
+		t.Fatalf("unexpected error seeding session: %v", err)
+	}
+
+	if err := g.In(alice); err != nil {
+		t.Fatalf("unexpected error on In: %v", err)
+	}
+
+	sessions, err := readAllSessions(g.db)
+	if err != nil {
+		t.Fatalf("unexpected error reading sessions: %v", err)
+	}
+	if len(sessions) != 2 || sessions[0][2] != "1" || sessions[1][2] != "0" {
+		t.Errorf("expected an orphan and an open session but got %v", sessions)
+	}
+}
+
+func TestSessionDeadline(t *testing.T) {
+	start := time.Date(2024, 5, 1, 18, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name        string
+		start       time.Time
+		maxDuration time.Duration
+		closing     time.Duration
+		want        time.Time
+	}{
+		{"max duration only", start, 4 * time.Hour, 0, start.Add(4 * time.Hour)},
+		{"closing comes first", start, 6 * time.Hour, 22 * time.Hour, time.Date(2024, 5, 1, 22, 0, 0, 0, time.UTC)},
+		{"max duration comes first", start, 2 * time.Hour, 22 * time.Hour, start.Add(2 * time.Hour)},
+		{"started after closing", start.Add(5 * time.Hour), 0, 22 * time.Hour, time.Date(2024, 5, 2, 22, 0, 0, 0, time.UTC)},
+		{"no limits", start, 0, 0, time.Time{}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := sessionDeadline(tc.start, tc.maxDuration, tc.closing); !got.Equal(tc.want) {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestGymCloseStale(t *testing.T) {
+	dbPath := "test_gym_close_stale.sqlite"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	g, err := NewGym(dbPath, "TST")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	now := time.Now()
+	seed := []struct {
+		climber Climber
+		start   time.Time
+	}{
+		{alice, now.Add(-5 * time.Hour)},
+		{bob, now.Add(-time.Hour)},
+	}
+	for _, s := range seed {
+		_, err := g.db.Exec("INSERT INTO sessions (gym, user_id, username, chat_id, started_at) VALUES (?, ?, ?, ?, ?)",
+			"TST", s.climber.ID, s.climber.Username, s.climber.ChatID, s.start.Format(time.RFC3339))
+		if err != nil {
+			t.Fatalf("unexpected error seeding session: %v", err)
+		}
+	}
+
+	closed, err := g.CloseStale(now, 4*time.Hour, 0, time.UTC)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(closed) != 1 || closed[0].Climber.ID != alice.ID || !closed[0].AutoClosed {
+		t.Fatalf("expected alice's session to be auto-closed, got %v", closed)
+	}
+	if closed[0].Duration != 4*time.Hour {
+		t.Errorf("expected a 4h session, got %v", closed[0].Duration)
+	}
+
+	// bob is still checked in, alice may check in again
+	if _, err := g.Out(bob); err != nil {
+		t.Errorf("unexpected error on bob Out: %v", err)
+	}
+	if err := g.In(alice); err != nil {
+		t.Errorf("unexpected error on alice In: %v", err)
+	}
+}
+
+func TestGymCloseStale_GymTimezone(t *testing.T) {
+	dbPath := "test_gym_close_stale_tz.sqlite"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	g, err := NewGym(dbPath, "TST")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no timezone data: %v", err)
+	}
+
+	// Stored in UTC, 19:00 at the gym
+	start := time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC)
+	_, err = g.db.Exec("INSERT INTO sessions (gym, user_id, username, chat_id, started_at) VALUES (?, ?, ?, ?, ?)",
+		"TST", alice.ID, alice.Username, alice.ChatID, start.Format(time.RFC3339))
+	if err != nil {
+		t.Fatalf("unexpected error seeding session: %v", err)
+	}
+
+	closed, err := g.CloseStale(start.Add(12*time.Hour), 0, 22*time.Hour, ny)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := time.Date(2024, 5, 1, 22, 0, 0, 0, ny)
+	if len(closed) != 1 || !closed[0].End.Equal(want) {
+		t.Fatalf("expected the session closed at 22:00 at the gym, got %v", closed)
+	}
+	if got := closed[0].End.Format("15:04"); got != "22:00" {
+		t.Errorf("expected the end in the gym's timezone, got %s", got)
+	}
+}
+
+func TestGymSetEnd(t *testing.T) {
+	dbPath := "test_gym_set_end.sqlite"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	g, err := NewGym(dbPath, "TST")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := g.In(alice); err != nil {
+		t.Fatalf("unexpected error on In: %v", err)
+	}
+	open, err := g.openSession(alice.ID)
+	if err != nil || open == nil {
+		t.Fatalf("expected an open session, got %v, %v", open, err)
+	}
+
+	// Open sessions can't be corrected
+	if err := g.SetEnd(open.ID, open.Start.Add(time.Hour)); err == nil {
+		t.Fatal("expected error correcting an open session, got nil")
+	}
+
+	if _, err := g.Out(alice); err != nil {
+		t.Fatalf("unexpected error on Out: %v", err)
+	}
+	if err := g.SetEnd(open.ID, open.Start.Add(-time.Hour)); err == nil {
+		t.Fatal("expected error setting end before start, got nil")
+	}
+	if err := g.SetEnd(open.ID, open.Start.Add(90*time.Minute)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	s, err := g.Session(open.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.Duration != 90*time.Minute {
+		t.Errorf("expected 1h30m session, got %v", s.Duration)
+	}
+}
+
+func TestGymSessions(t *testing.T) {
+	dbPath := "test_gym_sessions.sqlite"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	g, err := NewGym(dbPath, "TST")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := g.In(alice); err != nil {
+		t.Fatalf("unexpected error on In: %v", err)
+	}
+	if _, err := g.Out(alice); err != nil {
+		t.Fatalf("unexpected error on Out: %v", err)
+	}
+	if err := g.In(alice); err != nil {
+		t.Fatalf("unexpected error on In: %v", err)
+	}
+	if err := g.In(bob); err != nil {
+		t.Fatalf("unexpected error on In: %v", err)
+	}
+	_, err = g.db.Exec("INSERT INTO sessions (gym, user_id, started_at, orphan) VALUES (?, ?, ?, 1)",
+		"TST", alice.ID, time.Now().AddDate(0, 0, -1).Format(time.RFC3339))
+	if err != nil {
+		t.Fatalf("unexpected error seeding orphan: %v", err)
+	}
+
+	sessions, err := g.Sessions(alice.ID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %v", sessions)
+	}
+	if sessions[0].End.IsZero() || !sessions[1].End.IsZero() {
+		t.Errorf("expected a closed then an open session, got %v", sessions)
+	}
+	if sessions[0].Gym != "TST" || sessions[0].Climber.Username != alice.Username {
+		t.Errorf("unexpected session %v", sessions[0])
+	}
+}
+
+func TestGymActive(t *testing.T) {
+	dbPath := "test_gym_active.sqlite"
+	os.Remove(dbPath)
+	defer os.Remove(dbPath)
+
+	g, err := NewGym(dbPath, "TST")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	carol := Climber{ID: 3, Username: "carol", ChatID: 200}
+	for _, c := range []Climber{alice, bob, carol} {
+		if err := g.In(c); err != nil {
+			t.Fatalf("unexpected error on In: %v", err)
+		}
+	}
+	if _, err := g.Out(bob); err != nil {
+		t.Fatalf("unexpected error on Out: %v", err)
+	}
+
+	active, err := g.Active(alice.ChatID)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(active) != 1 || active[0].Climber != alice {
+		t.Errorf("expected only alice to be active, got %v", active)
+	}
+}
+
+func TestClimberName(t *testing.T) {
+	if got := alice.Name(); got != "@alice" {
+		t.Errorf("expected @alice, got %q", got)
+	}
+	if got := (Climber{ID: 42}).Name(); got != "climber 42" {
+		t.Errorf("expected climber 42, got %q", got)
+	}
+}
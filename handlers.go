@@ -1,60 +1,428 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
 )
 
 type JobHandler struct {
+	// mu guards providers, storers and the gyms' activity, which a config
+	// reload swaps and discovered gyms add to while jobs run.
+	mu         sync.RWMutex
 	storageDir string
-	client     *Client
+	providers  []OccupancyProvider
 	storers    map[string]Storer
+	alerts     *Alerts
+	notifier   Notifier
+	health     *Health
+	// lastSeen is when each gym was last on its source's page, and
+	// inactive the gyms missing from it for longer than inactiveAfter.
+	lastSeen      map[string]time.Time
+	inactive      map[string]bool
+	inactiveAfter time.Duration
+	// staleSince is when fetching each gym's counter started failing.
+	staleSince  map[string]time.Time
+	newStorer   func(gymKey string) (Storer, error)
+	onNewGym    []func(gymKey string, storer Storer)
+	onGymActive []func(gymKey string, active bool)
 }
 
-func NewJobHandler(storageDir string, client *Client, storers map[string]Storer) *JobHandler {
-	return &JobHandler{
-		storageDir: storageDir,
-		client:     client,
-		storers:    storers,
+func NewJobHandler(storageDir string, providers []OccupancyProvider, storers map[string]Storer) *JobHandler {
+	jh := &JobHandler{
+		storageDir:    storageDir,
+		providers:     providers,
+		storers:       storers,
+		lastSeen:      make(map[string]time.Time),
+		inactive:      make(map[string]bool),
+		inactiveAfter: defaultInactiveAfter,
+		staleSince:    make(map[string]time.Time),
+	}
+	jh.newStorer = func(gymKey string) (Storer, error) {
+		return newGymStorage(jh.storageDir, gymKey)
 	}
+	jh.seeAll(storers, time.Now())
+	return jh
+}
+
+// SetAlerts makes the job check every stored counter against the alerts and
+// send the ones that fire with the notifier.
+func (jh *JobHandler) SetAlerts(alerts *Alerts, notifier Notifier) {
+	jh.alerts = alerts
+	jh.notifier = notifier
+}
+
+// SetHealth makes the job run the health checks on every fetch.
+func (jh *JobHandler) SetHealth(health *Health) {
+	jh.health = health
+}
+
+// SetGyms swaps the providers and adds the gyms to the ones the job fetches
+// counters for. Gyms it already has keep their storage, so that the ones it
+// discovered meanwhile aren't lost or opened twice. It returns all the gyms.
+func (jh *JobHandler) SetGyms(providers []OccupancyProvider, storers map[string]Storer) map[string]Storer {
+	jh.mu.Lock()
+	defer jh.mu.Unlock()
+	merged := make(map[string]Storer, len(storers)+len(jh.storers))
+	maps.Copy(merged, storers)
+	maps.Copy(merged, jh.storers)
+	jh.providers = providers
+	jh.storers = merged
+	jh.seeAll(merged, time.Now())
+	return merged
+}
+
+// SetInactiveAfter sets how long a gym may be missing from its source's
+// page before it's marked inactive.
+func (jh *JobHandler) SetInactiveAfter(d time.Duration) {
+	jh.mu.Lock()
+	defer jh.mu.Unlock()
+	jh.inactiveAfter = d
+}
+
+// OnNewGym registers fn to be told about every gym the job discovers, with
+// the storage it created for it.
+func (jh *JobHandler) OnNewGym(fn func(gymKey string, storer Storer)) {
+	jh.mu.Lock()
+	defer jh.mu.Unlock()
+	jh.onNewGym = append(jh.onNewGym, fn)
+}
+
+// OnGymActive registers fn to be told when a gym is marked inactive, or
+// active again once it's back.
+func (jh *JobHandler) OnGymActive(fn func(gymKey string, active bool)) {
+	jh.mu.Lock()
+	defer jh.mu.Unlock()
+	jh.onGymActive = append(jh.onGymActive, fn)
+}
+
+// seeAll counts the gyms not seen before as seen at now, so that gyms
+// start out active. The caller holds mu.
+func (jh *JobHandler) seeAll(storers map[string]Storer, now time.Time) {
+	for gymKey := range storers {
+		if _, ok := jh.lastSeen[gymKey]; !ok {
+			jh.lastSeen[gymKey] = now
+		}
+	}
+}
+
+// StaleSince reports since when the gym's counter couldn't be fetched, if
+// the last fetch of it failed.
+func (jh *JobHandler) StaleSince(gymKey string) (time.Time, bool) {
+	jh.mu.RLock()
+	defer jh.mu.RUnlock()
+	since, ok := jh.staleSince[gymKey]
+	return since, ok
+}
+
+// MarkStale marks the gyms as not fetched since now, as when the counters
+// couldn't be fetched on startup.
+func (jh *JobHandler) MarkStale(gymKeys []string, now time.Time) {
+	jh.mu.Lock()
+	defer jh.mu.Unlock()
+	for _, gymKey := range gymKeys {
+		if _, ok := jh.staleSince[gymKey]; !ok {
+			jh.staleSince[gymKey] = now
+		}
+	}
+}
+
+// gyms returns the providers and the gyms to fetch counters for.
+func (jh *JobHandler) gyms() ([]OccupancyProvider, map[string]Storer) {
+	jh.mu.RLock()
+	defer jh.mu.RUnlock()
+	return jh.providers, jh.storers
+}
+
+// ForGym returns a job that only fetches counters for the gym. The job runs
+// on the handler itself, so it picks up alerts and health checks set later.
+func (jh *JobHandler) ForGym(gymKey string) *FetchJob {
+	return &FetchJob{jh: jh, gym: gymKey}
+}
+
+// ForSource returns a job that only fetches counters from the named source.
+func (jh *JobHandler) ForSource(name string) *FetchJob {
+	return &FetchJob{jh: jh, source: name}
 }
 
 func (jh *JobHandler) Execute(ctx context.Context) error {
+	return jh.execute(ctx, "", "")
+}
+
+// ExecuteUntilFetched runs the job again after a failed fetch until a run
+// succeeds, waiting before each from minDelay doubling up to maxDelay. It
+// gives up when ctx is done.
+func (jh *JobHandler) ExecuteUntilFetched(ctx context.Context, minDelay, maxDelay time.Duration) {
 	logger := slog.Default().With("component", "cron handler")
 
-	counters, err := jh.client.Counters()
+	delay := minDelay
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		err := jh.Execute(ctx)
+		if err == nil {
+			logger.Info("counters fetched")
+			return
+		}
+		delay = min(delay*2, maxDelay)
+		logger.Warn("can't fetch counters, retrying", "in", delay, "msg", err)
+	}
+}
+
+// execute fetches the counters and stores them for the gyms, narrowed down
+// to the named source and the gym unless they are empty.
+func (jh *JobHandler) execute(ctx context.Context, source, gym string) error {
+	allProviders, allStorers := jh.gyms()
+	var providers []OccupancyProvider
+	for _, p := range allProviders {
+		if source != "" && !strings.EqualFold(p.Name(), source) {
+			continue
+		}
+		if gym != "" && !(Source{Name: p.Name()}).Owns(gym) {
+			continue
+		}
+		if jh.health != nil {
+			p = jh.health.Watch(p)
+		}
+		providers = append(providers, p)
+	}
+	storers := make(map[string]Storer)
+	for gymKey, storer := range allStorers {
+		if gym != "" && gymKey != gym {
+			continue
+		}
+		if source != "" && !(Source{Name: source}).Owns(gymKey) {
+			continue
+		}
+		storers[gymKey] = storer
+	}
+	// Without a gym to narrow down to, gyms not known yet are discovered
+	if len(providers) == 0 || (gym != "" && len(storers) == 0) {
+		return fmt.Errorf("nothing to fetch for source %q, gym %q", source, gym)
+	}
+
+	counters, fetchErr := fetchCounters(ctx, providers)
+	return jh.record(ctx, counters, fetchErr, storers, allStorers)
+}
+
+// Record stores counters fetched outside of the job for all the gyms, as
+// execute does with the ones it fetches. fetchErr is the error of the fetch.
+func (jh *JobHandler) Record(ctx context.Context, counters *Counters, fetchErr error) error {
+	_, allStorers := jh.gyms()
+	return jh.record(ctx, counters, fetchErr, maps.Clone(allStorers), allStorers)
+}
+
+// record stores the fetched counters for the gyms in storers, which it adds
+// the gyms discovered in them to.
+func (jh *JobHandler) record(ctx context.Context, counters *Counters, fetchErr error, storers, allStorers map[string]Storer) error {
+	logger := slog.Default().With("component", "cron handler")
+
+	jh.markFetched(counters, storers, fetchErr, time.Now())
+	if fetchErr != nil {
+		logger.Error("can't get counters from provider", "msg", fetchErr)
+		if len(*counters) == 0 {
+			return fetchErr
+		}
+	}
+
+	firstErr := fetchErr
+	added, err := jh.discover(counters, allStorers)
 	if err != nil {
-		logger.Error("can't get counters from client", "msg", err)
-		return err
+		logger.Error("failed to add gym", "msg", err)
+		if firstErr == nil {
+			firstErr = err
+		}
 	}
+	maps.Copy(storers, added)
 
-	var firstErr error
-	for gym, storer := range jh.storers {
-		counter := counters.Counter(gym)
-		logger.Info("got counter from client", "gym", gym, "counter", counter)
+	if fetchErr == nil {
+		// Without a failed source, a gym missing from the counters is missing from its page
+		jh.track(counters, storers, time.Now())
+	}
+
+	for gym, storer := range storers {
+		counter, ok := (*counters)[gym]
+		if !ok {
+			// The gym's source failed or the gym is missing, nothing to store
+			continue
+		}
+		logger.Info("got counter from provider", "gym", gym, "counter", counter)
 		if err := storer.Store(counter); err != nil {
 			logger.Error("failed to store counter", "gym", gym, "msg", err)
 			if firstErr == nil {
 				firstErr = err
 			}
+			continue
+		}
+		if jh.alerts != nil && !counter.LastUpdate.IsZero() {
+			jh.notify(ctx, gym, counter)
 		}
 	}
 	return firstErr
 }
 
+// discover creates storage for the gyms in the counters the job doesn't
+// know yet, and tells the listeners about them.
+func (jh *JobHandler) discover(counters *Counters, known map[string]Storer) (map[string]Storer, error) {
+	logger := slog.Default().With("component", "cron handler")
+
+	added := make(map[string]Storer)
+	var errs []error
+	for gymKey := range *counters {
+		if _, ok := known[gymKey]; ok {
+			continue
+		}
+		st, err := jh.newStorer(gymKey)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		logger.Info("discovered gym", "gym", gymKey)
+		added[gymKey] = st
+	}
+	if len(added) == 0 {
+		return added, errors.Join(errs...)
+	}
+
+	jh.mu.Lock()
+	storers := maps.Clone(jh.storers)
+	for gymKey, st := range added {
+		if _, ok := storers[gymKey]; ok {
+			// Another job got there first
+			delete(added, gymKey)
+			continue
+		}
+		storers[gymKey] = st
+	}
+	jh.storers = storers
+	jh.seeAll(added, time.Now())
+	listeners := jh.onNewGym
+	jh.mu.Unlock()
+
+	for gymKey, st := range added {
+		for _, fn := range listeners {
+			fn(gymKey, st)
+		}
+	}
+	return added, errors.Join(errs...)
+}
+
+// markFetched marks the gyms with a counter fresh again and, when a source
+// failed, the ones without one stale. A gym merely missing from its page is
+// left to track.
+func (jh *JobHandler) markFetched(counters *Counters, storers map[string]Storer, fetchErr error, now time.Time) {
+	jh.mu.Lock()
+	defer jh.mu.Unlock()
+	for gymKey := range storers {
+		if _, ok := (*counters)[gymKey]; ok {
+			delete(jh.staleSince, gymKey)
+		} else if _, ok := jh.staleSince[gymKey]; !ok && fetchErr != nil {
+			jh.staleSince[gymKey] = now
+		}
+	}
+}
+
+// track notes which of the gyms are on their source's page, marking the ones
+// missing for too long inactive and the ones back active again.
+func (jh *JobHandler) track(counters *Counters, storers map[string]Storer, now time.Time) {
+	logger := slog.Default().With("component", "cron handler")
+
+	changed := make(map[string]bool)
+	jh.mu.Lock()
+	for gymKey := range storers {
+		if _, ok := (*counters)[gymKey]; ok {
+			jh.lastSeen[gymKey] = now
+			if jh.inactive[gymKey] {
+				delete(jh.inactive, gymKey)
+				changed[gymKey] = true
+			}
+			continue
+		}
+		if !jh.inactive[gymKey] && now.Sub(jh.lastSeen[gymKey]) >= jh.inactiveAfter {
+			jh.inactive[gymKey] = true
+			changed[gymKey] = false
+		}
+	}
+	listeners, inactiveAfter := jh.onGymActive, jh.inactiveAfter
+	jh.mu.Unlock()
+
+	for gymKey, active := range changed {
+		if active {
+			logger.Info("gym is back", "gym", gymKey)
+		} else {
+			logger.Warn("gym marked inactive", "gym", gymKey, "missing_for", inactiveAfter)
+		}
+		for _, fn := range listeners {
+			fn(gymKey, active)
+		}
+	}
+}
+
+// notify sends the gym's alerts that fire on the counter.
+func (jh *JobHandler) notify(ctx context.Context, gym string, counter Counter) {
+	logger := slog.Default().With("component", "cron handler")
+
+	fired, err := jh.alerts.Check(gym, counter, time.Now())
+	if err != nil {
+		logger.Error("failed to check alerts", "gym", gym, "msg", err)
+	}
+	for _, alert := range fired {
+		logger.Info("sending alert", "gym", gym, "chat_id", alert.ChatID, "alert", alert)
+		_, err := jh.notifier.SendMessage(ctx, &bot.SendMessageParams{ChatID: alert.ChatID, Text: alert.Message(counter)})
+		if err != nil {
+			logger.Error("failed to send alert", "gym", gym, "chat_id", alert.ChatID, "msg", err)
+		}
+	}
+}
+
 func (jh *JobHandler) Description() string {
-	return fmt.Sprintf("Climber Count Job for %d gym(s)", len(jh.storers))
+	_, storers := jh.gyms()
+	return fmt.Sprintf("Climber Count Job for %d gym(s)", len(storers))
+}
+
+// FetchJob fetches counters from a single source or for a single gym on their own schedule.
+type FetchJob struct {
+	jh     *JobHandler
+	source string
+	gym    string
+}
+
+func (fj *FetchJob) Execute(ctx context.Context) error {
+	return fj.jh.execute(ctx, fj.source, fj.gym)
+}
+
+func (fj *FetchJob) Description() string {
+	if fj.gym != "" {
+		return fmt.Sprintf("Climber Count Job for %s", fj.gym)
+	}
+	return fmt.Sprintf("Climber Count Job for source %s", fj.source)
 }
 
 type BotHandler struct {
+	// mu guards storers, inactive and defaultGym, which a config reload and
+	// the fetch job swap while handlers run.
+	mu         sync.RWMutex
 	storers    map[string]Storer
+	inactive   map[string]bool
 	defaultGym string
+	alerts     *Alerts
+	prefs      *Preferences
+	staleSince func(gymKey string) (time.Time, bool)
 	logger     *slog.Logger
 }
 
@@ -67,6 +435,73 @@ func NewBotHandler(defaultGym string, storers map[string]Storer) *BotHandler {
 	}
 }
 
+// SetGyms swaps the known gyms and the default gym.
+func (bh *BotHandler) SetGyms(defaultGym string, storers map[string]Storer) {
+	bh.mu.Lock()
+	defer bh.mu.Unlock()
+	bh.defaultGym = defaultGym
+	bh.storers = storers
+}
+
+// AddGym adds a gym discovered after startup.
+func (bh *BotHandler) AddGym(gymKey string, storer Storer) {
+	bh.mu.Lock()
+	defer bh.mu.Unlock()
+	storers := maps.Clone(bh.storers)
+	storers[gymKey] = storer
+	bh.storers = storers
+}
+
+// SetGymActive marks a gym that's gone from its source's page inactive, or
+// active again. Inactive gyms keep their history but are left out of the
+// /gym buttons.
+func (bh *BotHandler) SetGymActive(gymKey string, active bool) {
+	bh.mu.Lock()
+	defer bh.mu.Unlock()
+	inactive := maps.Clone(bh.inactive)
+	if inactive == nil {
+		inactive = make(map[string]bool)
+	}
+	if active {
+		delete(inactive, gymKey)
+	} else {
+		inactive[gymKey] = true
+	}
+	bh.inactive = inactive
+}
+
+// isInactive reports whether the gym has been marked inactive.
+func (bh *BotHandler) isInactive(gymKey string) bool {
+	bh.mu.RLock()
+	defer bh.mu.RUnlock()
+	return bh.inactive[gymKey]
+}
+
+// gyms returns the known gyms. The map is replaced, never changed, on reload
+// so it is safe to read without holding the lock.
+func (bh *BotHandler) gyms() map[string]Storer {
+	bh.mu.RLock()
+	defer bh.mu.RUnlock()
+	return bh.storers
+}
+
+// SetAlerts enables the /alert command, keeping subscriptions in alerts.
+func (bh *BotHandler) SetAlerts(alerts *Alerts) {
+	bh.alerts = alerts
+}
+
+// SetStaleness makes /count tell when a gym's counter is stale, using
+// staleSince to learn since when its page couldn't be fetched.
+func (bh *BotHandler) SetStaleness(staleSince func(gymKey string) (time.Time, bool)) {
+	bh.staleSince = staleSince
+}
+
+// SetPreferences enables the /setgym, /settz and /setlang commands and makes
+// the other commands respect the chat's preferences.
+func (bh *BotHandler) SetPreferences(prefs *Preferences) {
+	bh.prefs = prefs
+}
+
 func (bh *BotHandler) CountHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 	bh.logger.Info("CountHandler", "text", update.Message)
 	if update.Message == nil {
@@ -74,41 +509,435 @@ func (bh *BotHandler) CountHandler(ctx context.Context, b *bot.Bot, update *mode
 	}
 	chatID := update.Message.Chat.ID
 
-	gymKey := bh.defaultGym
+	gymKey := bh.chatGym(chatID)
 	if fields := strings.Fields(update.Message.Text); len(fields) >= 2 {
 		gymKey = strings.ToUpper(fields[1])
 	}
 
-	storer, ok := bh.storers[gymKey]
+	storer, ok := bh.gyms()[gymKey]
 	if !ok {
 		b.SendMessage(ctx, bh.Message(b, chatID,
 			fmt.Sprintf("Unknown gym %q. Known gyms: %s", gymKey, bh.gymKeys())))
 		return
 	}
 
-	if counter, ok := storer.Last(); ok {
-		b.SendMessage(ctx, bh.Message(b, chatID, counter.String()))
+	if msg := bh.countMessage(chatID, gymKey, storer); msg != "" {
+		b.SendMessage(ctx, bh.Message(b, chatID, msg))
 	}
 }
 
-func (bh *BotHandler) GymHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+// countMessage is the /count reply for the gym, saying so when the counter
+// is stale because its page couldn't be fetched lately.
+func (bh *BotHandler) countMessage(chatID int64, gymKey string, storer Storer) string {
+	var stale string
+	if bh.staleSince != nil {
+		if since, ok := bh.staleSince(gymKey); ok {
+			stale = fmt.Sprintf("The data is stale, the gym's page can't be read since %s.",
+				since.In(bh.now(chatID).Location()).Format("Jan 2 15:04"))
+		}
+	}
+
+	counter, ok := storer.Last()
+	if !ok {
+		if stale == "" {
+			return ""
+		}
+		return fmt.Sprintf("No data for %s yet. %s", bh.gymLabel(gymKey), stale)
+	}
+	msg := counter.String()
+	if counter.Name != "" || bh.isInactive(gymKey) {
+		msg = bh.gymLabel(gymKey) + ": " + msg
+	}
+	if stale != "" {
+		msg += "\n" + stale
+	}
+	return msg
+}
+
+func (bh *BotHandler) HistoryHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 	if update.Message == nil {
 		return
 	}
 	chatID := update.Message.Chat.ID
-	msg := bh.Message(b, chatID, "Going into the gym?")
-	msg.ReplyMarkup = &models.InlineKeyboardMarkup{
-		InlineKeyboard: [][]models.InlineKeyboardButton{
-			{
-				{Text: "Yeah", CallbackData: "gym_in"},
-				{Text: "Done", CallbackData: "gym_out"},
-			},
-		},
+
+	gymKey, period := bh.gymArgs(chatID, update.Message.Text)
+
+	storer, ok := bh.gyms()[gymKey]
+	if !ok {
+		b.SendMessage(ctx, bh.Message(b, chatID,
+			fmt.Sprintf("Unknown gym %q. Known gyms: %s", gymKey, bh.gymKeys())))
+		return
+	}
+
+	from, to, label, err := historyPeriod(period, bh.now(chatID))
+	if err != nil {
+		bh.logger.Info("bad history period", "msg", err)
+		b.SendMessage(ctx, bh.Message(b, chatID,
+			fmt.Sprintf("Unknown gym or period %q. Known gyms: %s. Periods: today, yesterday or 1h to %dh.", period, bh.gymKeys(), maxHistoryHours)))
+		return
 	}
+
+	counters, err := storer.Range(from, to)
+	if err != nil {
+		bh.logger.Error("can't read history", "gym", gymKey, "msg", err)
+		b.SendMessage(ctx, bh.Message(b, chatID, "Can't read the history right now, try again later."))
+		return
+	}
+
+	b.SendMessage(ctx, bh.Message(b, chatID, renderHistory(bh.gymLabel(gymKey), label, inLocation(counters, from.Location()))))
+}
+
+func (bh *BotHandler) ChartHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	if update.Message == nil {
+		return
+	}
+	chatID := update.Message.Chat.ID
+
+	gymKey, period := bh.gymArgs(chatID, update.Message.Text)
+	period = strings.ToLower(period)
+
+	storer, ok := bh.gyms()[gymKey]
+	if !ok {
+		b.SendMessage(ctx, bh.Message(b, chatID,
+			fmt.Sprintf("Unknown gym %q. Known gyms: %s", gymKey, bh.gymKeys())))
+		return
+	}
+	if period != "" && period != "day" && period != "week" {
+		b.SendMessage(ctx, bh.Message(b, chatID,
+			fmt.Sprintf("Unknown gym or period %q. Known gyms: %s. Periods: day or week.", period, bh.gymKeys())))
+		return
+	}
+
+	c, caption, err := occupancyChart(storer, bh.gymLabel(gymKey), period, bh.now(chatID))
+	if errors.Is(err, errNoChartData) {
+		b.SendMessage(ctx, bh.Message(b, chatID, fmt.Sprintf("No data to chart for %s yet.", gymKey)))
+		return
+	}
+	if err != nil {
+		bh.logger.Error("can't build chart", "gym", gymKey, "msg", err)
+		b.SendMessage(ctx, bh.Message(b, chatID, "Can't draw the chart right now, try again later."))
+		return
+	}
+
+	img, err := c.PNG()
+	if err != nil {
+		bh.logger.Error("can't render chart", "gym", gymKey, "msg", err)
+		b.SendMessage(ctx, bh.Message(b, chatID, "Can't draw the chart right now, try again later."))
+		return
+	}
+
+	b.SendPhoto(ctx, bh.Photo(b, chatID, img, caption))
+}
+
+func (bh *BotHandler) BestHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	if update.Message == nil {
+		return
+	}
+	chatID := update.Message.Chat.ID
+
+	gymKey, day := bh.gymArgs(chatID, update.Message.Text)
+	storer, ok := bh.gyms()[gymKey]
+	if !ok {
+		b.SendMessage(ctx, bh.Message(b, chatID,
+			fmt.Sprintf("Unknown gym %q. Known gyms: %s", gymKey, bh.gymKeys())))
+		return
+	}
+
+	now := bh.now(chatID)
+	wd, err := parseWeekday(day, now)
+	if err != nil {
+		b.SendMessage(ctx, bh.Message(b, chatID,
+			fmt.Sprintf("Unknown gym or weekday %q. Known gyms: %s", day, bh.gymKeys())))
+		return
+	}
+
+	counters, err := storer.Range(now.AddDate(0, 0, -7*bestWeeks), now)
+	if err != nil {
+		bh.logger.Error("can't read history", "gym", gymKey, "msg", err)
+		b.SendMessage(ctx, bh.Message(b, chatID, "Can't read the history right now, try again later."))
+		return
+	}
+
+	capacity := 0
+	if len(counters) > 0 {
+		capacity = counters[len(counters)-1].Capacity
+	}
+	hours := hourlyAverages(inLocation(counters, now.Location()), wd)
+	b.SendMessage(ctx, bh.Message(b, chatID, renderBest(bh.gymLabel(gymKey), wd, capacity, hours)))
+}
+
+func (bh *BotHandler) ForecastHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	if update.Message == nil {
+		return
+	}
+	chatID := update.Message.Chat.ID
+
+	gymKey, args := bh.gymFields(chatID, update.Message.Text)
+	if len(args) > 0 {
+		b.SendMessage(ctx, bh.Message(b, chatID,
+			fmt.Sprintf("Unknown gym %q. Known gyms: %s", args[0], bh.gymKeys())))
+		return
+	}
+	storer, ok := bh.gyms()[gymKey]
+	if !ok {
+		b.SendMessage(ctx, bh.Message(b, chatID,
+			fmt.Sprintf("Unknown gym %q. Known gyms: %s", gymKey, bh.gymKeys())))
+		return
+	}
+
+	current, ok := storer.Last()
+	if !ok {
+		b.SendMessage(ctx, bh.Message(b, chatID, fmt.Sprintf("Not enough data to forecast %s yet.", gymKey)))
+		return
+	}
+
+	now := bh.now(chatID)
+	y, m, d := now.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	recent, err := storer.Range(now.Add(-time.Hour), now.Add(time.Minute))
+	if err != nil {
+		bh.logger.Error("can't read history", "gym", gymKey, "msg", err)
+		b.SendMessage(ctx, bh.Message(b, chatID, "Can't read the history right now, try again later."))
+		return
+	}
+	history, err := storer.Range(midnight.AddDate(0, 0, -7*forecastWeeks), midnight)
+	if err != nil {
+		bh.logger.Error("can't read history", "gym", gymKey, "msg", err)
+		b.SendMessage(ctx, bh.Message(b, chatID, "Can't read the history right now, try again later."))
+		return
+	}
+
+	current.LastUpdate.Time = current.LastUpdate.In(now.Location())
+	f := NewForecast(current, inLocation(recent, now.Location()), inLocation(history, now.Location()), now)
+	b.SendMessage(ctx, bh.Message(b, chatID, f.Render(bh.gymLabel(gymKey))))
+}
+
+func (bh *BotHandler) AlertHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	if update.Message == nil || bh.alerts == nil {
+		return
+	}
+	chatID := update.Message.Chat.ID
+	now := bh.now(chatID)
+
+	gymKey, args := bh.gymFields(chatID, update.Message.Text)
+	if len(args) == 0 {
+		alerts, err := bh.alerts.List(chatID, now)
+		if err != nil {
+			bh.logger.Error("can't list alerts", "msg", err)
+			b.SendMessage(ctx, bh.Message(b, chatID, "Can't read your alerts right now, try again later."))
+			return
+		}
+		if len(alerts) == 0 {
+			b.SendMessage(ctx, bh.Message(b, chatID, "No alerts. Try /alert GYM below 30 [tonight|for 3h] [quiet 22-07]"))
+			return
+		}
+		lines := make([]string, 0, len(alerts))
+		for _, alert := range alerts {
+			lines = append(lines, alert.String())
+		}
+		b.SendMessage(ctx, bh.Message(b, chatID, "Your alerts:\n"+strings.Join(lines, "\n")))
+		return
+	}
+
+	if strings.ToLower(args[0]) == "off" {
+		// Only a gym given explicitly narrows down which alerts go,
+		// in which case it is the one field gymFields left out of args
+		gym := ""
+		if explicit := len(strings.Fields(update.Message.Text))-1 > len(args); explicit {
+			gym = gymKey
+		}
+		n, err := bh.alerts.Remove(chatID, gym)
+		if err != nil {
+			bh.logger.Error("can't remove alerts", "msg", err)
+			b.SendMessage(ctx, bh.Message(b, chatID, "Can't remove your alerts right now, try again later."))
+			return
+		}
+		b.SendMessage(ctx, bh.Message(b, chatID, fmt.Sprintf("Removed %s.", plural(int(n), "alert"))))
+		return
+	}
+
+	storer, ok := bh.gyms()[gymKey]
+	if !ok {
+		b.SendMessage(ctx, bh.Message(b, chatID,
+			fmt.Sprintf("Unknown gym %q. Known gyms: %s", gymKey, bh.gymKeys())))
+		return
+	}
+
+	last, _ := storer.Last()
+	alert, err := parseAlert(args, last, now)
+	if err != nil {
+		b.SendMessage(ctx, bh.Message(b, chatID,
+			fmt.Sprintf("Can't set the alert: %s. Try /alert GYM below 30 [tonight|for 3h] [quiet 22-07]", err)))
+		return
+	}
+	alert = bh.alerts.withDefaults(alert, now)
+	alert.ChatID, alert.Gym, alert.Location = chatID, gymKey, now.Location()
+
+	if alert, err = bh.alerts.Add(alert); err != nil {
+		bh.logger.Error("can't add alert", "msg", err)
+		b.SendMessage(ctx, bh.Message(b, chatID, "Can't save the alert right now, try again later."))
+		return
+	}
+
+	msg := fmt.Sprintf("Alert set: %s.", alert)
+	if !alert.Armed {
+		msg = fmt.Sprintf("%s is at %d already, so you'll hear about the next time it gets there. Alert set: %s.", gymKey, last.Count, alert)
+	}
+	b.SendMessage(ctx, bh.Message(b, chatID, msg))
+}
+
+func (bh *BotHandler) SetGymHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	if update.Message == nil || bh.prefs == nil {
+		return
+	}
+	chatID := update.Message.Chat.ID
+
+	fields := strings.Fields(update.Message.Text)
+	if len(fields) < 2 {
+		b.SendMessage(ctx, bh.Message(b, chatID,
+			fmt.Sprintf("Your gym is %s. Change it with /setgym GYM. Known gyms: %s", bh.gymLabel(bh.chatGym(chatID)), bh.gymKeys())))
+		return
+	}
+
+	gymKey := strings.ToUpper(fields[1])
+	if _, ok := bh.gyms()[gymKey]; !ok {
+		b.SendMessage(ctx, bh.Message(b, chatID,
+			fmt.Sprintf("Unknown gym %q. Known gyms: %s", gymKey, bh.gymKeys())))
+		return
+	}
+
+	if err := bh.prefs.SetGym(chatID, gymKey); err != nil {
+		bh.logger.Error("can't save preferences", "chat_id", chatID, "msg", err)
+		b.SendMessage(ctx, bh.Message(b, chatID, "Can't save your preferences right now, try again later."))
+		return
+	}
+	b.SendMessage(ctx, bh.Message(b, chatID, fmt.Sprintf("Your gym is %s now.", bh.gymLabel(gymKey))))
+}
+
+func (bh *BotHandler) SetTimezoneHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	bh.setPreference(ctx, b, update, "timezone", "/settz America/New_York", bh.prefs.SetTimezone)
+}
+
+func (bh *BotHandler) SetLanguageHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	bh.setPreference(ctx, b, update, "language", "/setlang en", bh.prefs.SetLanguage)
+}
+
+// setPreference stores the command's argument with set, or shows the chat's
+// preferences and the example usage when there is no argument.
+func (bh *BotHandler) setPreference(ctx context.Context, b *bot.Bot, update *models.Update, name, usage string, set func(int64, string) error) {
+	if update.Message == nil || bh.prefs == nil {
+		return
+	}
+	chatID := update.Message.Chat.ID
+
+	fields := strings.Fields(update.Message.Text)
+	if len(fields) < 2 {
+		b.SendMessage(ctx, bh.Message(b, chatID,
+			fmt.Sprintf("Your preferences:\n%s\nChange the %s with %s", bh.chatPrefs(chatID), name, usage)))
+		return
+	}
+
+	if err := set(chatID, fields[1]); err != nil {
+		b.SendMessage(ctx, bh.Message(b, chatID, fmt.Sprintf("Can't set the %s: %s.", name, err)))
+		return
+	}
+	b.SendMessage(ctx, bh.Message(b, chatID, fmt.Sprintf("Your %s is %s now.", name, fields[1])))
+}
+
+func (bh *BotHandler) StatsHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	if update.Message == nil || update.Message.From == nil {
+		return
+	}
+	chatID := update.Message.Chat.ID
+
+	var sessions []Session
+	for gymKey, storer := range bh.gyms() {
+		gymSessions, err := storer.GetGym().Sessions(update.Message.From.ID)
+		if err != nil {
+			bh.logger.Error("can't read sessions", "gym", gymKey, "msg", err)
+			b.SendMessage(ctx, bh.Message(b, chatID, "Can't read your sessions right now, try again later."))
+			return
+		}
+		sessions = append(sessions, gymSessions...)
+	}
+
+	b.SendMessage(ctx, bh.Message(b, chatID, NewStats(sessions, bh.now(chatID)).String()))
+}
+
+func (bh *BotHandler) GymHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	if update.Message == nil {
+		return
+	}
+	chatID := update.Message.Chat.ID
+	msg := bh.Message(b, chatID, bh.gymState(chatID))
+	msg.ReplyMarkup = bh.gymKeyboard(chatID)
 	b.SendMessage(ctx, msg)
 }
 
 func (bh *BotHandler) GymButtonHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	if update.CallbackQuery == nil || update.CallbackQuery.Message.Message == nil {
+		return
+	}
+
+	msg := update.CallbackQuery.Message.Message
+	chatID := msg.Chat.ID
+	climber := Climber{
+		ID:       update.CallbackQuery.From.ID,
+		Username: update.CallbackQuery.From.Username,
+		ChatID:   chatID,
+	}
+
+	action, gymKey := parseGymCallbackData(update.CallbackQuery.Data)
+	if gymKey == "" {
+		gymKey = bh.chatGym(chatID)
+	}
+
+	var reply string
+	var err error
+	storer, ok := bh.gyms()[gymKey]
+	switch {
+	case !ok:
+		err = fmt.Errorf("unknown gym %q, known gyms: %s", gymKey, bh.gymKeys())
+	case action == "in":
+		if err = storer.GetGym().In(climber); err == nil {
+			reply = fmt.Sprintf("Have a great climb at %s!", bh.gymLabel(gymKey))
+		}
+	case action == "out":
+		var since string
+		if since, err = storer.GetGym().Out(climber); err == nil {
+			reply = fmt.Sprintf("You went to %s %s. Good job!", bh.gymLabel(gymKey), since)
+		}
+	default:
+		err = fmt.Errorf("unknown gym action %q", update.CallbackQuery.Data)
+	}
+
+	if err != nil {
+		bh.logger.Info("gym button failed", "chat_id", chatID, "gym", gymKey, "msg", err)
+		b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+			CallbackQueryID: update.CallbackQuery.ID,
+			Text:            err.Error(),
+			ShowAlert:       true,
+		})
+		return
+	}
+
+	b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+		CallbackQueryID: update.CallbackQuery.ID,
+		Text:            reply,
+		ShowAlert:       false,
+	})
+
+	text := bh.gymState(chatID)
+	bh.logger.Info("editing reply", "chat_id", chatID, "text", text)
+	b.EditMessageText(ctx, &bot.EditMessageTextParams{
+		ChatID:      chatID,
+		MessageID:   msg.ID,
+		Text:        text,
+		ReplyMarkup: bh.gymKeyboard(chatID),
+	})
+}
+
+func (bh *BotHandler) SessionButtonHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
 	if update.CallbackQuery == nil {
 		return
 	}
@@ -118,32 +947,54 @@ func (bh *BotHandler) GymButtonHandler(ctx context.Context, b *bot.Bot, update *
 		ShowAlert:       false,
 	})
 
-	chatID := update.CallbackQuery.Message.Message.Chat.ID
+	msg := update.CallbackQuery.Message.Message
+	if msg == nil {
+		return
+	}
 
-	storer, ok := bh.storers[bh.defaultGym]
+	gymKey, id, choice, err := parseSessionCallbackData(update.CallbackQuery.Data)
+	if err != nil {
+		bh.logger.Error("bad session callback", "msg", err)
+		return
+	}
+
+	storer, ok := bh.gyms()[gymKey]
 	if !ok {
-		b.SendMessage(ctx, bh.Message(b, chatID,
-			fmt.Sprintf("Unknown gym %q. Known gyms: %s", bh.defaultGym, bh.gymKeys())))
+		b.SendMessage(ctx, bh.Message(b, msg.Chat.ID,
+			fmt.Sprintf("Unknown gym %q. Known gyms: %s", gymKey, bh.gymKeys())))
 		return
 	}
 
-	if update.CallbackQuery.Data == "gym_in" {
-		msg := "Have a great climb!"
-		err := storer.GetGym().In()
-		if err != nil {
-			msg = err.Error()
-		}
-		b.SendMessage(ctx, bh.Message(b, chatID, msg))
+	session, err := storer.GetGym().Session(id)
+	if err != nil {
+		b.SendMessage(ctx, bh.Message(b, msg.Chat.ID, err.Error()))
+		return
+	}
+	if session.Climber.ID != update.CallbackQuery.From.ID {
+		return
 	}
 
-	if update.CallbackQuery.Data == "gym_out" {
-		msg, err := storer.GetGym().Out()
+	text := fmt.Sprintf("Thanks! Your %s session stays at %s.", gymKey, formatDuration(session.Duration))
+	if choice != "ok" {
+		minutes, err := strconv.Atoi(choice)
 		if err != nil {
-			b.SendMessage(ctx, bh.Message(b, chatID, err.Error()))
+			bh.logger.Error("bad session callback", "msg", err)
 			return
 		}
-		b.SendMessage(ctx, bh.Message(b, chatID, fmt.Sprintf("You went to gym %s. Good job!", msg)))
+		d := time.Duration(minutes) * time.Minute
+		if err := storer.GetGym().SetEnd(id, session.Start.Add(d)); err != nil {
+			b.SendMessage(ctx, bh.Message(b, msg.Chat.ID, err.Error()))
+			return
+		}
+		text = fmt.Sprintf("Got it, your %s session is now %s.", gymKey, formatDuration(d))
 	}
+
+	bh.logger.Info("editing reply", "chat_id", msg.Chat.ID, "text", text)
+	b.EditMessageText(ctx, &bot.EditMessageTextParams{
+		ChatID:    msg.Chat.ID,
+		MessageID: msg.ID,
+		Text:      text,
+	})
 }
 
 func (bh *BotHandler) Message(b *bot.Bot, chatID int64, msg string) *bot.SendMessageParams {
@@ -151,6 +1002,15 @@ func (bh *BotHandler) Message(b *bot.Bot, chatID int64, msg string) *bot.SendMes
 	return &bot.SendMessageParams{ChatID: chatID, Text: msg}
 }
 
+func (bh *BotHandler) Photo(b *bot.Bot, chatID int64, img []byte, caption string) *bot.SendPhotoParams {
+	bh.logger.Info("sending photo", "chat_id", chatID, "caption", caption, "size", len(img))
+	return &bot.SendPhotoParams{
+		ChatID:  chatID,
+		Photo:   &models.InputFileUpload{Filename: "chart.png", Data: bytes.NewReader(img)},
+		Caption: caption,
+	}
+}
+
 func (bh *BotHandler) Reaction(b *bot.Bot, chatID int64, msgId int, emoji string) *bot.SetMessageReactionParams {
 	bh.logger.Info("sending reply", "chat_id", chatID, "reply", emoji)
 	return &bot.SetMessageReactionParams{
@@ -166,11 +1026,167 @@ func (bh *BotHandler) Reaction(b *bot.Bot, chatID int64, msgId int, emoji string
 	}
 }
 
+// gymArgs splits a command's arguments into a known gym key, falling back
+// to the chat's gym, and whatever other argument was given.
+func (bh *BotHandler) gymArgs(chatID int64, text string) (gymKey, arg string) {
+	gymKey, args := bh.gymFields(chatID, text)
+	if len(args) > 0 {
+		arg = args[len(args)-1]
+	}
+	return gymKey, arg
+}
+
+// gymFields splits a command's arguments into a known gym key, falling back
+// to the chat's gym, and all the other arguments.
+func (bh *BotHandler) gymFields(chatID int64, text string) (gymKey string, args []string) {
+	gymKey = bh.chatGym(chatID)
+	fields := strings.Fields(text)
+	if len(fields) > 0 {
+		fields = fields[1:]
+	}
+	for _, f := range fields {
+		if _, ok := bh.gyms()[strings.ToUpper(f)]; ok {
+			gymKey = strings.ToUpper(f)
+			continue
+		}
+		args = append(args, f)
+	}
+	return gymKey, args
+}
+
+// chatPrefs returns the chat's preferences, empty when there are none.
+func (bh *BotHandler) chatPrefs(chatID int64) Prefs {
+	if bh.prefs == nil {
+		return Prefs{ChatID: chatID}
+	}
+	prefs, err := bh.prefs.Get(chatID)
+	if err != nil {
+		bh.logger.Error("can't read preferences", "chat_id", chatID, "msg", err)
+	}
+	return prefs
+}
+
+// chatGym returns the chat's preferred gym, falling back to the default gym.
+func (bh *BotHandler) chatGym(chatID int64) string {
+	if gym := bh.chatPrefs(chatID).Gym; gym != "" {
+		if _, ok := bh.gyms()[gym]; ok {
+			return gym
+		}
+	}
+	bh.mu.RLock()
+	defer bh.mu.RUnlock()
+	return bh.defaultGym
+}
+
+// now returns the current time in the chat's timezone.
+func (bh *BotHandler) now(chatID int64) time.Time {
+	return time.Now().In(bh.chatPrefs(chatID).Location())
+}
+
+// gymKeyboard offers a check-in and a check-out button for every known gym,
+// the chat's gym first.
+func (bh *BotHandler) gymKeyboard(chatID int64) *models.InlineKeyboardMarkup {
+	chatGym := bh.chatGym(chatID)
+	storers := bh.gyms()
+	keys := make([]string, 0, len(storers))
+	for k := range storers {
+		if bh.isInactive(k) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if (keys[i] == chatGym) != (keys[j] == chatGym) {
+			return keys[i] == chatGym
+		}
+		return keys[i] < keys[j]
+	})
+
+	rows := make([][]models.InlineKeyboardButton, 0, len(keys))
+	for _, k := range keys {
+		rows = append(rows, []models.InlineKeyboardButton{
+			{Text: "Yeah, " + k, CallbackData: gymCallbackData("in", k)},
+			{Text: "Done, " + k, CallbackData: gymCallbackData("out", k)},
+		})
+	}
+	return &models.InlineKeyboardMarkup{InlineKeyboard: rows}
+}
+
+// gymState lists who in the chat is checked in at which gym.
+func (bh *BotHandler) gymState(chatID int64) string {
+	storers := bh.gyms()
+	keys := make([]string, 0, len(storers))
+	for k := range storers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	loc := bh.now(chatID).Location()
+	var lines []string
+	for _, k := range keys {
+		gym := storers[k].GetGym()
+		if gym == nil {
+			continue
+		}
+		active, err := gym.Active(chatID)
+		if err != nil {
+			bh.logger.Error("can't read sessions", "gym", k, "msg", err)
+			continue
+		}
+		if len(active) == 0 {
+			continue
+		}
+		climbers := make([]string, 0, len(active))
+		for _, s := range active {
+			climbers = append(climbers, fmt.Sprintf("%s since %s", s.Climber.Name(), s.Start.In(loc).Format("15:04")))
+		}
+		lines = append(lines, fmt.Sprintf("%s: %s", bh.gymLabel(k), strings.Join(climbers, ", ")))
+	}
+
+	if len(lines) == 0 {
+		return "Going into the gym? Nobody is climbing right now."
+	}
+	return "Going into the gym? Climbing right now:\n" + strings.Join(lines, "\n")
+}
+
+// gymCallbackData encodes a /gym button as "gym_<action>_<gym>".
+func gymCallbackData(action, gymKey string) string {
+	return "gym_" + action + "_" + gymKey
+}
+
+// parseGymCallbackData reverses gymCallbackData. Buttons sent before gyms
+// could be picked carry no gym key, in which case it is empty.
+func parseGymCallbackData(data string) (action, gymKey string) {
+	rest, _ := strings.CutPrefix(data, "gym_")
+	action, gymKey, _ = strings.Cut(rest, "_")
+	return action, gymKey
+}
+
+// gymKeys lists the known gyms by name and key, e.g. "Brooklyn Boulders (BKB)".
 func (bh *BotHandler) gymKeys() string {
-	keys := make([]string, 0, len(bh.storers))
-	for k := range bh.storers {
+	storers := bh.gyms()
+	keys := make([]string, 0, len(storers))
+	for k := range storers {
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
+	for i, k := range keys {
+		keys[i] = bh.gymLabel(k)
+	}
 	return strings.Join(keys, ", ")
 }
+
+// gymLabel names the gym after the name stored with its last counter,
+// noting if it's inactive.
+func (bh *BotHandler) gymLabel(gymKey string) string {
+	storer, ok := bh.gyms()[gymKey]
+	if !ok {
+		return gymKey
+	}
+	counter, _ := storer.Last()
+	label := counter.Label(gymKey)
+	if bh.isInactive(gymKey) {
+		label += " (inactive)"
+	}
+	return label
+}
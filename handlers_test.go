@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"io"
+	"maps"
 	"net/http"
 	"os"
 	"strconv"
@@ -38,9 +39,18 @@ func (s *stubStorer) Last() (Counter, bool) {
 	}
 	return s.stored[len(s.stored)-1], true
 }
+func (s *stubStorer) Range(from, to time.Time) ([]Counter, error) {
+	var counters []Counter
+	for _, c := range s.stored {
+		if !c.LastUpdate.Before(from) && c.LastUpdate.Before(to) {
+			counters = append(counters, c)
+		}
+	}
+	return counters, nil
+}
 func (s *stubStorer) NewGym() error {
 	var err error
-	s.gym, err = NewGym(s.gymPath)
+	s.gym, err = NewGym(s.gymPath, "TST")
 	return err
 }
 func (s *stubStorer) GetGym() *Gym { return s.gym }
@@ -53,7 +63,7 @@ func (e *errStorer) Store(_ Counter) error { return errors.New("store failed") }
 func TestNewJobHandler(t *testing.T) {
 	cfg := &Config{PGK: "pgk", FID: "fid"}
 	storers := map[string]Storer{"TST": newStubStorer(t)}
-	jh := NewJobHandler(t.TempDir(), NewClient(cfg), storers)
+	jh := NewJobHandler(t.TempDir(), []OccupancyProvider{NewClient(cfg)}, storers)
 	if jh == nil {
 		t.Fatal("expected non-nil JobHandler")
 	}
@@ -68,7 +78,7 @@ func TestJobHandler_Description(t *testing.T) {
 		"TST": newStubStorer(t),
 		"SLB": newStubStorer(t),
 	}
-	jh := NewJobHandler(t.TempDir(), NewClient(cfg), storers)
+	jh := NewJobHandler(t.TempDir(), []OccupancyProvider{NewClient(cfg)}, storers)
 	got := jh.Description()
 	want := "Climber Count Job for 2 gym(s)"
 	if got != want {
@@ -89,7 +99,7 @@ func TestJobHandler_Execute_Success(t *testing.T) {
 
 	st := newStubStorer(t)
 	storers := map[string]Storer{"TST": st}
-	jh := NewJobHandler(t.TempDir(), c, storers)
+	jh := NewJobHandler(t.TempDir(), []OccupancyProvider{c}, storers)
 
 	if err := jh.Execute(context.Background()); err != nil {
 		t.Fatalf("unexpected error: %v", err)
@@ -120,7 +130,7 @@ func TestJobHandler_Execute_MultipleGyms(t *testing.T) {
 		"TST": stTST,
 		"SLB": stSLB,
 	}
-	jh := NewJobHandler(t.TempDir(), c, storers)
+	jh := NewJobHandler(t.TempDir(), []OccupancyProvider{c}, storers)
 
 	if err := jh.Execute(context.Background()); err != nil {
 		t.Fatalf("unexpected error: %v", err)
@@ -138,12 +148,38 @@ func TestJobHandler_Execute_FetchError(t *testing.T) {
 	c := NewClient(cfg)
 	c.client = &MockClient{err: errors.New("network down")}
 	storers := map[string]Storer{"TST": newStubStorer(t)}
-	jh := NewJobHandler(t.TempDir(), c, storers)
+	jh := NewJobHandler(t.TempDir(), []OccupancyProvider{c}, storers)
 	if err := jh.Execute(context.Background()); err == nil {
 		t.Fatal("expected error when fetch fails")
 	}
 }
 
+func TestJobHandler_Execute_Sources(t *testing.T) {
+	bldr := NewSourceClient(&Config{}, Source{Name: "bldr", PGK: "p", FID: "f"})
+	bldr.client = &MockClient{
+		resp: &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(minimalOccupancyHTML("SLB", 3, 30))),
+		},
+	}
+	rope := NewSourceClient(&Config{}, Source{Name: "rope", PGK: "p", FID: "f"})
+	rope.client = &MockClient{err: errors.New("network down")}
+
+	stBLDR, stROPE := newStubStorer(t), newStubStorer(t)
+	storers := map[string]Storer{"BLDR-SLB": stBLDR, "ROPE-SLB": stROPE}
+	jh := NewJobHandler(t.TempDir(), []OccupancyProvider{bldr, rope}, storers)
+
+	if err := jh.Execute(context.Background()); err == nil {
+		t.Error("expected an error for the failing source")
+	}
+	if len(stBLDR.stored) != 1 || stBLDR.stored[0].Count != 3 {
+		t.Errorf("BLDR-SLB: expected the counter to be stored, got %v", stBLDR.stored)
+	}
+	if len(stROPE.stored) != 0 {
+		t.Errorf("ROPE-SLB: expected nothing stored for the failing source, got %v", stROPE.stored)
+	}
+}
+
 func TestJobHandler_Execute_StoreError(t *testing.T) {
 	page := minimalOccupancyHTML("TST", 3, 30)
 	cfg := &Config{PGK: "pgk", FID: "fid"}
@@ -155,12 +191,70 @@ func TestJobHandler_Execute_StoreError(t *testing.T) {
 		},
 	}
 	storers := map[string]Storer{"TST": &errStorer{}}
-	jh := NewJobHandler(t.TempDir(), c, storers)
+	jh := NewJobHandler(t.TempDir(), []OccupancyProvider{c}, storers)
 	if err := jh.Execute(context.Background()); err == nil {
 		t.Fatal("expected error when storage fails")
 	}
 }
 
+func TestJobHandler_Execute_Alerts(t *testing.T) {
+	page := minimalOccupancyHTML("TST", 3, 30)
+	cfg := &Config{PGK: "pgk", FID: "fid", Gyms: map[string]GymConfig{"TST": {Name: "Test Gym"}}}
+	c := NewClient(cfg)
+	c.client = &MockClient{
+		resp: &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(page)),
+		},
+	}
+
+	alerts, err := NewAlerts(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := alerts.Add(Alert{ChatID: 7, Gym: "TST", Below: true, Threshold: 10, Armed: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	n := &stubNotifier{}
+	jh := NewJobHandler(t.TempDir(), []OccupancyProvider{c}, map[string]Storer{"TST": newStubStorer(t)})
+	jh.SetAlerts(alerts, n)
+	if err := jh.Execute(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(n.sent) != 1 || n.sent[0].ChatID != int64(7) {
+		t.Fatalf("expected one alert to chat 7, got %v", n.sent)
+	}
+	if want := "Test Gym (TST) dropped below 10: 3 of 30 on the wall now."; n.sent[0].Text != want {
+		t.Errorf("expected %q, got %q", want, n.sent[0].Text)
+	}
+}
+
+func TestJobHandler_ForGym_AlertsSetLater(t *testing.T) {
+	p := &stubProvider{counters: Counters{"TST": {Count: 3, Capacity: 30, LastUpdate: LastUpdate{Time: time.Now()}}}}
+	jh := NewJobHandler(t.TempDir(), []OccupancyProvider{p}, map[string]Storer{"TST": newStubStorer(t)})
+	// Jobs are made before the handler is fully set up
+	fj := jh.ForGym("TST")
+
+	alerts, err := NewAlerts(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := alerts.Add(Alert{ChatID: 7, Gym: "TST", Below: true, Threshold: 10, Armed: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	n := &stubNotifier{}
+	jh.SetAlerts(alerts, n)
+
+	if err := fj.Execute(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(n.sent) != 1 {
+		t.Errorf("expected the per-gym job to send the alert, got %v", n.sent)
+	}
+}
+
 func newBotHandler(t *testing.T) *BotHandler {
 	t.Helper()
 	st := newStubStorer(t)
@@ -294,6 +388,216 @@ func TestBotHandler_GymButtonHandler_NilCallbackQuery(t *testing.T) {
 	bh.GymButtonHandler(context.Background(), &bot.Bot{}, &models.Update{})
 }
 
+func TestBotHandler_SessionButtonHandler_NilCallbackQuery(t *testing.T) {
+	bh := newBotHandler(t)
+	bh.SessionButtonHandler(context.Background(), &bot.Bot{}, &models.Update{})
+}
+
+func TestBotHandler_StatsHandler_NilMessage(t *testing.T) {
+	bh := newBotHandler(t)
+	bh.StatsHandler(context.Background(), &bot.Bot{}, &models.Update{})
+}
+
+func TestBotHandler_HistoryHandler_NilMessage(t *testing.T) {
+	bh := newBotHandler(t)
+	bh.HistoryHandler(context.Background(), &bot.Bot{}, &models.Update{})
+}
+
+func TestBotHandler_HistoryHandler_WithArgs(t *testing.T) {
+	st := newStubStorer(t)
+	st.stored = []Counter{
+		{Count: 12, Capacity: 50, LastUpdate: LastUpdate{Time: time.Now().Add(-time.Hour)}},
+	}
+	bh := NewBotHandler("TST", map[string]Storer{"TST": newStubStorer(t), "SLB": st})
+	//nolint:errcheck
+	defer func() { recover() }()
+	bh.HistoryHandler(context.Background(), &bot.Bot{}, &models.Update{
+		Message: &models.Message{
+			Chat: models.Chat{ID: 1},
+			Text: "/history slb 3h",
+		},
+	})
+}
+
+func TestBotHandler_ChartHandler_NilMessage(t *testing.T) {
+	bh := newBotHandler(t)
+	bh.ChartHandler(context.Background(), &bot.Bot{}, &models.Update{})
+}
+
+func TestBotHandler_Photo(t *testing.T) {
+	bh := newBotHandler(t)
+	params := bh.Photo(nil, 42, []byte("png"), "caption")
+	if params.ChatID != int64(42) || params.Caption != "caption" {
+		t.Errorf("unexpected params %v", params)
+	}
+	if _, ok := params.Photo.(*models.InputFileUpload); !ok {
+		t.Errorf("expected an uploaded photo, got %T", params.Photo)
+	}
+}
+
+func TestBotHandler_BestHandler_NilMessage(t *testing.T) {
+	bh := newBotHandler(t)
+	bh.BestHandler(context.Background(), &bot.Bot{}, &models.Update{})
+}
+
+func TestBotHandler_GymArgs(t *testing.T) {
+	bh := NewBotHandler("TST", map[string]Storer{"TST": newStubStorer(t), "SLB": newStubStorer(t)})
+	cases := []struct {
+		text string
+		gym  string
+		arg  string
+	}{
+		{"/best", "TST", ""},
+		{"/best slb", "SLB", ""},
+		{"/best tue", "TST", "tue"},
+		{"/best SLB tue", "SLB", "tue"},
+		{"/best tue slb", "SLB", "tue"},
+		{"", "TST", ""},
+	}
+	for _, tc := range cases {
+		gym, arg := bh.gymArgs(1, tc.text)
+		if gym != tc.gym || arg != tc.arg {
+			t.Errorf("%q: expected %q %q, got %q %q", tc.text, tc.gym, tc.arg, gym, arg)
+		}
+	}
+}
+
+func TestBotHandler_ForecastHandler_NilMessage(t *testing.T) {
+	bh := newBotHandler(t)
+	bh.ForecastHandler(context.Background(), &bot.Bot{}, &models.Update{})
+}
+
+func TestBotHandler_AlertHandler_NilMessage(t *testing.T) {
+	bh := newBotHandler(t)
+	bh.AlertHandler(context.Background(), &bot.Bot{}, &models.Update{})
+}
+
+func TestBotHandler_ChatGym(t *testing.T) {
+	bh := NewBotHandler("TST", map[string]Storer{"TST": newStubStorer(t), "SLB": newStubStorer(t)})
+	if got := bh.chatGym(1); got != "TST" {
+		t.Errorf("expected the default gym without preferences, got %q", got)
+	}
+
+	prefs, err := NewPreferences(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	bh.SetPreferences(prefs)
+	if err := prefs.SetGym(1, "SLB"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := prefs.SetGym(2, "GONE"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := bh.chatGym(1); got != "SLB" {
+		t.Errorf("expected the chat's gym SLB, got %q", got)
+	}
+	if got := bh.chatGym(2); got != "TST" {
+		t.Errorf("expected the default gym for an unknown preferred gym, got %q", got)
+	}
+	if gym, _ := bh.gymArgs(1, "/count tst"); gym != "TST" {
+		t.Errorf("expected an explicit gym to win over the chat's gym, got %q", gym)
+	}
+}
+
+func TestBotHandler_Now(t *testing.T) {
+	bh := newBotHandler(t)
+	prefs, err := NewPreferences(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	bh.SetPreferences(prefs)
+	if err := prefs.SetTimezone(1, "Asia/Tokyo"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if loc := bh.now(1).Location().String(); loc != "Asia/Tokyo" {
+		t.Errorf("expected Asia/Tokyo, got %q", loc)
+	}
+	if loc := bh.now(2).Location(); loc != time.Local {
+		t.Errorf("expected local time without preferences, got %q", loc)
+	}
+}
+
+func TestBotHandler_SetGymHandler_NilMessage(t *testing.T) {
+	bh := newBotHandler(t)
+	bh.SetGymHandler(context.Background(), &bot.Bot{}, &models.Update{})
+	bh.SetTimezoneHandler(context.Background(), &bot.Bot{}, &models.Update{})
+	bh.SetLanguageHandler(context.Background(), &bot.Bot{}, &models.Update{})
+}
+
+func TestParseGymCallbackData(t *testing.T) {
+	cases := []struct {
+		data   string
+		action string
+		gym    string
+	}{
+		{gymCallbackData("in", "SLB"), "in", "SLB"},
+		{gymCallbackData("out", "ACME-TST"), "out", "ACME-TST"},
+		// buttons sent before gyms could be picked
+		{"gym_in", "in", ""},
+		{"gym_out", "out", ""},
+	}
+	for _, tc := range cases {
+		action, gym := parseGymCallbackData(tc.data)
+		if action != tc.action || gym != tc.gym {
+			t.Errorf("%q: expected %q %q, got %q %q", tc.data, tc.action, tc.gym, action, gym)
+		}
+	}
+}
+
+func TestBotHandler_GymKeyboard(t *testing.T) {
+	bh := NewBotHandler("TST", map[string]Storer{
+		"ABC": newStubStorer(t),
+		"TST": newStubStorer(t),
+		"XYZ": newStubStorer(t),
+	})
+
+	var got []string
+	for _, row := range bh.gymKeyboard(1).InlineKeyboard {
+		for _, button := range row {
+			got = append(got, button.CallbackData)
+		}
+	}
+	want := []string{"gym_in_TST", "gym_out_TST", "gym_in_ABC", "gym_out_ABC", "gym_in_XYZ", "gym_out_XYZ"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("expected buttons %v, got %v", want, got)
+	}
+}
+
+func TestBotHandler_GymState(t *testing.T) {
+	stTST := newStubStorer(t)
+	stSLB := newStubStorer(t)
+	for _, st := range []*stubStorer{stTST, stSLB} {
+		if err := st.NewGym(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	bh := NewBotHandler("TST", map[string]Storer{"TST": stTST, "SLB": stSLB})
+
+	if got, want := bh.gymState(alice.ChatID), "Going into the gym? Nobody is climbing right now."; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	if err := stTST.GetGym().In(alice); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := stTST.GetGym().In(bob); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Checked in from another chat
+	if err := stSLB.GetGym().In(Climber{ID: 3, Username: "carol", ChatID: 200}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := bh.gymState(alice.ChatID)
+	if !strings.HasPrefix(got, "Going into the gym? Climbing right now:\nTST: @alice since ") ||
+		!strings.Contains(got, ", @bob since ") || strings.Contains(got, "carol") {
+		t.Errorf("unexpected state %q", got)
+	}
+}
+
 // multiGymOccupancyHTML builds a minimal rockgympro HTML page containing
 // multiple gym entries, used by multi-gym Execute tests.
 func multiGymOccupancyHTML(gyms map[string][2]int) string {
@@ -312,3 +616,232 @@ func multiGymOccupancyHTML(gyms map[string][2]int) string {
 }
 
 func itoa(n int) string { return strconv.Itoa(n) }
+
+func TestBotHandler_GymKeysUseNames(t *testing.T) {
+	bkb := newStubStorer(t)
+	bkb.stored = []Counter{{Count: 1, Name: "Brooklyn Boulders"}}
+	sbl := newStubStorer(t)
+	bh := NewBotHandler("BKB", map[string]Storer{"BKB": bkb, "SBL": sbl})
+
+	if got, want := bh.gymKeys(), "Brooklyn Boulders (BKB), SBL"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+// stubProvider returns a copy of its counters on every call, after failing
+// the first fails calls.
+type stubProvider struct {
+	name     string
+	counters Counters
+	fails    int
+}
+
+func (p *stubProvider) Counters(context.Context) (*Counters, error) {
+	if p.fails > 0 {
+		p.fails--
+		return nil, errors.New("portal unreachable")
+	}
+	counters := maps.Clone(p.counters)
+	return &counters, nil
+}
+func (p *stubProvider) Name() string { return p.name }
+
+func TestJobHandler_Execute_DiscoversGyms(t *testing.T) {
+	now := LastUpdate{Time: time.Now()}
+	p := &stubProvider{counters: Counters{"TST": {Count: 1, LastUpdate: now}}}
+	stTST := newStubStorer(t)
+	jh := NewJobHandler(t.TempDir(), []OccupancyProvider{p}, map[string]Storer{"TST": stTST})
+
+	created := make(map[string]*stubStorer)
+	jh.newStorer = func(gymKey string) (Storer, error) {
+		st := newStubStorer(t)
+		created[gymKey] = st
+		return st, nil
+	}
+	bh := NewBotHandler("TST", map[string]Storer{"TST": stTST})
+	jh.OnNewGym(bh.AddGym)
+
+	p.counters["NEW"] = Counter{Count: 7, LastUpdate: now}
+	if err := jh.Execute(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	st, ok := created["NEW"]
+	if !ok || len(st.stored) != 1 || st.stored[0].Count != 7 {
+		t.Fatalf("expected storage for NEW with its counter, got %v", created)
+	}
+	if _, storers := jh.gyms(); storers["NEW"] != st {
+		t.Error("expected the job to keep fetching NEW")
+	}
+	if bh.gyms()["NEW"] != st {
+		t.Error("expected NEW to be registered with the bot handler")
+	}
+
+	// Known from then on
+	if err := jh.Execute(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(created) != 1 || len(st.stored) != 2 {
+		t.Errorf("expected NEW to be created once, got %d storages and %d counters", len(created), len(st.stored))
+	}
+}
+
+func TestJobHandler_SetGyms_KeepsDiscovered(t *testing.T) {
+	now := LastUpdate{Time: time.Now()}
+	p := &stubProvider{counters: Counters{"TST": {Count: 1, LastUpdate: now}, "NEW": {Count: 7, LastUpdate: now}}}
+	stTST := newStubStorer(t)
+	jh := NewJobHandler(t.TempDir(), []OccupancyProvider{p}, map[string]Storer{"TST": stTST})
+	stNEW := newStubStorer(t)
+	jh.newStorer = func(gymKey string) (Storer, error) { return stNEW, nil }
+
+	// A reload that took its gyms before NEW was discovered
+	reloaded := map[string]Storer{"TST": stTST, "OTHER": newStubStorer(t)}
+	if err := jh.Execute(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := jh.SetGyms([]OccupancyProvider{p}, reloaded)
+
+	if got["NEW"] != stNEW || got["TST"] != stTST || got["OTHER"] != reloaded["OTHER"] {
+		t.Errorf("expected TST, OTHER and the discovered NEW, got %v", got)
+	}
+	if _, storers := jh.gyms(); len(storers) != 3 || storers["NEW"] != stNEW {
+		t.Errorf("expected the job to keep NEW, got %v", storers)
+	}
+}
+
+func TestJobHandler_Execute_InactiveGyms(t *testing.T) {
+	now := LastUpdate{Time: time.Now()}
+	p := &stubProvider{counters: Counters{"TST": {Count: 1, LastUpdate: now}}}
+	stTST, stOLD := newStubStorer(t), newStubStorer(t)
+	storers := map[string]Storer{"TST": stTST, "OLD": stOLD}
+	jh := NewJobHandler(t.TempDir(), []OccupancyProvider{p}, storers)
+	bh := NewBotHandler("TST", storers)
+	jh.OnGymActive(bh.SetGymActive)
+
+	jh.SetInactiveAfter(time.Hour)
+	if err := jh.Execute(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if bh.isInactive("OLD") {
+		t.Fatal("expected OLD to stay active until it's been missing for an hour")
+	}
+	if len(stOLD.stored) != 0 {
+		t.Errorf("expected nothing stored for the missing gym, got %v", stOLD.stored)
+	}
+
+	jh.SetInactiveAfter(time.Nanosecond)
+	jh.Execute(context.Background())
+	if !bh.isInactive("OLD") {
+		t.Fatal("expected OLD to be marked inactive")
+	}
+	if _, ok := bh.gyms()["OLD"]; !ok {
+		t.Error("expected OLD to be kept")
+	}
+	if got := bh.gymKeys(); got != "OLD (inactive), TST" {
+		t.Errorf("expected OLD to be listed as inactive, got %q", got)
+	}
+
+	p.counters["OLD"] = Counter{Count: 2, LastUpdate: now}
+	jh.Execute(context.Background())
+	if bh.isInactive("OLD") {
+		t.Error("expected OLD to be active again once it's back")
+	}
+}
+
+func TestJobHandler_Execute_Stale(t *testing.T) {
+	p := &stubProvider{counters: Counters{"TST": {Count: 1, LastUpdate: LastUpdate{Time: time.Now()}}}, fails: 1}
+	st := newStubStorer(t)
+	st.stored = []Counter{{Count: 5, Capacity: 50, LastUpdate: LastUpdate{Time: time.Now().Add(-time.Hour)}}}
+	jh := NewJobHandler(t.TempDir(), []OccupancyProvider{p}, map[string]Storer{"TST": st})
+	bh := NewBotHandler("TST", map[string]Storer{"TST": st})
+	bh.SetStaleness(jh.StaleSince)
+
+	if err := jh.Execute(context.Background()); err == nil {
+		t.Fatal("expected the fetch to fail")
+	}
+	if _, ok := jh.StaleSince("TST"); !ok {
+		t.Fatal("expected TST to be stale")
+	}
+	if msg := bh.countMessage(1, "TST", st); !strings.Contains(msg, "5 people") || !strings.Contains(msg, "stale") {
+		t.Errorf("expected the stored counter with a stale note, got %q", msg)
+	}
+
+	if err := jh.Execute(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := jh.StaleSince("TST"); ok {
+		t.Error("expected TST to be fresh again")
+	}
+	if msg := bh.countMessage(1, "TST", st); strings.Contains(msg, "stale") {
+		t.Errorf("expected no stale note, got %q", msg)
+	}
+}
+
+func TestBotHandler_CountMessage_NoData(t *testing.T) {
+	st := newStubStorer(t)
+	bh := NewBotHandler("TST", map[string]Storer{"TST": st})
+	if msg := bh.countMessage(1, "TST", st); msg != "" {
+		t.Errorf("expected no reply without data, got %q", msg)
+	}
+
+	jh := NewJobHandler(t.TempDir(), nil, map[string]Storer{"TST": st})
+	jh.MarkStale([]string{"TST"}, time.Now())
+	bh.SetStaleness(jh.StaleSince)
+	if msg := bh.countMessage(1, "TST", st); !strings.HasPrefix(msg, "No data for TST yet.") {
+		t.Errorf("expected a no data reply, got %q", msg)
+	}
+}
+
+func TestJobHandler_ExecuteUntilFetched(t *testing.T) {
+	p := &stubProvider{counters: Counters{"TST": {Count: 1, LastUpdate: LastUpdate{Time: time.Now()}}}, fails: 2}
+	// No gyms known yet, as on a first start during an outage
+	jh := NewJobHandler(t.TempDir(), []OccupancyProvider{p}, map[string]Storer{})
+	created := make(map[string]*stubStorer)
+	jh.newStorer = func(gymKey string) (Storer, error) {
+		st := newStubStorer(t)
+		created[gymKey] = st
+		return st, nil
+	}
+
+	jh.ExecuteUntilFetched(context.Background(), time.Millisecond, 2*time.Millisecond)
+
+	if p.fails != 0 {
+		t.Errorf("expected the failed fetches to be retried, %d left", p.fails)
+	}
+	if st, ok := created["TST"]; !ok || len(st.stored) != 1 {
+		t.Errorf("expected TST to be discovered and stored, got %v", created)
+	}
+}
+
+func TestJobHandler_ExecuteUntilFetched_Cancelled(t *testing.T) {
+	p := &stubProvider{fails: 1000}
+	jh := NewJobHandler(t.TempDir(), []OccupancyProvider{p}, map[string]Storer{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	jh.ExecuteUntilFetched(ctx, time.Hour, time.Hour)
+	if p.fails != 1000 {
+		t.Errorf("expected no attempt once cancelled, got %d", 1000-p.fails)
+	}
+}
+
+func TestJobHandler_Record(t *testing.T) {
+	stTST, stOLD := newStubStorer(t), newStubStorer(t)
+	jh := NewJobHandler(t.TempDir(), nil, map[string]Storer{"TST": stTST, "OLD": stOLD})
+
+	// One source answered, another one failed
+	counters := &Counters{"TST": {Count: 3, LastUpdate: LastUpdate{Time: time.Now()}}}
+	err := jh.Record(context.Background(), counters, errors.New("source OLD: portal unreachable"))
+	if err == nil {
+		t.Error("expected the fetch error back")
+	}
+	if len(stTST.stored) != 1 {
+		t.Errorf("expected the counter that came back to be stored, got %v", stTST.stored)
+	}
+	if _, ok := jh.StaleSince("OLD"); !ok {
+		t.Error("expected OLD to be stale")
+	}
+	if _, ok := jh.StaleSince("TST"); ok {
+		t.Error("expected TST to be fresh")
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-telegram/bot"
+)
+
+// StructureError is a page or response that doesn't look the way the
+// scraper expects, as opposed to one that couldn't be fetched at all.
+type StructureError struct {
+	Err error
+}
+
+func (e *StructureError) Error() string { return e.Err.Error() }
+
+func (e *StructureError) Unwrap() error { return e.Err }
+
+// Health watches what the providers return for signs that a page changed
+// under the scraper: pages without data, gyms disappearing or appearing,
+// capacities changing and update times that are stuck or can't be read. It
+// reports them to the admin chat, each problem at most once per throttle
+// period.
+type Health struct {
+	mu        sync.Mutex
+	adminChat int64
+	cfg       HealthConfig
+	notifier  Notifier
+	// gyms holds the gym keys last seen from each source.
+	gyms     map[string][]string
+	counters map[string]healthState
+	reported map[string]time.Time
+	now      func() time.Time
+}
+
+// healthState is what the health checks remember about a gym.
+type healthState struct {
+	capacity int
+	// since is when the current stretch of fetches without a gap started,
+	// and seen when the gym was last fetched.
+	since time.Time
+	seen  time.Time
+}
+
+func NewHealth(adminChat int64, cfg HealthConfig, notifier Notifier) *Health {
+	return &Health{
+		adminChat: adminChat,
+		cfg:       cfg,
+		notifier:  notifier,
+		gyms:      make(map[string][]string),
+		counters:  make(map[string]healthState),
+		reported:  make(map[string]time.Time),
+		now:       time.Now,
+	}
+}
+
+// SetConfig swaps the admin chat and the health check settings.
+func (h *Health) SetConfig(adminChat int64, cfg HealthConfig) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.adminChat = adminChat
+	h.cfg = cfg
+}
+
+// Watch returns the provider with the health checks run on what it returns.
+func (h *Health) Watch(p OccupancyProvider) OccupancyProvider {
+	return &watchedProvider{p, h}
+}
+
+type watchedProvider struct {
+	OccupancyProvider
+	health *Health
+}
+
+func (wp *watchedProvider) Counters(ctx context.Context) (*Counters, error) {
+	counters, err := wp.OccupancyProvider.Counters(ctx)
+	wp.health.Check(ctx, wp.Name(), counters, err)
+	return counters, err
+}
+
+// Check runs the health checks on what the named source returned.
+func (h *Health) Check(ctx context.Context, source string, counters *Counters, err error) {
+	h.mu.Lock()
+	problems := h.check(source, counters, err)
+	adminChat := h.adminChat
+	h.mu.Unlock()
+
+	logger := slog.Default().With("component", "health", "source", source)
+	for _, p := range problems {
+		logger.Warn("scraper problem", "problem", p.key, "msg", p.msg)
+		if adminChat == 0 || h.notifier == nil {
+			continue
+		}
+		_, err := h.notifier.SendMessage(ctx, &bot.SendMessageParams{ChatID: adminChat, Text: p.msg})
+		if err != nil {
+			logger.Error("failed to report problem", "chat_id", adminChat, "msg", err)
+		}
+	}
+}
+
+type healthProblem struct {
+	key string
+	msg string
+}
+
+// check returns the problems found that haven't been reported within the
+// throttle period, marking them as reported.
+func (h *Health) check(source string, counters *Counters, err error) []healthProblem {
+	now := h.now()
+	name := source
+	if name == "" {
+		name = "default"
+	}
+
+	var problems []healthProblem
+	report := func(key, format string, args ...any) {
+		if last, ok := h.reported[key]; ok && now.Sub(last) < h.cfg.Throttle {
+			return
+		}
+		h.reported[key] = now
+		problems = append(problems, healthProblem{key, fmt.Sprintf(format, args...)})
+	}
+
+	if err != nil {
+		var se *StructureError
+		if errors.As(err, &se) {
+			report(name+":structure", "The page of source %s has changed: %v", name, se.Err)
+		}
+		return problems
+	}
+	if counters == nil {
+		return problems
+	}
+
+	keys := slices.Sorted(maps.Keys(*counters))
+	if len(keys) == 0 {
+		report(name+":empty", "Source %s returned no gyms", name)
+		return problems
+	}
+	if prev, ok := h.gyms[name]; ok {
+		if gone := difference(prev, keys); len(gone) > 0 {
+			report(name+":gone:"+strings.Join(gone, ","), "Gyms gone from source %s: %s", name, strings.Join(gone, ", "))
+		}
+		if added := difference(keys, prev); len(added) > 0 {
+			report(name+":new:"+strings.Join(added, ","), "New gyms in source %s: %s", name, strings.Join(added, ", "))
+		}
+	}
+	h.gyms[name] = keys
+
+	for _, gym := range keys {
+		counter := (*counters)[gym]
+		prev, seen := h.counters[gym]
+		state := healthState{capacity: counter.Capacity, since: now, seen: now}
+		// Nothing is fetched while the gym is closed, so a gap in the
+		// fetches starts a new stretch
+		if seen && now.Sub(prev.seen) <= h.cfg.Stale {
+			state.since = prev.since
+		}
+
+		if seen && prev.capacity != counter.Capacity {
+			report(gym+":capacity", "Capacity of %s changed from %d to %d", gym, prev.capacity, counter.Capacity)
+		}
+
+		// The update time is only stuck if it's old after fetching all along
+		age := now.Sub(counter.LastUpdate.Time)
+		switch {
+		case counter.LastUpdate.Approx:
+			report(gym+":update", "Can't read the update time of %s: %q", gym, counter.LastUpdate.Raw)
+		case !counter.LastUpdate.IsZero() && age >= h.cfg.Stale && now.Sub(state.since) >= h.cfg.Stale:
+			report(gym+":stuck", "The counter of %s hasn't been updated since %s, %s ago",
+				gym, counter.LastUpdate.Time.Format("Jan 2 15:04"), age.Truncate(time.Minute))
+		}
+		h.counters[gym] = state
+	}
+	return problems
+}
+
+// difference returns the keys in a that are not in b, both sorted.
+func difference(a, b []string) []string {
+	var out []string
+	for _, k := range a {
+		if _, found := slices.BinarySearch(b, k); !found {
+			out = append(out, k)
+		}
+	}
+	return out
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestHealth(n Notifier) (*Health, *time.Time) {
+	now := time.Date(2024, time.May, 30, 10, 0, 0, 0, time.UTC)
+	h := NewHealth(42, HealthConfig{Stale: 3 * time.Hour, Throttle: time.Hour}, n)
+	h.now = func() time.Time { return now }
+	return h, &now
+}
+
+func sentTexts(n *stubNotifier) []string {
+	texts := make([]string, len(n.sent))
+	for i, p := range n.sent {
+		texts[i] = p.Text
+	}
+	return texts
+}
+
+func TestHealth_StructureErrors(t *testing.T) {
+	n := &stubNotifier{}
+	h, now := newTestHealth(n)
+
+	h.Check(context.Background(), "bldr", nil, &StructureError{ErrNoData})
+	if len(n.sent) != 1 || n.sent[0].ChatID != int64(42) || !strings.Contains(n.sent[0].Text, "no occupancy data") {
+		t.Fatalf("expected the missing data to be reported to the admin chat, got %v", sentTexts(n))
+	}
+
+	// Throttled for an hour
+	*now = now.Add(30 * time.Minute)
+	h.Check(context.Background(), "bldr", nil, &StructureError{ErrNoData})
+	if len(n.sent) != 1 {
+		t.Errorf("expected the problem not to be reported again yet, got %v", sentTexts(n))
+	}
+	*now = now.Add(31 * time.Minute)
+	h.Check(context.Background(), "bldr", nil, &StructureError{ErrNoData})
+	if len(n.sent) != 2 {
+		t.Errorf("expected the problem to be reported again after an hour, got %v", sentTexts(n))
+	}
+
+	// Network errors aren't about the page
+	h.Check(context.Background(), "rope", nil, errors.New("connection refused"))
+	if len(n.sent) != 2 {
+		t.Errorf("expected a network error not to be reported, got %v", sentTexts(n))
+	}
+}
+
+func TestHealth_GymsAndCapacity(t *testing.T) {
+	n := &stubNotifier{}
+	h, now := newTestHealth(n)
+	update := LastUpdate{Time: *now}
+
+	h.Check(context.Background(), "", &Counters{"SBG": {Capacity: 60, LastUpdate: update}, "SBL": {Capacity: 100, LastUpdate: update}}, nil)
+	if len(n.sent) != 0 {
+		t.Fatalf("expected nothing to report on the first fetch, got %v", sentTexts(n))
+	}
+
+	h.Check(context.Background(), "", &Counters{"SBG": {Capacity: 80, LastUpdate: update}, "NEW": {Capacity: 10, LastUpdate: update}}, nil)
+	want := []string{
+		"Gyms gone from source default: SBL",
+		"New gyms in source default: NEW",
+		"Capacity of SBG changed from 60 to 80",
+	}
+	if got := sentTexts(n); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestHealth_StuckUpdate(t *testing.T) {
+	n := &stubNotifier{}
+	h, now := newTestHealth(n)
+	update := LastUpdate{Time: *now}
+
+	// The first fetch of the day sees an old update from last night
+	h.Check(context.Background(), "", &Counters{"SBG": {LastUpdate: LastUpdate{Time: now.Add(-10 * time.Hour)}}}, nil)
+	if len(n.sent) != 0 {
+		t.Fatalf("expected an old update after a gap not to count, got %v", sentTexts(n))
+	}
+
+	for range 11 {
+		*now = now.Add(15 * time.Minute)
+		h.Check(context.Background(), "", &Counters{"SBG": {LastUpdate: update}}, nil)
+	}
+	if len(n.sent) != 0 {
+		t.Fatalf("expected no report before the update is 3h old, got %v", sentTexts(n))
+	}
+
+	*now = now.Add(15 * time.Minute)
+	h.Check(context.Background(), "", &Counters{"SBG": {LastUpdate: update}}, nil)
+	if len(n.sent) != 1 || !strings.Contains(n.sent[0].Text, "SBG hasn't been updated since May 30 10:00, 3h0m0s ago") {
+		t.Errorf("expected the stuck update to be reported, got %v", sentTexts(n))
+	}
+}
+
+func TestHealth_UnreadableUpdate(t *testing.T) {
+	n := &stubNotifier{}
+	h, now := newTestHealth(n)
+
+	h.Check(context.Background(), "", &Counters{"SBG": {LastUpdate: LastUpdate{Time: *now, Raw: "whenever", Approx: true}}}, nil)
+	if len(n.sent) != 1 || !strings.Contains(n.sent[0].Text, `update time of SBG: "whenever"`) {
+		t.Errorf("expected the unreadable update time to be reported, got %v", sentTexts(n))
+	}
+}
+
+func TestHealth_NoAdminChat(t *testing.T) {
+	n := &stubNotifier{}
+	h, _ := newTestHealth(n)
+	h.SetConfig(0, HealthConfig{Stale: time.Hour, Throttle: time.Hour})
+
+	h.Check(context.Background(), "", nil, &StructureError{ErrNoData})
+	if len(n.sent) != 0 {
+		t.Errorf("expected problems only to be logged without an admin chat, got %v", sentTexts(n))
+	}
+}
+
+func TestJobHandler_HealthWatchesProviders(t *testing.T) {
+	c := NewClient(&Config{})
+	c.client = &MockClient{resp: &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("<html><body>gone</body></html>"))}}
+
+	n := &stubNotifier{}
+	h, _ := newTestHealth(n)
+	jh := NewJobHandler(t.TempDir(), []OccupancyProvider{c}, map[string]Storer{"TST": newStubStorer(t)})
+	jh.SetHealth(h)
+
+	if err := jh.Execute(context.Background()); err == nil {
+		t.Fatal("expected the fetch to fail")
+	}
+	if len(n.sent) != 1 || !strings.Contains(n.sent[0].Text, "The page of source default has changed") {
+		t.Errorf("expected the changed page to be reported, got %v", sentTexts(n))
+	}
+}
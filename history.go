@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxHistoryHours caps the "Nh" period of /history.
+const maxHistoryHours = 48
+
+var sparks = []rune("▁▂▃▄▅▆▇█")
+
+// historyPeriod resolves a /history period argument into a time range.
+// It accepts "today" (the default), "yesterday" and "Nh" for the last N hours.
+func historyPeriod(arg string, now time.Time) (from, to time.Time, label string, err error) {
+	y, m, d := now.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+
+	switch arg = strings.ToLower(arg); arg {
+	case "", "today":
+		return midnight, now, "today", nil
+	case "yesterday":
+		return midnight.AddDate(0, 0, -1), midnight, "yesterday", nil
+	}
+
+	if hours, ok := strings.CutSuffix(arg, "h"); ok {
+		n, err := strconv.Atoi(hours)
+		if err == nil && n > 0 && n <= maxHistoryHours {
+			return now.Add(-time.Duration(n) * time.Hour), now, fmt.Sprintf("last %dh", n), nil
+		}
+	}
+
+	return from, to, "", fmt.Errorf("unknown period %q, use today, yesterday or 1h to %dh", arg, maxHistoryHours)
+}
+
+// renderHistory draws the counters as a sparkline timeline with the lowest
+// and highest counts and the trend over the last hour.
+func renderHistory(gym, label string, counters []Counter) string {
+	if len(counters) == 0 {
+		return fmt.Sprintf("No data for %s %s.", gym, label)
+	}
+
+	first, last := counters[0], counters[len(counters)-1]
+	span := last.LastUpdate.Sub(first.LastUpdate.Time)
+	bucket := time.Hour
+	switch {
+	case span <= 8*time.Hour:
+		bucket = 15 * time.Minute
+	case span <= 16*time.Hour:
+		bucket = 30 * time.Minute
+	}
+
+	buckets := int(span/bucket) + 1
+	sums := make([]int, buckets)
+	samples := make([]int, buckets)
+	scale := 0
+	low, high := first, first
+	for _, c := range counters {
+		i := int(c.LastUpdate.Sub(first.LastUpdate.Time) / bucket)
+		sums[i] += c.Count
+		samples[i]++
+		scale = max(scale, c.Capacity, c.Count)
+		if c.Count < low.Count {
+			low = c
+		}
+		if c.Count > high.Count {
+			high = c
+		}
+	}
+	scale = max(scale, 1)
+
+	var line strings.Builder
+	for i := range buckets {
+		if samples[i] == 0 {
+			line.WriteRune(' ')
+			continue
+		}
+		level := sums[i] * len(sparks) / (samples[i] * scale)
+		line.WriteRune(sparks[min(level, len(sparks)-1)])
+	}
+
+	// Compare against the latest sample at least an hour older than the last one
+	ref := first
+	for _, c := range counters {
+		if c.LastUpdate.After(last.LastUpdate.Add(-time.Hour)) {
+			break
+		}
+		ref = c
+	}
+	trend := "steady"
+	switch delta := last.Count - ref.Count; {
+	case delta > 0:
+		trend = fmt.Sprintf("filling up: +%d", delta)
+	case delta < 0:
+		trend = fmt.Sprintf("emptying out: %d", delta)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s, %s–%s\n", gym, label, first.LastUpdate.Format("15:04"), last.LastUpdate.Format("15:04"))
+	fmt.Fprintf(&b, "%s\n", line.String())
+	fmt.Fprintf(&b, "low %d at %s, high %d at %s\n", low.Count, low.LastUpdate.Format("15:04"), high.Count, high.LastUpdate.Format("15:04"))
+	fmt.Fprintf(&b, "last %d of %d, %s since %s", last.Count, last.Capacity, trend, ref.LastUpdate.Format("15:04"))
+	return b.String()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHistoryPeriod(t *testing.T) {
+	now := time.Date(2024, 5, 15, 18, 30, 0, 0, time.UTC)
+	midnight := time.Date(2024, 5, 15, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		arg   string
+		from  time.Time
+		to    time.Time
+		label string
+	}{
+		{"", midnight, now, "today"},
+		{"Today", midnight, now, "today"},
+		{"yesterday", midnight.AddDate(0, 0, -1), midnight, "yesterday"},
+		{"3h", now.Add(-3 * time.Hour), now, "last 3h"},
+	}
+	for _, tc := range cases {
+		from, to, label, err := historyPeriod(tc.arg, now)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.arg, err)
+			continue
+		}
+		if !from.Equal(tc.from) || !to.Equal(tc.to) || label != tc.label {
+			t.Errorf("%q: expected %v–%v %q, got %v–%v %q", tc.arg, tc.from, tc.to, tc.label, from, to, label)
+		}
+	}
+
+	for _, arg := range []string{"week", "0h", "49h", "h", "-1h"} {
+		if _, _, _, err := historyPeriod(arg, now); err == nil {
+			t.Errorf("%q: expected an error, got nil", arg)
+		}
+	}
+}
+
+func TestRenderHistory(t *testing.T) {
+	start := time.Date(2024, 5, 15, 17, 0, 0, 0, time.UTC)
+	var counters []Counter
+	for i, count := range []int{0, 10, 20, 30, 40, 50, 60, 70, 80} {
+		counters = append(counters, Counter{
+			Count:      count,
+			Capacity:   80,
+			LastUpdate: LastUpdate{Time: start.Add(time.Duration(i) * 15 * time.Minute)},
+		})
+	}
+
+	want := "TST today, 17:00–19:00\n" +
+		"▁▂▃▄▅▆▇██\n" +
+		"low 0 at 17:00, high 80 at 19:00\n" +
+		"last 80 of 80, filling up: +40 since 18:00"
+	if got := renderHistory("TST", "today", counters); got != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestRenderHistory_EmptyingOut(t *testing.T) {
+	start := time.Date(2024, 5, 15, 20, 0, 0, 0, time.UTC)
+	counters := []Counter{
+		{Count: 40, Capacity: 80, LastUpdate: LastUpdate{Time: start}},
+		{Count: 25, Capacity: 80, LastUpdate: LastUpdate{Time: start.Add(time.Hour)}},
+	}
+
+	want := "TST last 2h, 20:00–21:00\n" +
+		"▅   ▃\n" +
+		"low 25 at 21:00, high 40 at 20:00\n" +
+		"last 25 of 80, emptying out: -15 since 20:00"
+	if got := renderHistory("TST", "last 2h", counters); got != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, got)
+	}
+}
+
+func TestRenderHistory_NoData(t *testing.T) {
+	if got, want := renderHistory("TST", "yesterday", nil), "No data for TST yesterday."; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// jsSyntaxError is a failure to read a JavaScript literal, at Offset bytes into Src.
+type jsSyntaxError struct {
+	Msg    string
+	Offset int
+	Src    string
+}
+
+func (e *jsSyntaxError) Error() string {
+	line, col := position(e.Src, e.Offset)
+	return fmt.Sprintf("%s at line %d, column %d of the script", e.Msg, line, col)
+}
+
+// position turns a byte offset into src into a 1-based line and column.
+func position(src string, offset int) (line, col int) {
+	offset = min(max(offset, 0), len(src))
+	before := src[:offset]
+	line = strings.Count(before, "\n") + 1
+	col = utf8.RuneCountInString(before[strings.LastIndexByte(before, '\n')+1:]) + 1
+	return line, col
+}
+
+// jsToJSON converts the JavaScript literal at the start of src, an object as
+// a web page would write it, into JSON. It takes quoted and unquoted keys,
+// both quote styles, escapes, trailing commas and comments, and returns how
+// many bytes of src the literal took up.
+func jsToJSON(src string) (string, int, error) {
+	p := &jsParser{src: src}
+	p.skipSpace()
+	if err := p.value(); err != nil {
+		return "", p.pos, err
+	}
+	return p.out.String(), p.pos, nil
+}
+
+type jsParser struct {
+	src string
+	pos int
+	out bytes.Buffer
+}
+
+func (p *jsParser) errorf(format string, args ...any) error {
+	return &jsSyntaxError{Msg: fmt.Sprintf(format, args...), Offset: p.pos, Src: p.src}
+}
+
+func (p *jsParser) peek() byte {
+	if p.pos >= len(p.src) {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+// skipSpace skips whitespace and comments.
+func (p *jsParser) skipSpace() {
+	for p.pos < len(p.src) {
+		r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+		switch {
+		case unicode.IsSpace(r):
+			p.pos += size
+		case strings.HasPrefix(p.src[p.pos:], "//"):
+			end := strings.IndexByte(p.src[p.pos:], '\n')
+			if end < 0 {
+				p.pos = len(p.src)
+				return
+			}
+			p.pos += end + 1
+		case strings.HasPrefix(p.src[p.pos:], "/*"):
+			end := strings.Index(p.src[p.pos+2:], "*/")
+			if end < 0 {
+				p.pos = len(p.src)
+				return
+			}
+			p.pos += end + 4
+		default:
+			return
+		}
+	}
+}
+
+func (p *jsParser) value() error {
+	switch c := p.peek(); {
+	case c == '{':
+		return p.object()
+	case c == '[':
+		return p.array()
+	case c == '\'' || c == '"':
+		s, err := p.string()
+		if err != nil {
+			return err
+		}
+		p.writeString(s)
+		return nil
+	case c == '-' || c == '+' || c == '.' || isDigit(c):
+		return p.number()
+	case c == 0:
+		return p.errorf("unexpected end of script")
+	}
+
+	start := p.pos
+	switch word := p.identifier(); word {
+	case "true", "false", "null":
+		p.out.WriteString(word)
+	case "undefined":
+		p.out.WriteString("null")
+	default:
+		p.pos = start
+		return p.errorf("unexpected %q", p.nextRune())
+	}
+	return nil
+}
+
+func (p *jsParser) object() error {
+	p.pos++ // {
+	p.out.WriteByte('{')
+	first := true
+	for {
+		p.skipSpace()
+		if p.peek() == '}' {
+			p.pos++
+			p.out.WriteByte('}')
+			return nil
+		}
+
+		key, err := p.key()
+		if err != nil {
+			return err
+		}
+		if !first {
+			p.out.WriteByte(',')
+		}
+		first = false
+		p.writeString(key)
+
+		p.skipSpace()
+		if p.peek() != ':' {
+			return p.errorf("expected ':' after key %q", key)
+		}
+		p.pos++
+		p.out.WriteByte(':')
+
+		p.skipSpace()
+		if err := p.value(); err != nil {
+			return err
+		}
+
+		p.skipSpace()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case '}':
+		default:
+			return p.errorf("expected ',' or '}' in object")
+		}
+	}
+}
+
+func (p *jsParser) key() (string, error) {
+	switch c := p.peek(); {
+	case c == '\'' || c == '"':
+		return p.string()
+	case isDigit(c):
+		start := p.pos
+		for isDigit(p.peek()) {
+			p.pos++
+		}
+		return p.src[start:p.pos], nil
+	}
+	if key := p.identifier(); key != "" {
+		return key, nil
+	}
+	if p.peek() == 0 {
+		return "", p.errorf("unexpected end of script in object")
+	}
+	return "", p.errorf("unexpected %q in object", p.nextRune())
+}
+
+func (p *jsParser) array() error {
+	p.pos++ // [
+	p.out.WriteByte('[')
+	first := true
+	for {
+		p.skipSpace()
+		if p.peek() == ']' {
+			p.pos++
+			p.out.WriteByte(']')
+			return nil
+		}
+
+		if !first {
+			p.out.WriteByte(',')
+		}
+		first = false
+		if err := p.value(); err != nil {
+			return err
+		}
+
+		p.skipSpace()
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ']':
+		default:
+			return p.errorf("expected ',' or ']' in array")
+		}
+	}
+}
+
+// string reads a quoted string, resolving its escapes.
+func (p *jsParser) string() (string, error) {
+	start := p.pos
+	quote := p.src[p.pos]
+	p.pos++
+
+	var b strings.Builder
+	for {
+		if p.pos >= len(p.src) {
+			p.pos = start
+			return "", p.errorf("unterminated string")
+		}
+		c := p.src[p.pos]
+		switch {
+		case c == quote:
+			p.pos++
+			return b.String(), nil
+		case c == '\n':
+			p.pos = start
+			return "", p.errorf("unterminated string")
+		case c != '\\':
+			b.WriteByte(c)
+			p.pos++
+			continue
+		}
+
+		// An escape
+		p.pos++
+		if p.pos >= len(p.src) {
+			continue
+		}
+		esc := p.src[p.pos]
+		p.pos++
+		switch esc {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'v':
+			b.WriteByte('\v')
+		case '0':
+			b.WriteByte(0)
+		case '\n':
+			// A line continuation
+		case 'x', 'u':
+			n := 2
+			if esc == 'u' {
+				n = 4
+			}
+			if p.pos+n > len(p.src) {
+				return "", p.errorf("bad \\%c escape", esc)
+			}
+			code, err := strconv.ParseUint(p.src[p.pos:p.pos+n], 16, 32)
+			if err != nil {
+				return "", p.errorf("bad \\%c escape", esc)
+			}
+			p.pos += n
+			b.WriteRune(rune(code))
+		default:
+			// \', \", \\ and any other character stand for themselves
+			b.WriteByte(esc)
+		}
+	}
+}
+
+func (p *jsParser) number() error {
+	start := p.pos
+	for p.pos < len(p.src) && strings.IndexByte("+-.0123456789abcdefABCDEFxX", p.src[p.pos]) >= 0 {
+		p.pos++
+	}
+	token := strings.TrimPrefix(p.src[start:p.pos], "+")
+
+	if n, err := strconv.ParseInt(token, 0, 64); err == nil {
+		p.out.WriteString(strconv.FormatInt(n, 10))
+		return nil
+	}
+	f, err := strconv.ParseFloat(token, 64)
+	if err != nil {
+		p.pos = start
+		return p.errorf("bad number %q", p.src[start:start+len(token)])
+	}
+	p.out.WriteString(strconv.FormatFloat(f, 'f', -1, 64))
+	return nil
+}
+
+// identifier reads a JavaScript identifier, or nothing if there is none.
+func (p *jsParser) identifier() string {
+	start := p.pos
+	for p.pos < len(p.src) {
+		r, size := utf8.DecodeRuneInString(p.src[p.pos:])
+		if r != '_' && r != '$' && !unicode.IsLetter(r) && (p.pos == start || !unicode.IsDigit(r)) {
+			break
+		}
+		p.pos += size
+	}
+	return p.src[start:p.pos]
+}
+
+func (p *jsParser) nextRune() rune {
+	r, _ := utf8.DecodeRuneInString(p.src[p.pos:])
+	return r
+}
+
+// writeString writes s as a JSON string, leaving HTML characters as they are.
+func (p *jsParser) writeString(s string) {
+	enc := json.NewEncoder(&p.out)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	// Encode ends with a newline
+	p.out.Truncate(p.out.Len() - 1)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestJSToJSON(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "Quoted and unquoted keys",
+			input:    `{'a': 1, "b": 2, c: 3, $d_1: 4, 5: 6}`,
+			expected: `{"a":1,"b":2,"c":3,"$d_1":4,"5":6}`,
+		},
+		{
+			name:     "Trailing commas",
+			input:    `{a: [1, 2, ], b: {c: 1, }, }`,
+			expected: `{"a":[1,2],"b":{"c":1}}`,
+		},
+		{
+			name:     "Comments",
+			input:    "{ // the gym\n a: /* count */ 1 }",
+			expected: `{"a":1}`,
+		},
+		{
+			name:     "Spaces, apostrophes and semicolons in strings",
+			input:    `{name: "Brooklyn Boulders' Queensbridge; LIC", other: 'Rock \'n\' Roll'}`,
+			expected: `{"name":"Brooklyn Boulders' Queensbridge; LIC","other":"Rock 'n' Roll"}`,
+		},
+		{
+			name:     "Escapes",
+			input:    `{a: "tab\tnew\nline", b: '\x41é\\', c: "<b>&amp;</b>"}`,
+			expected: `{"a":"tab\tnew\nline","b":"Aé\\","c":"<b>&amp;</b>"}`,
+		},
+		{
+			name:     "Numbers and literals",
+			input:    `[-1, +2, 0x10, 1.5, .5, 1e3, true, false, null, undefined]`,
+			expected: `[-1,2,16,1.5,0.5,1000,true,false,null,null]`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, _, err := jsToJSON(tc.input)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result != tc.expected {
+				t.Errorf("expected %s but got %s", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestJSToJSON_Consumed(t *testing.T) {
+	src := "{a: 1};\nfunction f() {}"
+	_, n, err := jsToJSON(src)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if src[n:] != ";\nfunction f() {}" {
+		t.Errorf("expected to stop after the object, stopped at %q", src[n:])
+	}
+}
+
+func TestJSToJSON_Errors(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input string
+		msg   string
+	}{
+		{"Missing colon", "{\n  a 1\n}", "expected ':' after key \"a\" at line 2, column 5"},
+		{"Unterminated string", "{a: 'open\n}", "unterminated string at line 1, column 5"},
+		{"Unexpected end", "{a: [1, 2", "expected ',' or ']' in array at line 1, column 10"},
+		{"Function call", "{a: f()}", "unexpected 'f' at line 1, column 5"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := jsToJSON(tc.input)
+			if err == nil || !strings.Contains(err.Error(), tc.msg) {
+				t.Errorf("expected error containing %q, got %v", tc.msg, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JSONProvider reads the occupancy of a single gym from a JSON HTTP endpoint.
+type JSONProvider struct {
+	client HTTPClient
+	source Source
+}
+
+func NewJSONProvider(cfg *Config, src Source) *JSONProvider {
+	rt := NewClientRoundTripper(cfg.HTTP)
+	return &JSONProvider{NewRetryClient(&http.Client{Transport: rt}, cfg.HTTP, cfg.Retry, src.Name), src}
+}
+
+// Name returns the name of the provider's source.
+func (jp *JSONProvider) Name() string {
+	return jp.source.Name
+}
+
+func (jp *JSONProvider) Counters(ctx context.Context) (*Counters, error) {
+	logger := slog.Default().With("component", "json provider")
+	counters := NewCounters()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", jp.source.JSON.URL, nil)
+	if err != nil {
+		return counters, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", USER_AGENT)
+
+	resp, err := jp.client.Do(req)
+	if err != nil {
+		logger.Error("can't fetch endpoint", "msg", err)
+		return counters, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return counters, fmt.Errorf("failed to fetch URL: %s, status: %d", req.URL, resp.StatusCode)
+	}
+
+	var doc any
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		logger.Error("can't parse response", "msg", err)
+		return counters, &StructureError{err}
+	}
+
+	counter, err := jp.counter(doc)
+	if err != nil {
+		return counters, &StructureError{err}
+	}
+
+	*counters = Counters{jp.source.GymKey(jp.source.JSON.Gym): counter}
+	return counters, nil
+}
+
+// counter picks the gym's counter out of the decoded response. Without an
+// updated path the counter is taken to be current.
+func (jp *JSONProvider) counter(doc any) (Counter, error) {
+	var counter Counter
+	src := jp.source.JSON
+
+	count, err := jsonNumber(doc, src.Count)
+	if err != nil {
+		return counter, fmt.Errorf("count: %w", err)
+	}
+	counter.Count = int(count)
+
+	if src.Capacity != "" {
+		capacity, err := jsonNumber(doc, src.Capacity)
+		if err != nil {
+			return counter, fmt.Errorf("capacity: %w", err)
+		}
+		counter.Capacity = int(capacity)
+	}
+
+	if src.Name != "" {
+		val, err := jsonPath(doc, src.Name)
+		if err != nil {
+			return counter, fmt.Errorf("name: %w", err)
+		}
+		name, ok := val.(string)
+		if !ok {
+			return counter, fmt.Errorf("name: %q is not a string", src.Name)
+		}
+		counter.Name = name
+	}
+
+	counter.LastUpdate.Time = time.Now().Truncate(time.Minute)
+	if src.Updated != "" {
+		val, err := jsonPath(doc, src.Updated)
+		if err != nil {
+			return counter, fmt.Errorf("updated: %w", err)
+		}
+		if counter.LastUpdate.Time, err = jsonTime(val); err != nil {
+			return counter, fmt.Errorf("updated: %w", err)
+		}
+	}
+	return counter, nil
+}
+
+// jsonPath follows the dot-separated path through objects and arrays,
+// taking numeric parts as array indexes.
+func jsonPath(doc any, path string) (any, error) {
+	val := doc
+	for part := range strings.SplitSeq(path, ".") {
+		switch v := val.(type) {
+		case map[string]any:
+			next, ok := v[part]
+			if !ok {
+				return nil, fmt.Errorf("no %q in %q", part, path)
+			}
+			val = next
+		case []any:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, fmt.Errorf("no index %q in %q", part, path)
+			}
+			val = v[i]
+		default:
+			return nil, fmt.Errorf("can't look up %q in %q", part, path)
+		}
+	}
+	return val, nil
+}
+
+// jsonNumber returns the number at path, also when it comes as a string.
+func jsonNumber(doc any, path string) (float64, error) {
+	val, err := jsonPath(doc, path)
+	if err != nil {
+		return 0, err
+	}
+	switch v := val.(type) {
+	case float64:
+		return v, nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(v), 64)
+	}
+	return 0, fmt.Errorf("%q is not a number", path)
+}
+
+// jsonTime reads an RFC 3339 timestamp or Unix time in seconds or milliseconds.
+func jsonTime(val any) (time.Time, error) {
+	switch v := val.(type) {
+	case float64:
+		if v > 1e12 {
+			return time.UnixMilli(int64(v)), nil
+		}
+		return time.Unix(int64(v), 0), nil
+	case string:
+		return time.Parse(time.RFC3339, v)
+	}
+	return time.Time{}, fmt.Errorf("%v is not a time", val)
+}
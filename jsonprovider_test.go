@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestJSONProvider(src Source, body string, status int) *JSONProvider {
+	jp := NewJSONProvider(&Config{}, src)
+	jp.client = &MockClient{
+		resp: &http.Response{
+			StatusCode: status,
+			Body:       io.NopCloser(strings.NewReader(body)),
+		},
+	}
+	return jp
+}
+
+func TestJSONProvider_Counters(t *testing.T) {
+	src := Source{
+		Name: "bb",
+		JSON: &JSONSource{
+			URL:      "https://example.com/occupancy",
+			Gym:      "WIEN",
+			Count:    "data.locations.1.current",
+			Capacity: "data.locations.1.max",
+			Updated:  "data.updated",
+			Name:     "data.locations.1.title",
+		},
+	}
+	body := `{"data": {"updated": "2024-05-30T18:42:00Z", "locations": [
+		{"current": 1, "max": 10, "title": "Wien Nord"},
+		{"current": "42", "max": 120, "title": "Wien West"}
+	]}}`
+
+	counters, err := newTestJSONProvider(src, body, http.StatusOK).Counters(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, ok := (*counters)["BB-WIEN"]
+	if !ok {
+		t.Fatalf("expected a counter for BB-WIEN, got %v", *counters)
+	}
+	want := time.Date(2024, time.May, 30, 18, 42, 0, 0, time.UTC)
+	if got.Count != 42 || got.Capacity != 120 || !got.LastUpdate.Time.Equal(want) {
+		t.Errorf("expected 42 of 120 at %v, got %+v", want, got)
+	}
+	if got.Name != "Wien West" {
+		t.Errorf("expected name Wien West, got %q", got.Name)
+	}
+}
+
+func TestJSONProvider_CountersUnixTimeAndNoCapacity(t *testing.T) {
+	src := Source{JSON: &JSONSource{URL: "https://example.com", Gym: "TST", Count: "count", Updated: "ts"}}
+
+	counters, err := newTestJSONProvider(src, `{"count": 7, "ts": 1717094520}`, http.StatusOK).Counters(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	got := counters.Counter("TST")
+	if got.Count != 7 || got.Capacity != 0 || !got.LastUpdate.Time.Equal(time.Unix(1717094520, 0)) {
+		t.Errorf("unexpected counter %+v", got)
+	}
+}
+
+func TestJSONProvider_CountersErrors(t *testing.T) {
+	src := Source{JSON: &JSONSource{URL: "https://example.com", Gym: "TST", Count: "data.count"}}
+	cases := []struct {
+		name   string
+		body   string
+		status int
+		want   string
+	}{
+		{"status", `{}`, http.StatusBadGateway, "status: 502"},
+		{"not json", `<html>`, http.StatusOK, "invalid character"},
+		{"missing key", `{"data": {}}`, http.StatusOK, `no "count"`},
+		{"not a number", `{"data": {"count": true}}`, http.StatusOK, "not a number"},
+	}
+	for _, tc := range cases {
+		_, err := newTestJSONProvider(src, tc.body, tc.status).Counters(context.Background())
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: expected error mentioning %q, got %v", tc.name, tc.want, err)
+		}
+	}
+}
+
+func TestNewProviders(t *testing.T) {
+	cfg := &Config{Sources: []Source{
+		{Name: "rgp", PGK: "p", FID: "f"},
+		{Name: "bb", JSON: &JSONSource{URL: "https://example.com", Gym: "WIEN", Count: "count"}},
+	}}
+
+	providers := NewProviders(cfg)
+	if len(providers) != 2 {
+		t.Fatalf("expected 2 providers, got %d", len(providers))
+	}
+	if _, ok := providers[0].(*Client); !ok {
+		t.Errorf("expected a rockgympro client first, got %T", providers[0])
+	}
+	if _, ok := providers[1].(*JSONProvider); !ok {
+		t.Errorf("expected a JSON provider second, got %T", providers[1])
+	}
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"log/slog"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/go-telegram/bot"
@@ -15,49 +18,140 @@ import (
 	"github.com/reugn/go-quartz/quartz"
 )
 
+// startupRetryMin and startupRetryMax bound the wait between the retries of
+// a scrape that failed on startup.
+const (
+	startupRetryMin = 30 * time.Second
+	startupRetryMax = 10 * time.Minute
+)
+
 func main() {
+	configPath := flag.String("config", os.Getenv("CONFIG"), "path to the YAML config file")
+	flag.Parse()
+
 	SetLogger()
 
-	cfg, err := NewConfig()
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	if flag.Arg(0) == "check-config" {
+		if err := checkConfig(ctx, *configPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("config OK")
+		return
+	}
+
+	if flag.Arg(0) == "replay" {
+		replayFlags := flag.NewFlagSet("replay", flag.ExitOnError)
+		source := replayFlags.String("source", "", "replay only the pages of this source")
+		store := replayFlags.Bool("store", false, "backfill the counters read into the storage")
+		replayFlags.Parse(flag.Args()[1:])
+
+		cfg, err := LoadConfig(*configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := replay(cfg, *source, *store, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	cfg, err := LoadConfig(*configPath)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	// Fetch counters once to discover all available gym keys.
-	client := NewClient(cfg)
-	counters, err := client.Counters()
-	if err != nil {
-		log.Fatal(err)
+	providers := NewProviders(cfg)
+	counters, failedSources, fetchErr := fetchSources(ctx, providers)
+	failed := fetchErr != nil || len(*counters) == 0
+	if failed {
+		slog.Error("can't scrape all the gyms on startup, falling back to the stored ones",
+			"component", "main", "msg", fetchErr)
+	}
+
+	// The gym keys are checked against the sources that answered
+	validateWith := counters
+	if len(*counters) == 0 {
+		validateWith = nil
+	}
+	if err := cfg.Validate(validateWith, failedSources...); err != nil {
+		log.Fatalf("invalid config:\n%v", err)
+	}
+
+	if cfg.MetricsAddr != "" {
+		go ServeMetrics(cfg.MetricsAddr)
 	}
 
 	// Build one Storage (and Gym) per gym found in the scraped counters.
 	storers := make(map[string]Storer)
 	for gymKey := range *counters {
-		st, err := NewStorage(cfg.Storage, gymKey)
+		st, err := newGymStorage(cfg.Storage, gymKey)
 		if err != nil {
-			log.Fatalf("create storage for gym %q: %v", gymKey, err)
-		}
-		if err := st.NewGym(); err != nil {
-			log.Fatalf("init gym for %q: %v", gymKey, err)
+			log.Fatal(err)
 		}
 		storers[gymKey] = st
 	}
 
+	// So that the bot works through a portal outage, add the gyms stored
+	// before that the scrape failed to bring. They are stale until it succeeds.
+	var stale []string
+	if failed {
+		stored, err := storedGyms(cfg.Storage)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, gymKey := range stored {
+			if _, ok := storers[gymKey]; ok {
+				continue
+			}
+			st, err := newGymStorage(cfg.Storage, gymKey)
+			if err != nil {
+				log.Fatal(err)
+			}
+			storers[gymKey] = st
+			stale = append(stale, gymKey)
+		}
+	}
+
 	if len(storers) == 0 {
-		log.Fatal("no gyms found in scraped data")
+		slog.Warn("no gyms scraped or stored, waiting for the first scrape", "component", "main")
 	}
 
-	jh := NewJobHandler(cfg.Storage, client, storers)
+	jh := NewJobHandler(cfg.Storage, providers, storers)
 	bh := NewBotHandler(cfg.Gym, storers)
+	jh.MarkStale(stale, time.Now())
+	bh.SetStaleness(jh.StaleSince)
 
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
-	defer cancel()
+	// Store the freshly-fetched counters for all gyms immediately. What
+	// failed is retried once the bot is up.
+	if len(*counters) > 0 {
+		if err := jh.Record(ctx, counters, fetchErr); err != nil {
+			slog.Error("can't store the first counters", "component", "main", "msg", err)
+		}
+	}
 
-	// Store the freshly-fetched counters for all gyms immediately.
-	if err := jh.Execute(ctx); err != nil {
+	opts := []bot.Option{
+		bot.WithDefaultHandler(func(ctx context.Context, b *bot.Bot, update *models.Update) {}),
+		bot.WithDebugHandler(func(format string, args ...any) {
+			slog.Debug(fmt.Sprintf(format, args), "component", "telegram bot")
+		}),
+		bot.WithErrorsHandler(func(err error) {
+			slog.Error("telegram error", "msg", err, "component", "telegram bot")
+		}),
+	}
+
+	b, err := bot.New(cfg.BotToken, opts...)
+	if nil != err {
 		log.Fatal(err)
 	}
 
+	jh.SetHealth(NewHealth(cfg.AdminChat, cfg.Health, b))
+
 	loc := time.Now().Location()
 	sched, err := quartz.NewStdScheduler(quartz.WithLogger(logger.NoOpLogger{}))
 	if err != nil {
@@ -65,38 +159,103 @@ func main() {
 	}
 	sched.Start(ctx)
 
-	for key, crontab := range cfg.Schedule {
-		slog.Info("schedule job", "job_key", key, "crontab", crontab, "loc", loc)
-		cronTrigger, _ := quartz.NewCronTriggerWithLoc(crontab, loc)
-		err := sched.ScheduleJob(quartz.NewJobDetail(jh, quartz.NewJobKey(key)), cronTrigger)
-		if err != nil {
-			log.Fatal(err)
-		}
+	alerts, err := NewAlerts(cfg.Storage)
+	if err != nil {
+		log.Fatal(err)
 	}
+	jh.SetAlerts(alerts, b)
+	alerts.SetDefaults(cfg.Alerts)
+	bh.SetAlerts(alerts)
 
-	defer func() {
-		sched.Stop()
-		sched.Wait(ctx)
-	}()
+	prefs, err := NewPreferences(cfg.Storage)
+	if err != nil {
+		log.Fatal(err)
+	}
+	bh.SetPreferences(prefs)
 
-	opts := []bot.Option{
-		bot.WithDefaultHandler(func(ctx context.Context, b *bot.Bot, update *models.Update) {}),
-		bot.WithDebugHandler(func(format string, args ...any) {
-			slog.Debug(fmt.Sprintf(format, args), "component", "telegram bot")
-		}),
-		bot.WithErrorsHandler(func(err error) {
-			slog.Error("telegram error", "msg", err, "component", "telegram bot")
-		}),
+	cj := NewCheckoutJob(cfg, storers, b)
+
+	// Gyms that show up on a page later on are added as the fetch job finds them
+	jh.SetInactiveAfter(cfg.InactiveAfter)
+	jh.OnNewGym(bh.AddGym)
+	jh.OnNewGym(cj.AddGym)
+	jh.OnGymActive(bh.SetGymActive)
+	if failed {
+		go jh.ExecuteUntilFetched(ctx, startupRetryMin, startupRetryMax)
+	}
+	slog.Info("schedule job", "job_key", "checkout", "crontab", CHECKOUT_SCHEDULE, "loc", loc)
+	checkoutTrigger, err := quartz.NewCronTriggerWithLoc(CHECKOUT_SCHEDULE, loc)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := sched.ScheduleJob(quartz.NewJobDetail(cj, quartz.NewJobKey("checkout")), checkoutTrigger); err != nil {
+		log.Fatal(err)
 	}
 
-	b, err := bot.New(cfg.BotToken, opts...)
-	if nil != err {
+	reloader := NewReloader(*configPath, cfg, sched, loc, jh, bh, cj, alerts)
+	if err := reloader.Schedule(); err != nil {
 		log.Fatal(err)
 	}
 
+	// Reload the config on SIGHUP, keeping the running one if the new one is broken.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				slog.Info("reloading config", "component", "reloader")
+				if err := reloader.Reload(ctx); err != nil {
+					slog.Error("can't reload config", "component", "reloader", "msg", err)
+				}
+			}
+		}
+	}()
+
+	defer func() {
+		sched.Stop()
+		sched.Wait(ctx)
+	}()
+
 	b.RegisterHandler(bot.HandlerTypeMessageText, "/count", bot.MatchTypePrefix, bh.CountHandler)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/history", bot.MatchTypePrefix, bh.HistoryHandler)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/chart", bot.MatchTypePrefix, bh.ChartHandler)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/best", bot.MatchTypePrefix, bh.BestHandler)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/forecast", bot.MatchTypePrefix, bh.ForecastHandler)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/alert", bot.MatchTypePrefix, bh.AlertHandler)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/setgym", bot.MatchTypePrefix, bh.SetGymHandler)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/settz", bot.MatchTypePrefix, bh.SetTimezoneHandler)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/setlang", bot.MatchTypePrefix, bh.SetLanguageHandler)
 	b.RegisterHandler(bot.HandlerTypeMessageText, "/gym", bot.MatchTypeExact, bh.GymHandler)
+	b.RegisterHandler(bot.HandlerTypeMessageText, "/stats", bot.MatchTypeExact, bh.StatsHandler)
 	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, "gym", bot.MatchTypePrefix, bh.GymButtonHandler)
+	b.RegisterHandler(bot.HandlerTypeCallbackQueryData, "session_", bot.MatchTypePrefix, bh.SessionButtonHandler)
 
 	b.Start(ctx)
 }
+
+// checkConfig loads the config at path, scrapes the counters once and
+// validates the config against them, reporting a failed scrape along with the
+// other problems.
+func checkConfig(ctx context.Context, path string) error {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	counters, failedSources, fetchErr := fetchSources(ctx, NewProviders(cfg))
+	if fetchErr != nil {
+		errs = append(errs, fmt.Errorf("can't scrape the gyms: %w", fetchErr))
+	}
+	validateWith := counters
+	if len(*counters) == 0 {
+		validateWith = nil
+	}
+	if err := cfg.Validate(validateWith, failedSources...); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
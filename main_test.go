@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"io"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -14,3 +18,35 @@ func TestMain(m *testing.M) {
 	// Run the tests
 	os.Exit(m.Run())
 }
+
+func TestCheckConfig_ReportsScrapeFailureWithOtherProblems(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	path := writeConfigFile(t, `
+gym: TST
+bot_token: t
+storage: `+t.TempDir()+`
+schedule:
+  often: "every minute"
+sources:
+  - name: bb
+    json:
+      url: `+srv.URL+`
+      gym: TST
+      count: count
+retry:
+  attempts: 1
+`)
+	err := checkConfig(context.Background(), path)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{"can't scrape the gyms", "schedule.often"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in the report, got %v", want, err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"expvar"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// metrics are published with expvar under "scrape", e.g.
+// {"scrape": {"bldr": {"requests": 12, "retries": 2, "failures": 1, "breaker": "closed"}}}.
+// The unnamed source shows up as "default".
+var metrics = &scrapeMetrics{vars: expvar.NewMap("scrape")}
+
+type scrapeMetrics struct {
+	mu   sync.Mutex
+	vars *expvar.Map
+}
+
+// source returns the metrics of the source, creating them on first use.
+func (m *scrapeMetrics) source(name string) *expvar.Map {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if name == "" {
+		name = "default"
+	}
+	if v, ok := m.vars.Get(name).(*expvar.Map); ok {
+		return v
+	}
+	v := new(expvar.Map).Init()
+	m.vars.Set(name, v)
+	return v
+}
+
+// Add adds delta to the source's counter.
+func (m *scrapeMetrics) Add(name, key string, delta int64) {
+	m.source(name).Add(key, delta)
+}
+
+// SetBreaker records the state of the source's circuit breaker.
+func (m *scrapeMetrics) SetBreaker(name, state string) {
+	v := new(expvar.String)
+	v.Set(state)
+	m.source(name).Set("breaker", v)
+}
+
+// ServeMetrics serves the expvar metrics at /debug/vars on addr.
+func ServeMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	slog.Info("serving metrics", "component", "metrics", "addr", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("can't serve metrics", "component", "metrics", "msg", err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// PREFS_FILE is the SQLite file in the storage dir that keeps chat preferences.
+const PREFS_FILE = "prefs.sqlite"
+
+var reLanguage = regexp.MustCompile(`^[a-z]{2}$`)
+
+// Prefs are a chat's preferences. Empty fields fall back to the global defaults.
+type Prefs struct {
+	ChatID   int64
+	Gym      string
+	Timezone string
+	Language string
+}
+
+// Location returns the chat's timezone, or the local one when none is set.
+func (p Prefs) Location() *time.Location {
+	if p.Timezone == "" {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(p.Timezone)
+	if err != nil {
+		return time.Local
+	}
+	return loc
+}
+
+func (p Prefs) String() string {
+	value := func(v, fallback string) string {
+		if v == "" {
+			return fallback
+		}
+		return v
+	}
+	return fmt.Sprintf("gym: %s\ntimezone: %s\nlanguage: %s",
+		value(p.Gym, "default"), value(p.Timezone, "default"), value(p.Language, "default"))
+}
+
+// Preferences keeps the preferences of all chats.
+type Preferences struct {
+	db *sql.DB
+}
+
+// NewPreferences creates a new Preferences instance with its SQLite file inside storageDir.
+func NewPreferences(storageDir string) (*Preferences, error) {
+	if err := os.MkdirAll(storageDir, 0o755); err != nil {
+		return nil, fmt.Errorf("create storage dir %q: %w", storageDir, err)
+	}
+
+	db, err := sql.Open("sqlite", filepath.Join(storageDir, PREFS_FILE))
+	if err != nil {
+		return nil, err
+	}
+
+	createTableQuery := `
+    CREATE TABLE IF NOT EXISTS prefs (
+        chat_id INTEGER PRIMARY KEY,
+        gym TEXT NOT NULL DEFAULT '',
+        timezone TEXT NOT NULL DEFAULT '',
+        language TEXT NOT NULL DEFAULT ''
+    );`
+	if _, err = db.Exec(createTableQuery); err != nil {
+		return nil, err
+	}
+
+	return &Preferences{db: db}, nil
+}
+
+// Get returns the chat's preferences, empty if it has none.
+func (p *Preferences) Get(chatID int64) (Prefs, error) {
+	prefs := Prefs{ChatID: chatID}
+	err := p.db.QueryRow("SELECT gym, timezone, language FROM prefs WHERE chat_id = ?", chatID).
+		Scan(&prefs.Gym, &prefs.Timezone, &prefs.Language)
+	if err == sql.ErrNoRows {
+		return prefs, nil
+	}
+	return prefs, err
+}
+
+// SetGym stores the chat's preferred gym.
+func (p *Preferences) SetGym(chatID int64, gym string) error {
+	return p.set(chatID, "gym", gym)
+}
+
+// SetTimezone stores the chat's timezone, an IANA name such as "America/New_York".
+func (p *Preferences) SetTimezone(chatID int64, tz string) error {
+	if _, err := time.LoadLocation(tz); err != nil || tz == "" || tz == "Local" {
+		return fmt.Errorf("unknown timezone %q, use a name like America/New_York", tz)
+	}
+	return p.set(chatID, "timezone", tz)
+}
+
+// SetLanguage stores the chat's language as a two-letter code such as "en".
+func (p *Preferences) SetLanguage(chatID int64, lang string) error {
+	lang = strings.ToLower(lang)
+	if !reLanguage.MatchString(lang) {
+		return fmt.Errorf("unknown language %q, use a two-letter code like en", lang)
+	}
+	return p.set(chatID, "language", lang)
+}
+
+func (p *Preferences) set(chatID int64, column, value string) error {
+	query := fmt.Sprintf(`
+    INSERT INTO prefs (chat_id, %[1]s) VALUES (?, ?)
+    ON CONFLICT(chat_id) DO UPDATE SET %[1]s = excluded.%[1]s`, column)
+	_, err := p.db.Exec(query, chatID, value)
+	return err
+}
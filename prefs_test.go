@@ -0,0 +1,93 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewPreferences(t *testing.T) {
+	p, err := NewPreferences(filepath.Join(t.TempDir(), "storage"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p == nil {
+		t.Fatal("expected non-nil Preferences instance")
+	}
+}
+
+func TestPreferences_SetAndGet(t *testing.T) {
+	p, err := NewPreferences(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	prefs, err := p.Get(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if prefs != (Prefs{ChatID: 1}) {
+		t.Errorf("expected empty preferences, got %+v", prefs)
+	}
+
+	if err := p.SetGym(1, "TST"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := p.SetTimezone(1, "Europe/Berlin"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := p.SetLanguage(1, "DE"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Setting one preference keeps the others
+	if err := p.SetGym(1, "SLB"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	prefs, err = p.Get(1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := Prefs{ChatID: 1, Gym: "SLB", Timezone: "Europe/Berlin", Language: "de"}
+	if prefs != want {
+		t.Errorf("expected %+v, got %+v", want, prefs)
+	}
+
+	if other, _ := p.Get(2); other.Gym != "" {
+		t.Errorf("expected no preferences for another chat, got %+v", other)
+	}
+}
+
+func TestPreferences_Invalid(t *testing.T) {
+	p, err := NewPreferences(t.TempDir())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, tz := range []string{"Mars/Olympus", "Local", ""} {
+		if err := p.SetTimezone(1, tz); err == nil {
+			t.Errorf("expected an error for timezone %q, got nil", tz)
+		}
+	}
+	for _, lang := range []string{"english", "e", "1a"} {
+		if err := p.SetLanguage(1, lang); err == nil {
+			t.Errorf("expected an error for language %q, got nil", lang)
+		}
+	}
+}
+
+func TestPrefs_Location(t *testing.T) {
+	if loc := (Prefs{}).Location(); loc != time.Local {
+		t.Errorf("expected local time, got %v", loc)
+	}
+	if loc := (Prefs{Timezone: "Asia/Tokyo"}).Location(); loc.String() != "Asia/Tokyo" {
+		t.Errorf("expected Asia/Tokyo, got %v", loc)
+	}
+}
+
+func TestPrefs_String(t *testing.T) {
+	want := "gym: TST\ntimezone: default\nlanguage: en"
+	if got := (Prefs{Gym: "TST", Language: "en"}).String(); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
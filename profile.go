@@ -0,0 +1,49 @@
+package main
+
+import "time"
+
+// Profile holds the average count per weekday and time-of-day bucket,
+// i.e. how busy a gym typically is at a given time of the week.
+type Profile struct {
+	bucket time.Duration
+	sums   [7][]int
+	counts [7][]int
+}
+
+// NewProfile builds a Profile of the counters with buckets of the given size.
+// Times of day are taken in each counter's own location.
+func NewProfile(counters []Counter, bucket time.Duration) *Profile {
+	p := &Profile{bucket: bucket}
+	buckets := int((24*time.Hour + bucket - 1) / bucket)
+	for wd := range p.sums {
+		p.sums[wd] = make([]int, buckets)
+		p.counts[wd] = make([]int, buckets)
+	}
+
+	for _, c := range counters {
+		wd, i := p.index(c.LastUpdate.Time)
+		p.sums[wd][i] += c.Count
+		p.counts[wd][i]++
+	}
+	return p
+}
+
+// At returns the average count for t's weekday and time of day, and
+// whether there were any samples in that bucket.
+func (p *Profile) At(t time.Time) (float64, bool) {
+	wd, i := p.index(t)
+	if p.counts[wd][i] == 0 {
+		return 0, false
+	}
+	return float64(p.sums[wd][i]) / float64(p.counts[wd][i]), true
+}
+
+// Bucket returns the size of the profile's time-of-day buckets.
+func (p *Profile) Bucket() time.Duration {
+	return p.bucket
+}
+
+func (p *Profile) index(t time.Time) (time.Weekday, int) {
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	return t.Weekday(), int(sinceMidnight / p.bucket)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProfile(t *testing.T) {
+	// Two Wednesdays and a Thursday
+	wed1 := time.Date(2024, 5, 8, 18, 0, 0, 0, time.UTC)
+	wed2 := time.Date(2024, 5, 15, 18, 10, 0, 0, time.UTC)
+	thu := time.Date(2024, 5, 16, 18, 0, 0, 0, time.UTC)
+	counters := []Counter{
+		{Count: 40, LastUpdate: LastUpdate{Time: wed1}},
+		{Count: 60, LastUpdate: LastUpdate{Time: wed2}},
+		{Count: 10, LastUpdate: LastUpdate{Time: thu}},
+	}
+
+	p := NewProfile(counters, 15*time.Minute)
+	if p.Bucket() != 15*time.Minute {
+		t.Errorf("expected 15m buckets, got %v", p.Bucket())
+	}
+
+	nextWed := time.Date(2024, 5, 22, 18, 5, 0, 0, time.UTC)
+	if avg, ok := p.At(nextWed); !ok || avg != 50 {
+		t.Errorf("expected Wednesday 18:00 average of 50, got %v, %v", avg, ok)
+	}
+	if avg, ok := p.At(thu.Add(time.Minute)); !ok || avg != 10 {
+		t.Errorf("expected Thursday 18:00 average of 10, got %v, %v", avg, ok)
+	}
+	if _, ok := p.At(nextWed.Add(time.Hour)); ok {
+		t.Error("expected no samples for Wednesday 19:00")
+	}
+	if _, ok := p.At(time.Date(2024, 5, 22, 23, 59, 59, 0, time.UTC)); ok {
+		t.Error("expected no samples for Wednesday 23:59")
+	}
+}
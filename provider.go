@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+)
+
+// OccupancyProvider gets the current counters of one or more gyms, keyed by
+// gym key.
+type OccupancyProvider interface {
+	Counters(ctx context.Context) (*Counters, error)
+	// Name is the name of the source the provider was configured from.
+	Name() string
+}
+
+// NewProviders creates a provider for every source in the config.
+func NewProviders(cfg *Config) []OccupancyProvider {
+	providers := make([]OccupancyProvider, 0, len(cfg.Sources))
+	for _, src := range cfg.Sources {
+		if src.JSON != nil {
+			providers = append(providers, NewJSONProvider(cfg, src))
+			continue
+		}
+		providers = append(providers, NewSourceClient(cfg, src))
+	}
+	return providers
+}
+
+// keepBreakers hands the circuit breakers of the old providers to the new
+// ones fetching from the same URL, so that a config reload doesn't reset an
+// open breaker and hit a failing portal again.
+func keepBreakers(old, new []OccupancyProvider) {
+	breakers := make(map[string]*Breaker)
+	for _, p := range old {
+		if url, rc, ok := retryClient(p); ok {
+			breakers[url] = rc.breaker
+		}
+	}
+	for _, p := range new {
+		url, rc, ok := retryClient(p)
+		if !ok {
+			continue
+		}
+		if b, ok := breakers[url]; ok {
+			b.SetLimits(rc.retry.BreakerFailures, rc.retry.BreakerCooldown)
+			rc.breaker = b
+		}
+	}
+}
+
+// retryClient returns the URL the provider fetches from and its retry client.
+func retryClient(p OccupancyProvider) (string, *RetryClient, bool) {
+	var url string
+	var client HTTPClient
+	switch p := p.(type) {
+	case *Client:
+		url, client = p.url, p.client
+	case *JSONProvider:
+		url, client = p.source.JSON.URL, p.client
+	default:
+		return "", nil, false
+	}
+	rc, ok := client.(*RetryClient)
+	return url, rc, ok
+}
+
+// fetchCounters gets the counters from all providers. When some of them fail,
+// it returns the counters of the others along with the errors.
+func fetchCounters(ctx context.Context, providers []OccupancyProvider) (*Counters, error) {
+	counters, _, err := fetchSources(ctx, providers)
+	return counters, err
+}
+
+// fetchSources is fetchCounters that also returns the names of the sources
+// that failed.
+func fetchSources(ctx context.Context, providers []OccupancyProvider) (*Counters, []string, error) {
+	counters := NewCounters()
+	*counters = make(Counters)
+	var failed []string
+	var errs []error
+	for _, p := range providers {
+		pc, err := p.Counters(ctx)
+		if err != nil {
+			if p.Name() != "" {
+				err = fmt.Errorf("source %s: %w", p.Name(), err)
+			}
+			failed = append(failed, p.Name())
+			errs = append(errs, err)
+			continue
+		}
+		maps.Copy(*counters, *pc)
+	}
+	return counters, failed, errors.Join(errs...)
+}
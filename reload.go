@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/reugn/go-quartz/quartz"
+)
+
+// Reloader re-reads the config while the bot runs: it reschedules the fetch
+// jobs, adds storage for newly appearing gyms and swaps the new settings
+// into the handlers and jobs.
+type Reloader struct {
+	mu      sync.Mutex
+	path    string
+	cfg     *Config
+	sched   quartz.Scheduler
+	loc     *time.Location
+	jh      *JobHandler
+	bh      *BotHandler
+	cj      *CheckoutJob
+	alerts  *Alerts
+	jobKeys []*quartz.JobKey
+	// newProviders makes the providers for the reloaded config.
+	newProviders func(*Config) []OccupancyProvider
+}
+
+func NewReloader(path string, cfg *Config, sched quartz.Scheduler, loc *time.Location, jh *JobHandler, bh *BotHandler, cj *CheckoutJob, alerts *Alerts) *Reloader {
+	return &Reloader{
+		path:         path,
+		cfg:          cfg,
+		sched:        sched,
+		loc:          loc,
+		jh:           jh,
+		bh:           bh,
+		cj:           cj,
+		alerts:       alerts,
+		newProviders: NewProviders,
+	}
+}
+
+// Schedule schedules the fetch jobs of the current config.
+func (r *Reloader) Schedule() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keys, err := scheduleFetchJobs(r.sched, r.cfg, r.jh, r.loc)
+	r.jobKeys = keys
+	return err
+}
+
+// Reload loads the config again and applies it. A config that fails to load
+// or validate leaves the running one in place.
+func (r *Reloader) Reload(ctx context.Context) error {
+	logger := slog.Default().With("component", "reloader")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg, err := LoadConfig(r.path)
+	if err != nil {
+		return err
+	}
+
+	providers := r.newProviders(cfg)
+	running, _ := r.jh.gyms()
+	keepBreakers(running, providers)
+	counters, err := fetchCounters(ctx, providers)
+	if err != nil {
+		return fmt.Errorf("can't scrape the gyms: %w", err)
+	}
+	if err := cfg.Validate(counters); err != nil {
+		return fmt.Errorf("invalid config:\n%w", err)
+	}
+
+	if cfg.BotToken != r.cfg.BotToken {
+		logger.Warn("bot token changed, restart to apply")
+	}
+	if cfg.Storage != r.cfg.Storage {
+		logger.Warn("storage changed, new gyms go to the new storage and the others stay until restart",
+			"old", r.cfg.Storage, "new", cfg.Storage)
+	}
+
+	// Start from the job's gyms, which include the ones it discovered since
+	_, current := r.jh.gyms()
+	storers := maps.Clone(current)
+	for gymKey := range *counters {
+		if _, ok := storers[gymKey]; ok {
+			continue
+		}
+		st, err := newGymStorage(cfg.Storage, gymKey)
+		if err != nil {
+			return err
+		}
+		logger.Info("added gym", "gym", gymKey)
+		storers[gymKey] = st
+	}
+
+	storers = r.jh.SetGyms(providers, storers)
+	r.jh.SetInactiveAfter(cfg.InactiveAfter)
+	r.bh.SetGyms(cfg.Gym, storers)
+	r.cj.SetGyms(cfg, storers)
+	r.alerts.SetDefaults(cfg.Alerts)
+	if r.jh.health != nil {
+		r.jh.health.SetConfig(cfg.AdminChat, cfg.Health)
+	}
+	r.cfg = cfg
+
+	for _, key := range r.jobKeys {
+		if err := r.sched.DeleteJob(key); err != nil {
+			logger.Error("can't unschedule job", "job_key", key, "msg", err)
+		}
+	}
+	r.jobKeys, err = scheduleFetchJobs(r.sched, cfg, r.jh, r.loc)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("config reloaded", "gyms", len(storers), "jobs", len(r.jobKeys))
+	return nil
+}
+
+// scheduleFetchJobs schedules the jobs fetching counters on the config's
+// schedules and returns the keys of the ones scheduled. The keys are
+// namespaced, e.g. "fetch/often", "source/bldr/often" and "gym/SLB/often",
+// so that they can't clash with each other or with the "checkout" job.
+func scheduleFetchJobs(sched quartz.Scheduler, cfg *Config, jh *JobHandler, loc *time.Location) ([]*quartz.JobKey, error) {
+	var keys []*quartz.JobKey
+	schedule := func(job quartz.Job, key, crontab string) error {
+		slog.Info("schedule job", "job_key", key, "crontab", crontab, "loc", loc)
+		cronTrigger, err := quartz.NewCronTriggerWithLoc(crontab, loc)
+		if err != nil {
+			return fmt.Errorf("schedule job %q: %w", key, err)
+		}
+		jobKey := quartz.NewJobKey(key)
+		if err := sched.ScheduleJob(quartz.NewJobDetail(job, jobKey), cronTrigger); err != nil {
+			return fmt.Errorf("schedule job %q: %w", key, err)
+		}
+		keys = append(keys, jobKey)
+		return nil
+	}
+
+	for key, crontab := range cfg.Schedule {
+		if err := schedule(jh, "fetch/"+key, crontab); err != nil {
+			return keys, err
+		}
+	}
+	for _, src := range cfg.Sources {
+		for key, crontab := range src.Schedule {
+			job := quartz.Job(jh)
+			if src.Name != "" {
+				job = jh.ForSource(src.Name)
+			}
+			if err := schedule(job, "source/"+src.Name+"/"+key, crontab); err != nil {
+				return keys, err
+			}
+		}
+	}
+	for gymKey, gc := range cfg.Gyms {
+		for key, crontab := range gc.Schedule {
+			if err := schedule(jh.ForGym(gymKey), "gym/"+gymKey+"/"+key, crontab); err != nil {
+				return keys, err
+			}
+		}
+	}
+	return keys, nil
+}
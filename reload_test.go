@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/reugn/go-quartz/quartz"
+)
+
+// newTestReloader sets up a reloader for the config file at path whose
+// scrapes return the page.
+func newTestReloader(t *testing.T, path, page string, storers map[string]Storer) (*Reloader, quartz.Scheduler) {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	sched, err := quartz.NewStdScheduler()
+	if err != nil {
+		t.Fatalf("NewStdScheduler: %v", err)
+	}
+
+	newProviders := func(cfg *Config) []OccupancyProvider {
+		c := NewClient(cfg)
+		c.client = &MockClient{resp: &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(page)),
+		}}
+		return []OccupancyProvider{c}
+	}
+	jh := NewJobHandler(cfg.Storage, newProviders(cfg), storers)
+	bh := NewBotHandler(cfg.Gym, storers)
+	cj := NewCheckoutJob(cfg, storers, &stubNotifier{})
+	alerts, err := NewAlerts(cfg.Storage)
+	if err != nil {
+		t.Fatalf("NewAlerts: %v", err)
+	}
+
+	r := NewReloader(path, cfg, sched, time.UTC, jh, bh, cj, alerts)
+	r.newProviders = newProviders
+	return r, sched
+}
+
+func jobKeyNames(t *testing.T, sched quartz.Scheduler) []string {
+	keys, err := sched.GetJobKeys()
+	if err != nil {
+		t.Fatalf("GetJobKeys: %v", err)
+	}
+	names := make([]string, 0, len(keys))
+	for _, k := range keys {
+		names = append(names, k.Name())
+	}
+	return names
+}
+
+func TestReloader_Reload(t *testing.T) {
+	dir := t.TempDir()
+	path := writeConfigFile(t, `
+pgk: p
+fid: f
+gym: TST
+bot_token: t
+storage: `+dir+`
+schedule:
+  often: "0 * * * * *"
+`)
+	page := multiGymOccupancyHTML(map[string][2]int{"TST": {1, 10}, "SLB": {2, 20}})
+	storers := map[string]Storer{"TST": newStubStorer(t)}
+	r, sched := newTestReloader(t, path, page, storers)
+
+	if err := r.Schedule(); err != nil {
+		t.Fatalf("Schedule: %v", err)
+	}
+	if got := jobKeyNames(t, sched); len(got) != 1 || got[0] != "fetch/often" {
+		t.Fatalf("expected job fetch/often, got %v", got)
+	}
+
+	r.path = writeConfigFile(t, `
+pgk: p
+fid: f
+gym: SLB
+bot_token: t
+storage: `+dir+`
+schedule:
+  rarely: "0 0 * * * *"
+gyms:
+  SLB:
+    schedule:
+      evenings: "0 */5 17-21 * * *"
+`)
+	if err := r.Reload(context.Background()); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+
+	got := jobKeyNames(t, sched)
+	if len(got) != 2 || !strings.Contains(strings.Join(got, ","), "rarely") || !strings.Contains(strings.Join(got, ","), "gym/SLB/evenings") {
+		t.Errorf("expected jobs fetch/rarely and gym/SLB/evenings, got %v", got)
+	}
+	if _, ok := r.bh.gyms()["SLB"]; !ok {
+		t.Error("expected the new gym SLB in the bot handler")
+	}
+	if r.bh.gyms()["TST"] != storers["TST"] {
+		t.Error("expected the existing gym TST to keep its storer")
+	}
+	if gym := r.bh.chatGym(1); gym != "SLB" {
+		t.Errorf("expected default gym SLB, got %q", gym)
+	}
+	if _, storers := r.jh.gyms(); len(storers) != 2 {
+		t.Errorf("expected the job handler to fetch 2 gyms, got %d", len(storers))
+	}
+}
+
+func TestReloader_ReloadInvalidKeepsRunningConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := writeConfigFile(t, "pgk: p\nfid: f\ngym: TST\nbot_token: t\nstorage: "+dir+"\nschedule:\n  often: \"0 * * * * *\"\n")
+	page := minimalOccupancyHTML("TST", 1, 10)
+	r, sched := newTestReloader(t, path, page, map[string]Storer{"TST": newStubStorer(t)})
+	if err := r.Schedule(); err != nil {
+		t.Fatalf("Schedule: %v", err)
+	}
+
+	r.path = writeConfigFile(t, "pgk: p\nfid: f\ngym: XYZ\nbot_token: t\nstorage: "+dir+"\nschedule:\n  often: \"every minute\"\n")
+	if err := r.Reload(context.Background()); err == nil {
+		t.Fatal("expected an error for an invalid config")
+	}
+
+	if got := jobKeyNames(t, sched); len(got) != 1 || got[0] != "fetch/often" {
+		t.Errorf("expected job fetch/often to stay, got %v", got)
+	}
+	if gym := r.bh.chatGym(1); gym != "TST" {
+		t.Errorf("expected default gym TST to stay, got %q", gym)
+	}
+}
+
+func TestScheduleFetchJobs_BadCrontab(t *testing.T) {
+	sched, err := quartz.NewStdScheduler()
+	if err != nil {
+		t.Fatalf("NewStdScheduler: %v", err)
+	}
+	jh := NewJobHandler(t.TempDir(), nil, map[string]Storer{})
+	cfg := &Config{Gyms: map[string]GymConfig{"TST": {Schedule: map[string]string{"evenings": "not a crontab"}}}}
+
+	_, err = scheduleFetchJobs(sched, cfg, jh, time.UTC)
+	if err == nil || !strings.Contains(err.Error(), "gym/TST/evenings") {
+		t.Errorf("expected the bad per-gym crontab to be reported, got %v", err)
+	}
+}
+
+func TestScheduleFetchJobs_KeysDontClash(t *testing.T) {
+	sched, err := quartz.NewStdScheduler()
+	if err != nil {
+		t.Fatalf("NewStdScheduler: %v", err)
+	}
+	trigger, err := quartz.NewCronTrigger("0 * * * * *")
+	if err != nil {
+		t.Fatalf("NewCronTrigger: %v", err)
+	}
+	jh := NewJobHandler(t.TempDir(), nil, map[string]Storer{})
+	if err := sched.ScheduleJob(quartz.NewJobDetail(jh, quartz.NewJobKey("checkout")), trigger); err != nil {
+		t.Fatalf("ScheduleJob: %v", err)
+	}
+
+	crontab := map[string]string{"checkout": "0 * * * * *", "B-often": "0 * * * * *"}
+	cfg := &Config{
+		Schedule: crontab,
+		Sources:  []Source{{Name: "b", Schedule: map[string]string{"often": "0 * * * * *"}}},
+		Gyms:     map[string]GymConfig{"B": {Schedule: map[string]string{"often": "0 * * * * *"}}},
+	}
+	keys, err := scheduleFetchJobs(sched, cfg, jh, time.UTC)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(keys) != 4 {
+		t.Errorf("expected 4 jobs, got %v", keys)
+	}
+}
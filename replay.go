@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// replay runs the archived pages back through the parser, printing what it
+// read from each, to try a parser change on real pages. With store set the
+// counters read are backfilled into the gyms' storage, rebuilding history.
+func replay(cfg *Config, source string, store bool, out io.Writer) error {
+	if cfg.Archive.Dir == "" {
+		return errors.New("no archive to replay, set archive.dir or ARCHIVE_DIR")
+	}
+	archive := NewArchive(cfg.Archive)
+
+	storers := make(map[string]*Storage)
+	storage := func(gymKey string) (*Storage, error) {
+		if st, ok := storers[gymKey]; ok {
+			return st, nil
+		}
+		st, err := NewStorage(cfg.Storage, gymKey)
+		if err != nil {
+			return nil, err
+		}
+		storers[gymKey] = st
+		return st, nil
+	}
+
+	var pages, failed, stored int
+	for _, src := range cfg.Sources {
+		if src.JSON != nil || (source != "" && !strings.EqualFold(src.Name, source)) {
+			continue
+		}
+
+		archived, err := archive.Pages(src.Name)
+		if err != nil {
+			return err
+		}
+		c := NewSourceClient(cfg, src)
+		for _, p := range archived {
+			pages++
+			prefix := fmt.Sprintf("%s %s:", p.FetchedAt.Format(time.RFC3339), p.Source)
+
+			counters, err := replayPage(c, p)
+			if err != nil {
+				failed++
+				fmt.Fprintln(out, prefix, "error:", err)
+				continue
+			}
+			fmt.Fprintln(out, prefix, len(*counters), "gyms")
+
+			if !store {
+				continue
+			}
+			for gymKey, counter := range *counters {
+				st, err := storage(gymKey)
+				if err != nil {
+					return err
+				}
+				ok, err := st.Backfill(counter)
+				if err != nil {
+					return fmt.Errorf("backfill %s: %w", gymKey, err)
+				}
+				if ok {
+					stored++
+				}
+			}
+		}
+	}
+
+	if store {
+		fmt.Fprintf(out, "replayed %d pages, %d failed, %d counters backfilled\n", pages, failed, stored)
+	} else {
+		fmt.Fprintf(out, "replayed %d pages, %d failed\n", pages, failed)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d pages failed", failed, pages)
+	}
+	return nil
+}
+
+func replayPage(c *Client, p ArchivedPage) (*Counters, error) {
+	page, err := p.Read()
+	if err != nil {
+		return nil, err
+	}
+	return c.pageCounters(page, p.FetchedAt)
+}
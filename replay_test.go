@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplay(t *testing.T) {
+	cfg := &Config{
+		Storage: t.TempDir(),
+		Sources: []Source{{Name: "bldr"}},
+		Archive: ArchiveConfig{Dir: t.TempDir(), Retention: 24 * time.Hour},
+	}
+	a := NewArchive(cfg.Archive)
+	t1 := time.Date(2024, time.May, 30, 10, 0, 0, 0, time.UTC)
+	t2 := t1.Add(5 * time.Minute)
+	a.now = func() time.Time { return t2 }
+	a.Save("bldr", t1, []byte(minimalOccupancyHTML("SLB", 5, 50)))
+	a.Save("bldr", t2, []byte("<html><body>changed</body></html>"))
+
+	var out bytes.Buffer
+	err := replay(cfg, "", true, &out)
+	if err == nil || !strings.Contains(err.Error(), "1 of 2 pages failed") {
+		t.Errorf("expected the changed page to fail, got %v", err)
+	}
+	if !strings.Contains(out.String(), "2024-05-30T10:00:00Z bldr: 1 gyms") ||
+		!strings.Contains(out.String(), "2024-05-30T10:05:00Z bldr: error:") ||
+		!strings.Contains(out.String(), "1 counters backfilled") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+
+	st, err := NewStorage(cfg.Storage, "BLDR-SLB")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	last, ok := st.Last()
+	if !ok || last.Count != 5 || !last.LastUpdate.Equal(t1) {
+		t.Errorf("expected the counter of the first page to be backfilled, got %+v", last)
+	}
+
+	// Replaying again doesn't store the same counters twice
+	out.Reset()
+	replay(cfg, "bldr", true, &out)
+	if !strings.Contains(out.String(), "0 counters backfilled") {
+		t.Errorf("expected nothing to be backfilled again, got:\n%s", out.String())
+	}
+}
+
+func TestReplay_NoArchive(t *testing.T) {
+	if err := replay(&Config{}, "", false, &bytes.Buffer{}); err == nil {
+		t.Error("expected an error without an archive dir")
+	}
+}
+
+func TestStorage_Backfill(t *testing.T) {
+	st, err := NewStorage(t.TempDir(), "TST")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	now := time.Date(2024, time.May, 30, 10, 0, 0, 0, time.UTC)
+	st.Store(Counter{Count: 9, LastUpdate: LastUpdate{Time: now}})
+
+	old := Counter{Count: 3, LastUpdate: LastUpdate{Time: now.Add(-time.Hour)}}
+	if ok, err := st.Backfill(old); !ok || err != nil {
+		t.Fatalf("expected the old counter to be stored, got %v, %v", ok, err)
+	}
+	if ok, _ := st.Backfill(old); ok {
+		t.Error("expected the same counter not to be stored twice")
+	}
+	if last, _ := st.Last(); last.Count != 9 {
+		t.Errorf("expected the latest counter to stay the last one, got %+v", last)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of making a request while the circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// RetryClient retries requests that failed with a network error, a 5xx or a
+// 429 with jittered exponential backoff, and stops making requests for a
+// while after repeated failures. It reads the whole response body within the
+// request, so that a body cut short is retried as well, and bounds it all by
+// the HTTP config's total timeout and body size limit.
+type RetryClient struct {
+	next    HTTPClient
+	http    HTTPConfig
+	retry   RetryConfig
+	breaker *Breaker
+	name    string
+	sleep   func(ctx context.Context, d time.Duration) error
+}
+
+func NewRetryClient(next HTTPClient, hc HTTPConfig, retry RetryConfig, name string) *RetryClient {
+	return &RetryClient{
+		next:    next,
+		http:    hc,
+		retry:   retry,
+		breaker: NewBreaker(name, retry.BreakerFailures, retry.BreakerCooldown),
+		name:    name,
+		sleep:   sleep,
+	}
+}
+
+func (rc *RetryClient) Do(req *http.Request) (*http.Response, error) {
+	logger := slog.Default().With("component", "retry client", "source", rc.name)
+
+	if err := rc.breaker.Allow(); err != nil {
+		return nil, err
+	}
+
+	// Only the caller giving up spares the breaker, running out of the
+	// total timeout counts against the source
+	parent := req.Context()
+	ctx, cancel := rc.http.withTimeout(parent)
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	attempts := max(1, rc.retry.Attempts)
+	for attempt := 1; ; attempt++ {
+		metrics.Add(rc.name, "requests", 1)
+		resp, err := rc.next.Do(req)
+		if err == nil {
+			resp, err = readBody(resp, rc.http.MaxBodySize)
+		}
+		if parent.Err() != nil {
+			rc.breaker.Cancel()
+			return resp, err
+		}
+		if !retryable(resp, err) {
+			rc.breaker.Success()
+			return resp, err
+		}
+
+		delay, ok := rc.delay(attempt, resp)
+		if attempt >= attempts || !ok || ctx.Err() != nil {
+			rc.breaker.Failure()
+			metrics.Add(rc.name, "failures", 1)
+			return resp, err
+		}
+
+		if resp != nil {
+			logger.Warn("retrying request", "attempt", attempt, "status", resp.StatusCode, "delay", delay)
+		} else {
+			logger.Warn("retrying request", "attempt", attempt, "msg", err, "delay", delay)
+		}
+		metrics.Add(rc.name, "retries", 1)
+		if err := rc.sleep(ctx, delay); err != nil {
+			if parent.Err() != nil {
+				rc.breaker.Cancel()
+			} else {
+				rc.breaker.Failure()
+				metrics.Add(rc.name, "failures", 1)
+			}
+			return nil, err
+		}
+	}
+}
+
+// readBody reads the whole body of the response, up to limit bytes unless
+// limit is 0, and gives the response a body that reads what was read.
+func readBody(resp *http.Response, limit int64) (*http.Response, error) {
+	defer resp.Body.Close()
+	body, err := io.ReadAll(limitBody(resp.Body, limit))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// delay returns how long to wait before the attempt after the given one. It
+// is false when the server asks to wait longer than the max delay.
+func (rc *RetryClient) delay(attempt int, resp *http.Response) (time.Duration, bool) {
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		if d, ok := retryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			return d, d <= rc.retry.MaxDelay
+		}
+	}
+
+	// Equal jitter: half the backoff for sure, the other half random
+	backoff := min(rc.retry.MaxDelay, rc.retry.MinDelay<<min(attempt-1, 20))
+	if backoff <= 0 {
+		return 0, true
+	}
+	return backoff/2 + rand.N(backoff/2+1), true
+}
+
+// retryable reports whether the outcome of a request is worth another try.
+// A body over the size limit won't get any smaller.
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, ErrBodyTooLarge)
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// retryAfter parses a Retry-After header given in seconds or as an HTTP date.
+func retryAfter(val string, now time.Time) (time.Duration, bool) {
+	if val == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(val); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(val); err == nil {
+		return max(0, t.Sub(now)), true
+	}
+	return 0, false
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+type breakerState string
+
+const (
+	breakerClosed   breakerState = "closed"
+	breakerOpen     breakerState = "open"
+	breakerHalfOpen breakerState = "half-open"
+)
+
+// Breaker is a circuit breaker. It opens after the given number of
+// consecutive failures and lets a single trial request through once the
+// cooldown has passed, closing again if that succeeds. A breaker with no
+// failure limit never opens.
+type Breaker struct {
+	mu       sync.Mutex
+	name     string
+	limit    int
+	cooldown time.Duration
+	state    breakerState
+	failures int
+	openedAt time.Time
+	now      func() time.Time
+}
+
+func NewBreaker(name string, limit int, cooldown time.Duration) *Breaker {
+	b := &Breaker{name: name, limit: limit, cooldown: cooldown, now: time.Now}
+	b.setState(breakerClosed)
+	return b
+}
+
+// SetLimits changes how many failures in a row open the breaker and how long
+// it stays open, keeping its state.
+func (b *Breaker) SetLimits(limit int, cooldown time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limit = limit
+	b.cooldown = cooldown
+}
+
+// Allow returns ErrCircuitOpen while the breaker is open or has a trial request in flight.
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return fmt.Errorf("%w until %s", ErrCircuitOpen, b.openedAt.Add(b.cooldown).Format(time.TimeOnly))
+		}
+		b.setState(breakerHalfOpen)
+		return nil
+	case breakerHalfOpen:
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+func (b *Breaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	if b.state != breakerClosed {
+		b.setState(breakerClosed)
+	}
+}
+
+func (b *Breaker) Failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.limit > 0 && (b.state == breakerHalfOpen || b.failures >= b.limit) {
+		b.openedAt = b.now()
+		b.setState(breakerOpen)
+	}
+}
+
+// Cancel gives up a trial request without a verdict, so that the next
+// request becomes the trial.
+func (b *Breaker) Cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.setState(breakerOpen)
+	}
+}
+
+// State returns the breaker's state: closed, open or half-open.
+func (b *Breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return string(b.state)
+}
+
+func (b *Breaker) setState(state breakerState) {
+	if b.state != "" && b.state != state {
+		slog.Warn("circuit breaker changed state", "component", "breaker", "source", b.name,
+			"from", b.state, "to", state, "failures", b.failures)
+	}
+	b.state = state
+	metrics.SetBreaker(b.name, string(state))
+}
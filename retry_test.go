@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// seqClient replies with its responses in turn, repeating the last one.
+type seqClient struct {
+	replies []seqReply
+	calls   int
+}
+
+type seqReply struct {
+	status int
+	header http.Header
+	err    error
+}
+
+func (s *seqClient) Do(req *http.Request) (*http.Response, error) {
+	r := s.replies[min(s.calls, len(s.replies)-1)]
+	s.calls++
+	if r.err != nil {
+		return nil, r.err
+	}
+	return &http.Response{StatusCode: r.status, Header: r.header, Body: io.NopCloser(strings.NewReader(""))}, nil
+}
+
+func newTestRetryClient(next HTTPClient, retry RetryConfig) (*RetryClient, *[]time.Duration) {
+	rc := NewRetryClient(next, HTTPConfig{}, retry, "test")
+	var slept []time.Duration
+	rc.sleep = func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return ctx.Err()
+	}
+	return rc, &slept
+}
+
+func TestRetryClient_RetriesUntilSuccess(t *testing.T) {
+	next := &seqClient{replies: []seqReply{
+		{err: errors.New("connection reset")},
+		{status: http.StatusBadGateway},
+		{status: http.StatusOK},
+	}}
+	rc, slept := newTestRetryClient(next, RetryConfig{Attempts: 3, MinDelay: time.Second, MaxDelay: 10 * time.Second})
+
+	req, _ := http.NewRequest("GET", "https://example.com", nil)
+	resp, err := rc.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %v, %v", resp, err)
+	}
+	if next.calls != 3 {
+		t.Errorf("expected 3 attempts, got %d", next.calls)
+	}
+	// Backoff of 1s and 2s, each jittered down by up to a half
+	if len(*slept) != 2 || (*slept)[0] < 500*time.Millisecond || (*slept)[0] > time.Second ||
+		(*slept)[1] < time.Second || (*slept)[1] > 2*time.Second {
+		t.Errorf("unexpected delays %v", *slept)
+	}
+}
+
+func TestRetryClient_GivesUp(t *testing.T) {
+	next := &seqClient{replies: []seqReply{{status: http.StatusServiceUnavailable}}}
+	rc, _ := newTestRetryClient(next, RetryConfig{Attempts: 3, MinDelay: time.Second, MaxDelay: 10 * time.Second})
+
+	req, _ := http.NewRequest("GET", "https://example.com", nil)
+	resp, err := rc.Do(req)
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected the last 503 back, got %v, %v", resp, err)
+	}
+	if next.calls != 3 {
+		t.Errorf("expected 3 attempts, got %d", next.calls)
+	}
+}
+
+func TestRetryClient_NoRetryOnClientError(t *testing.T) {
+	next := &seqClient{replies: []seqReply{{status: http.StatusNotFound}}}
+	rc, _ := newTestRetryClient(next, RetryConfig{Attempts: 3, MinDelay: time.Second, MaxDelay: 10 * time.Second})
+
+	req, _ := http.NewRequest("GET", "https://example.com", nil)
+	if resp, _ := rc.Do(req); resp.StatusCode != http.StatusNotFound || next.calls != 1 {
+		t.Errorf("expected a single attempt for a 404, got %d", next.calls)
+	}
+}
+
+func TestRetryClient_RetryAfter(t *testing.T) {
+	next := &seqClient{replies: []seqReply{
+		{status: http.StatusTooManyRequests, header: http.Header{"Retry-After": {"7"}}},
+		{status: http.StatusOK},
+	}}
+	rc, slept := newTestRetryClient(next, RetryConfig{Attempts: 3, MinDelay: time.Second, MaxDelay: 10 * time.Second})
+
+	req, _ := http.NewRequest("GET", "https://example.com", nil)
+	if resp, err := rc.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %v, %v", resp, err)
+	}
+	if len(*slept) != 1 || (*slept)[0] != 7*time.Second {
+		t.Errorf("expected to wait 7s as asked, got %v", *slept)
+	}
+
+	// Asked to wait longer than the max delay, it gives up right away
+	next = &seqClient{replies: []seqReply{{status: http.StatusTooManyRequests, header: http.Header{"Retry-After": {"3600"}}}}}
+	rc, _ = newTestRetryClient(next, RetryConfig{Attempts: 3, MinDelay: time.Second, MaxDelay: 10 * time.Second})
+	if resp, _ := rc.Do(req); resp.StatusCode != http.StatusTooManyRequests || next.calls != 1 {
+		t.Errorf("expected to give up after one attempt, got %d", next.calls)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, time.May, 30, 10, 0, 0, 0, time.UTC)
+	cases := []struct {
+		val  string
+		want time.Duration
+		ok   bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{"Thu, 30 May 2024 10:00:30 GMT", 30 * time.Second, true},
+		{"Thu, 30 May 2024 09:00:00 GMT", 0, true},
+		{"", 0, false},
+		{"soon", 0, false},
+	}
+	for _, tc := range cases {
+		got, ok := retryAfter(tc.val, now)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("retryAfter(%q): expected %v, %v, got %v, %v", tc.val, tc.want, tc.ok, got, ok)
+		}
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	now := time.Date(2024, time.May, 30, 10, 0, 0, 0, time.UTC)
+	b := NewBreaker("test", 2, time.Minute)
+	b.now = func() time.Time { return now }
+
+	b.Failure()
+	if err := b.Allow(); err != nil {
+		t.Fatalf("expected the breaker to stay closed after one failure, got %v", err)
+	}
+	b.Failure()
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) || b.State() != "open" {
+		t.Fatalf("expected the breaker to open after two failures, got %v (%s)", err, b.State())
+	}
+
+	now = now.Add(time.Minute)
+	if err := b.Allow(); err != nil || b.State() != "half-open" {
+		t.Fatalf("expected a trial request after the cooldown, got %v (%s)", err, b.State())
+	}
+	if err := b.Allow(); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected a single trial request, got %v", err)
+	}
+	b.Failure()
+	if b.State() != "open" {
+		t.Fatalf("expected a failed trial to open the breaker, got %s", b.State())
+	}
+
+	now = now.Add(time.Minute)
+	if err := b.Allow(); err != nil {
+		t.Fatalf("expected a trial request after the cooldown, got %v", err)
+	}
+	b.Success()
+	if err := b.Allow(); err != nil || b.State() != "closed" {
+		t.Errorf("expected a successful trial to close the breaker, got %v (%s)", err, b.State())
+	}
+}
+
+func TestRetryClient_BreakerOpens(t *testing.T) {
+	next := &seqClient{replies: []seqReply{{err: errors.New("connection refused")}}}
+	rc, _ := newTestRetryClient(next, RetryConfig{Attempts: 2, BreakerFailures: 2, BreakerCooldown: time.Hour})
+
+	req, _ := http.NewRequest("GET", "https://example.com", nil)
+	for range 2 {
+		if _, err := rc.Do(req); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+	if _, err := rc.Do(req); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("expected the breaker to be open, got %v", err)
+	}
+	if next.calls != 4 {
+		t.Errorf("expected no requests while open, got %d in total", next.calls)
+	}
+	if got := metrics.source("test").Get("breaker").String(); got != `"open"` {
+		t.Errorf("expected the breaker metric to be open, got %s", got)
+	}
+}
+
+// hangClient waits for the request to be given up on.
+type hangClient struct{}
+
+func (hangClient) Do(req *http.Request) (*http.Response, error) {
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+func TestRetryClient_TimeoutCountsAsFailure(t *testing.T) {
+	rc := NewRetryClient(hangClient{}, HTTPConfig{Timeout: 10 * time.Millisecond}, RetryConfig{Attempts: 1, BreakerFailures: 1, BreakerCooldown: time.Hour}, "test")
+
+	req, _ := http.NewRequest("GET", "https://example.com", nil)
+	if _, err := rc.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the timeout, got %v", err)
+	}
+	if got := rc.breaker.State(); got != "open" {
+		t.Errorf("expected the timeout to open the breaker, got %s", got)
+	}
+}
+
+func TestRetryClient_CallerGivingUpSparesBreaker(t *testing.T) {
+	rc := NewRetryClient(hangClient{}, HTTPConfig{}, RetryConfig{Attempts: 1, BreakerFailures: 1, BreakerCooldown: time.Hour}, "test")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", "https://example.com", nil)
+	if _, err := rc.Do(req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the caller's deadline, got %v", err)
+	}
+	if got := rc.breaker.State(); got != "closed" {
+		t.Errorf("expected the breaker to stay closed, got %s", got)
+	}
+}
+
+// cutBody fails reading after the first bytes, like a reset connection.
+type cutBody struct{ read bool }
+
+func (b *cutBody) Read(p []byte) (int, error) {
+	if b.read {
+		return 0, errors.New("connection reset by peer")
+	}
+	b.read = true
+	return copy(p, "<html>"), nil
+}
+
+func (b *cutBody) Close() error { return nil }
+
+// cutClient cuts the body of its first response short.
+type cutClient struct{ calls int }
+
+func (c *cutClient) Do(req *http.Request) (*http.Response, error) {
+	c.calls++
+	if c.calls == 1 {
+		return &http.Response{StatusCode: http.StatusOK, Body: &cutBody{}}, nil
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader("<html></html>"))}, nil
+}
+
+func TestRetryClient_RetriesCutBody(t *testing.T) {
+	next := &cutClient{}
+	rc, _ := newTestRetryClient(next, RetryConfig{Attempts: 2})
+
+	req, _ := http.NewRequest("GET", "https://example.com", nil)
+	resp, err := rc.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if next.calls != 2 || string(body) != "<html></html>" {
+		t.Errorf("expected the whole body of the second attempt, got %q after %d attempts", body, next.calls)
+	}
+}
+
+func TestKeepBreakers(t *testing.T) {
+	cfg := &Config{
+		Retry: RetryConfig{BreakerFailures: 1, BreakerCooldown: time.Hour},
+		Sources: []Source{
+			{Name: "rgp", PGK: "pgk", FID: "fid"},
+			{Name: "json", JSON: &JSONSource{URL: "https://example.com/a", Gym: "A"}},
+		},
+	}
+	old := NewProviders(cfg)
+	for _, p := range old {
+		_, rc, _ := retryClient(p)
+		rc.breaker.Failure()
+	}
+
+	reloaded := *cfg
+	reloaded.Retry.BreakerFailures = 3
+	reloaded.Sources = []Source{cfg.Sources[0], {Name: "json", JSON: &JSONSource{URL: "https://example.com/b", Gym: "A"}}}
+	providers := NewProviders(&reloaded)
+	keepBreakers(old, providers)
+
+	_, kept, _ := retryClient(providers[0])
+	if _, oldRC, _ := retryClient(old[0]); kept.breaker != oldRC.breaker || kept.breaker.State() != "open" {
+		t.Errorf("expected the open breaker of the unchanged source to be kept, got %s", kept.breaker.State())
+	}
+	if kept.breaker.limit != 3 {
+		t.Errorf("expected the kept breaker to take the new limit, got %d", kept.breaker.limit)
+	}
+	if _, changed, _ := retryClient(providers[1]); changed.breaker.State() != "closed" {
+		t.Errorf("expected a new breaker for the changed URL, got %s", changed.breaker.State())
+	}
+}
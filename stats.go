@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Stats summarises a climber's sessions across all gyms.
+type Stats struct {
+	Week    int
+	Month   int
+	Year    int
+	Total   time.Duration
+	Average time.Duration
+	Longest Session
+	// Streak is the number of consecutive weeks with at least one session,
+	// counting back from the current week, or from the last one while the
+	// current week has no sessions yet.
+	Streak int
+	// Open is the session still going on, zero if there is none.
+	Open Session
+}
+
+// NewStats computes Stats for the sessions as of now.
+func NewStats(sessions []Session, now time.Time) Stats {
+	var st Stats
+
+	week := startOfWeek(now)
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	year := time.Date(now.Year(), 1, 1, 0, 0, 0, 0, now.Location())
+
+	closed := 0
+	weeks := make(map[time.Time]bool)
+	for _, s := range sessions {
+		start := s.Start.In(now.Location())
+		if !start.Before(week) {
+			st.Week++
+		}
+		if !start.Before(month) {
+			st.Month++
+		}
+		if !start.Before(year) {
+			st.Year++
+		}
+		weeks[startOfWeek(start)] = true
+
+		if s.End.IsZero() {
+			if start.After(st.Open.Start) {
+				st.Open = s
+				st.Open.Start = start
+			}
+			continue
+		}
+		closed++
+		st.Total += s.Duration
+		if s.Duration > st.Longest.Duration {
+			st.Longest = s
+		}
+	}
+
+	if closed > 0 {
+		st.Average = st.Total / time.Duration(closed)
+	}
+
+	w := week
+	if !weeks[w] {
+		w = w.AddDate(0, 0, -7)
+	}
+	for weeks[w] {
+		st.Streak++
+		w = w.AddDate(0, 0, -7)
+	}
+
+	return st
+}
+
+func (st Stats) String() string {
+	var b strings.Builder
+	b.WriteString("Your climbing stats:\n")
+	fmt.Fprintf(&b, "This week: %s\n", plural(st.Week, "session"))
+	fmt.Fprintf(&b, "This month: %s\n", plural(st.Month, "session"))
+	fmt.Fprintf(&b, "This year: %s\n", plural(st.Year, "session"))
+	if !st.Open.Start.IsZero() {
+		fmt.Fprintf(&b, "Climbing now: at %s since %s\n", st.Open.Gym, st.Open.Start.Format("15:04"))
+	}
+	if st.Total == 0 {
+		b.WriteString("No finished sessions yet.\n")
+	} else {
+		fmt.Fprintf(&b, "Time on the wall: %s total, %s on average\n", formatDuration(st.Total), formatDuration(st.Average))
+		fmt.Fprintf(&b, "Longest session: %s at %s on %s\n", formatDuration(st.Longest.Duration), st.Longest.Gym, st.Longest.Start.Format("Jan 2"))
+	}
+	fmt.Fprintf(&b, "Weekly streak: %s", plural(st.Streak, "week"))
+	return b.String()
+}
+
+// startOfWeek returns midnight of the Monday of t's week.
+func startOfWeek(t time.Time) time.Time {
+	y, m, d := t.Date()
+	offset := (int(t.Weekday()) + 6) % 7
+	return time.Date(y, m, d-offset, 0, 0, 0, 0, t.Location())
+}
+
+// plural formats n with the noun, adding an "s" unless n is one.
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
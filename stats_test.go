@@ -0,0 +1,115 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewStats(t *testing.T) {
+	// Wednesday
+	now := time.Date(2024, 5, 15, 12, 0, 0, 0, time.UTC)
+	session := func(gym string, start time.Time, d time.Duration) Session {
+		return Session{Gym: gym, Start: start, End: start.Add(d), Duration: d}
+	}
+	sessions := []Session{
+		session("TST", time.Date(2023, 12, 30, 18, 0, 0, 0, time.UTC), 3*time.Hour),
+		session("TST", time.Date(2024, 4, 29, 18, 0, 0, 0, time.UTC), time.Hour),
+		session("SLB", time.Date(2024, 5, 1, 18, 0, 0, 0, time.UTC), 2*time.Hour),
+		session("TST", time.Date(2024, 5, 8, 18, 0, 0, 0, time.UTC), time.Hour),
+		session("TST", time.Date(2024, 5, 13, 18, 0, 0, 0, time.UTC), 2*time.Hour),
+		// still open, counts as a session but not towards time on the wall
+		{Gym: "TST", Start: time.Date(2024, 5, 15, 10, 0, 0, 0, time.UTC)},
+	}
+
+	st := NewStats(sessions, now)
+
+	if st.Week != 2 || st.Month != 4 || st.Year != 5 {
+		t.Errorf("expected 2/4/5 sessions this week/month/year, got %d/%d/%d", st.Week, st.Month, st.Year)
+	}
+	if st.Total != 9*time.Hour {
+		t.Errorf("expected 9h total, got %v", st.Total)
+	}
+	if st.Average != 108*time.Minute {
+		t.Errorf("expected 1h48m average, got %v", st.Average)
+	}
+	if st.Longest.Duration != 3*time.Hour || st.Longest.Start.Year() != 2023 {
+		t.Errorf("expected the 3h session from 2023 as longest, got %v", st.Longest)
+	}
+	if st.Streak != 3 {
+		t.Errorf("expected a 3 week streak, got %d", st.Streak)
+	}
+	if st.Open.Gym != "TST" || st.Open.Start.Hour() != 10 {
+		t.Errorf("expected the session from 10:00 at TST to be open, got %v", st.Open)
+	}
+}
+
+func TestNewStats_StreakFromLastWeek(t *testing.T) {
+	// Monday morning, nothing yet this week
+	now := time.Date(2024, 5, 20, 8, 0, 0, 0, time.UTC)
+	sessions := []Session{
+		{Start: time.Date(2024, 5, 13, 18, 0, 0, 0, time.UTC)},
+		{Start: time.Date(2024, 5, 19, 18, 0, 0, 0, time.UTC)},
+	}
+
+	if st := NewStats(sessions, now); st.Streak != 1 {
+		t.Errorf("expected a 1 week streak, got %d", st.Streak)
+	}
+
+	// A full week without sessions breaks the streak
+	if st := NewStats(sessions, now.AddDate(0, 0, 7)); st.Streak != 0 {
+		t.Errorf("expected no streak, got %d", st.Streak)
+	}
+}
+
+func TestStats_String(t *testing.T) {
+	empty := NewStats(nil, time.Now()).String()
+	if !strings.Contains(empty, "This week: 0 sessions") || !strings.Contains(empty, "No finished sessions yet.") {
+		t.Errorf("unexpected empty stats %q", empty)
+	}
+
+	// Only an open session, this week
+	now := time.Date(2024, 5, 15, 19, 0, 0, 0, time.UTC)
+	open := NewStats([]Session{{Gym: "TST", Start: now.Add(-time.Hour)}}, now)
+	want := "Your climbing stats:\n" +
+		"This week: 1 session\n" +
+		"This month: 1 session\n" +
+		"This year: 1 session\n" +
+		"Climbing now: at TST since 18:00\n" +
+		"No finished sessions yet.\n" +
+		"Weekly streak: 1 week"
+	if got := open.String(); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	start := time.Date(2024, 5, 1, 18, 0, 0, 0, time.UTC)
+	st := Stats{
+		Week:    1,
+		Month:   2,
+		Year:    3,
+		Total:   5 * time.Hour,
+		Average: 100 * time.Minute,
+		Longest: Session{Gym: "TST", Start: start, Duration: 2 * time.Hour},
+		Streak:  1,
+	}
+	want = "Your climbing stats:\n" +
+		"This week: 1 session\n" +
+		"This month: 2 sessions\n" +
+		"This year: 3 sessions\n" +
+		"Time on the wall: 5h total, 1h40m on average\n" +
+		"Longest session: 2h at TST on May 1\n" +
+		"Weekly streak: 1 week"
+	if got := st.String(); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestStartOfWeek(t *testing.T) {
+	monday := time.Date(2024, 5, 13, 0, 0, 0, 0, time.UTC)
+	for d := range 7 {
+		day := monday.AddDate(0, 0, d).Add(13 * time.Hour)
+		if got := startOfWeek(day); !got.Equal(monday) {
+			t.Errorf("startOfWeek(%v): expected %v, got %v", day, monday, got)
+		}
+	}
+}
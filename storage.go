@@ -2,10 +2,12 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
@@ -16,6 +18,7 @@ import (
 type Storer interface {
 	Store(counter Counter) error
 	Last() (Counter, bool)
+	Range(from, to time.Time) ([]Counter, error)
 	NewGym() error
 	GetGym() *Gym
 }
@@ -23,6 +26,7 @@ type Storer interface {
 // Storage struct with the path to the storage file
 type Storage struct {
 	filePath string
+	name     string
 	db       *sql.DB
 	gym      *Gym
 }
@@ -51,14 +55,95 @@ func NewStorage(storageDir, gymName string) (*Storage, error) {
 	if _, err = db.Exec(createTableQuery); err != nil {
 		return nil, err
 	}
+	if err := addMissingColumns(db, "count", map[string]string{
+		"name": "TEXT", "extra": "TEXT", "raw_update": "TEXT", "approx": "INTEGER NOT NULL DEFAULT 0",
+	}); err != nil {
+		return nil, err
+	}
+
+	// The file name is lowercased, so keep the gym's key as it goes for storedGyms
+	createMetaQuery := `
+    CREATE TABLE IF NOT EXISTS meta (
+        name TEXT PRIMARY KEY,
+        value TEXT
+    );`
+	if _, err := db.Exec(createMetaQuery); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(`
+    INSERT INTO meta (name, value) VALUES ('gym_key', ?)
+    ON CONFLICT(name) DO UPDATE SET value = excluded.value`, gymName); err != nil {
+		return nil, err
+	}
 
-	return &Storage{db: db, filePath: filePath}, nil
+	return &Storage{db: db, filePath: filePath, name: gymName}, nil
+}
+
+// newGymStorage creates the storage of a gym along with its Gym.
+func newGymStorage(storageDir, gymKey string) (*Storage, error) {
+	st, err := NewStorage(storageDir, gymKey)
+	if err != nil {
+		return nil, fmt.Errorf("create storage for gym %q: %w", gymKey, err)
+	}
+	if err := st.NewGym(); err != nil {
+		return nil, fmt.Errorf("init gym for %q: %w", gymKey, err)
+	}
+	return st, nil
+}
+
+// storedGyms returns the keys of the gyms that have storage in storageDir,
+// sorted. A missing dir has none.
+func storedGyms(storageDir string) ([]string, error) {
+	logger := slog.Default().With("component", "storage")
+
+	paths, err := filepath.Glob(filepath.Join(storageDir, "*.db"))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(paths))
+	for _, path := range paths {
+		key, err := storedGymKey(path)
+		if err != nil {
+			logger.Warn("can't tell the gym of the storage, skipping it", "path", path, "msg", err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// storedGymKey reads the gym key kept in the storage file at path. Files from
+// before the key was kept in them go by their uppercased name, as gym keys are
+// uppercase.
+func storedGymKey(path string) (string, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	var hasMeta bool
+	if err := db.QueryRow("SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = 'meta'").Scan(&hasMeta); err != nil {
+		return "", err
+	}
+	var key string
+	if hasMeta {
+		err = db.QueryRow("SELECT value FROM meta WHERE name = 'gym_key'").Scan(&key)
+	}
+	switch {
+	case !hasMeta || err == sql.ErrNoRows:
+		return strings.ToUpper(strings.TrimSuffix(filepath.Base(path), ".db")), nil
+	case err != nil:
+		return "", err
+	}
+	return key, nil
 }
 
 // NewGym initializes and stores the Gym instance using the Storage's file path.
 func (s *Storage) NewGym() error {
 	var err error
-	s.gym, err = NewGym(s.filePath)
+	s.gym, err = NewGym(s.filePath, s.name)
 	return err
 }
 
@@ -72,7 +157,7 @@ func (s *Storage) Store(counter Counter) error {
 	logger := slog.Default().With("component", "storage")
 
 	var lastUpdate string
-	query := "SELECT last_update FROM count ORDER BY id DESC LIMIT 1"
+	query := "SELECT last_update FROM count ORDER BY datetime(last_update) DESC, id DESC LIMIT 1"
 	err := s.db.QueryRow(query).Scan(&lastUpdate)
 	if err != nil && err != sql.ErrNoRows {
 		return err
@@ -83,17 +168,14 @@ func (s *Storage) Store(counter Counter) error {
 		if err != nil {
 			return err
 		}
-		if counter.LastUpdate.Equal(lastTime) {
+		// Stored to the second, compared as instants whatever their offsets
+		if counter.LastUpdate.Time.Truncate(time.Second).Equal(lastTime) {
 			logger.Info("skipping duplicated counter", "counter", counter)
 			return nil
 		}
 	}
 
-	insertQuery := `
-    INSERT INTO count (count, capacity, last_update)
-    VALUES (?, ?, ?)`
-	_, err = s.db.Exec(insertQuery, counter.Count, counter.Capacity, counter.LastUpdate.Format(time.RFC3339))
-	if err != nil {
+	if err := s.insert(counter); err != nil {
 		return err
 	}
 
@@ -101,16 +183,48 @@ func (s *Storage) Store(counter Counter) error {
 	return nil
 }
 
+// Backfill stores a counter from the past unless one with the same update
+// time is stored already. It reports whether the counter was stored.
+func (s *Storage) Backfill(counter Counter) (bool, error) {
+	var n int
+	query := "SELECT COUNT(*) FROM count WHERE datetime(last_update) = datetime(?)"
+	if err := s.db.QueryRow(query, counter.LastUpdate.Format(time.RFC3339)).Scan(&n); err != nil {
+		return false, err
+	}
+	if n > 0 {
+		return false, nil
+	}
+	return true, s.insert(counter)
+}
+
+func (s *Storage) insert(counter Counter) error {
+	var extra sql.NullString
+	if len(counter.Extra) > 0 {
+		b, err := json.Marshal(counter.Extra)
+		if err != nil {
+			return err
+		}
+		extra = sql.NullString{String: string(b), Valid: true}
+	}
+
+	insertQuery := `
+    INSERT INTO count (count, capacity, last_update, name, extra, raw_update, approx)
+    VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err := s.db.Exec(insertQuery, counter.Count, counter.Capacity, counter.LastUpdate.Format(time.RFC3339),
+		counter.Name, extra, counter.LastUpdate.Raw, counter.LastUpdate.Approx)
+	return err
+}
+
 // Last returns the last stored Counter and a boolean indicating if it was successful
 func (s *Storage) Last() (Counter, bool) {
 	logger := slog.Default().With("component", "storage", "function", "last")
 
-	var counter Counter
-	query := "SELECT count, capacity, last_update FROM count ORDER BY id DESC LIMIT 1"
-	row := s.db.QueryRow(query)
-
-	var lastUpdate string
-	if err := row.Scan(&counter.Count, &counter.Capacity, &lastUpdate); err != nil {
+	// By update time rather than id, as backfilled counters come in late
+	query := `
+    SELECT count, capacity, last_update, name, extra, raw_update, approx FROM count
+    ORDER BY datetime(last_update) DESC, id DESC LIMIT 1`
+	counter, err := scanCounter(s.db.QueryRow(query))
+	if err != nil {
 		if err == sql.ErrNoRows {
 			logger.Info("no records in table")
 			return Counter{}, false
@@ -119,13 +233,57 @@ func (s *Storage) Last() (Counter, bool) {
 		return Counter{}, false
 	}
 
+	logger.Info("found last record", "counter", counter)
+	return counter, true
+}
+
+// Range returns the counters last updated within [from, to), oldest first
+func (s *Storage) Range(from, to time.Time) ([]Counter, error) {
+	// datetime() normalises the stored offsets to UTC so the comparison holds across DST changes
+	query := `
+    SELECT count, capacity, last_update, name, extra, raw_update, approx FROM count
+    WHERE datetime(last_update) >= datetime(?) AND datetime(last_update) < datetime(?)
+    ORDER BY datetime(last_update), id`
+	rows, err := s.db.Query(query, from.Format(time.RFC3339), to.Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counters []Counter
+	for rows.Next() {
+		counter, err := scanCounter(rows)
+		if err != nil {
+			return nil, err
+		}
+		counters = append(counters, counter)
+	}
+
+	return counters, rows.Err()
+}
+
+// scanCounter reads a row of count, capacity, last_update, name, extra,
+// raw_update and approx.
+func scanCounter(row interface{ Scan(dest ...any) error }) (Counter, error) {
+	var counter Counter
+	var lastUpdate string
+	var name, extra, rawUpdate sql.NullString
+	var approx bool
+	if err := row.Scan(&counter.Count, &counter.Capacity, &lastUpdate, &name, &extra, &rawUpdate, &approx); err != nil {
+		return Counter{}, err
+	}
+
 	parsedTime, err := time.Parse(time.RFC3339, lastUpdate)
 	if err != nil {
-		logger.Error("invalid time format", "msg", err)
-		return Counter{}, false
+		return Counter{}, fmt.Errorf("invalid time format: %w", err)
 	}
+	counter.LastUpdate = LastUpdate{Time: parsedTime, Raw: rawUpdate.String, Approx: approx}
+	counter.Name = name.String
 
-	counter.LastUpdate = LastUpdate{Time: parsedTime}
-	logger.Info("found last record", "counter", counter)
-	return counter, true
+	if extra.Valid && extra.String != "" {
+		if err := json.Unmarshal([]byte(extra.String), &counter.Extra); err != nil {
+			return Counter{}, fmt.Errorf("invalid extra fields: %w", err)
+		}
+	}
+	return counter, nil
 }
@@ -154,6 +154,32 @@ func TestStore_Append(t *testing.T) {
 	}
 }
 
+func TestStore_SkipsDuplicateInOtherOffset(t *testing.T) {
+	st, err := NewStorage(t.TempDir(), "TST")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	at := time.Date(2024, time.May, 30, 10, 0, 0, 0, time.UTC)
+	for _, t0 := range []time.Time{at, at.In(time.FixedZone("EDT", -4*60*60))} {
+		if err := st.Store(Counter{Count: 1, Capacity: 100, LastUpdate: LastUpdate{Time: t0}}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	// Same wall clock, another instant
+	if err := st.Store(Counter{Count: 2, Capacity: 100, LastUpdate: LastUpdate{Time: time.Date(2024, time.May, 30, 10, 0, 0, 0, time.FixedZone("EDT", -4*60*60))}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	records, err := readAllRecords(st.db)
+	if err != nil {
+		t.Fatalf("unexpected error reading records: %v", err)
+	}
+	if len(records) != 2 {
+		t.Errorf("expected the same instant to be stored once, got %v", records)
+	}
+}
+
 func TestLast(t *testing.T) {
 	st, err := NewStorage(t.TempDir(), "TST")
 	if err != nil {
@@ -264,3 +290,124 @@ func TestMultipleGyms(t *testing.T) {
 		t.Error("SLB and SBG share the same file path")
 	}
 }
+
+func TestRange(t *testing.T) {
+	st, err := NewStorage(t.TempDir(), "TST")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	est := time.FixedZone("EST", -5*60*60)
+	times := []time.Time{
+		time.Date(2024, time.May, 30, 9, 0, 0, 0, time.UTC),
+		time.Date(2024, time.May, 30, 10, 0, 0, 0, time.UTC),
+		// 11:00 UTC stored with a different offset
+		time.Date(2024, time.May, 30, 6, 0, 0, 0, est),
+		time.Date(2024, time.May, 30, 12, 0, 0, 0, time.UTC),
+	}
+	for i, ts := range times {
+		if err := st.Store(Counter{Count: i, Capacity: 100, LastUpdate: LastUpdate{Time: ts}}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	counters, err := st.Range(time.Date(2024, time.May, 30, 10, 0, 0, 0, time.UTC), time.Date(2024, time.May, 30, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(counters) != 2 || counters[0].Count != 1 || counters[1].Count != 2 {
+		t.Errorf("expected counters 1 and 2, got %v", counters)
+	}
+}
+
+func TestStore_NameAndExtra(t *testing.T) {
+	st, err := NewStorage(t.TempDir(), "BKB")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	counter := Counter{
+		Count:      5,
+		Capacity:   50,
+		LastUpdate: LastUpdate{Time: time.Date(2024, time.May, 30, 10, 0, 0, 0, time.UTC)},
+		Name:       "Brooklyn Boulders",
+		Extra:      map[string]float64{"waiting": 2},
+	}
+	if err := st.Store(counter); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	last, ok := st.Last()
+	if !ok {
+		t.Fatal("expected last counter to be found")
+	}
+	if !reflect.DeepEqual(last, counter) {
+		t.Errorf("expected %+v but got %+v", counter, last)
+	}
+
+	records, err := st.Range(counter.LastUpdate.Add(-time.Minute), counter.LastUpdate.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(records) != 1 || !reflect.DeepEqual(records[0], counter) {
+		t.Errorf("expected [%+v] but got %+v", counter, records)
+	}
+}
+
+func TestNewStorage_AddsColumnsToOldTable(t *testing.T) {
+	dir := t.TempDir()
+	db, err := sql.Open("sqlite", filepath.Join(dir, "tst.db"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err = db.Exec(`CREATE TABLE count (id INTEGER PRIMARY KEY AUTOINCREMENT, count INTEGER, capacity INTEGER, last_update TEXT);
+		INSERT INTO count (count, capacity, last_update) VALUES (3, 30, '2024-05-30T10:00:00Z');`)
+	db.Close()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	st, err := NewStorage(dir, "TST")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	last, ok := st.Last()
+	if !ok || last.Count != 3 || last.Name != "" || last.Extra != nil {
+		t.Errorf("expected the old record without name or extra, got %+v", last)
+	}
+}
+
+func TestStoredGyms(t *testing.T) {
+	dir := t.TempDir()
+	for _, gym := range []string{"SLB", "BLDR-BKB", "downtown"} {
+		if _, err := NewStorage(dir, gym); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	// Not gyms
+	if _, err := NewAlerts(dir); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// A gym stored before its key was kept
+	old, err := sql.Open("sqlite", filepath.Join(dir, "bldr-old.db"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := old.Exec("CREATE TABLE count (id INTEGER PRIMARY KEY AUTOINCREMENT, count INTEGER)"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	old.Close()
+
+	got, err := storedGyms(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"BLDR-BKB", "BLDR-OLD", "SLB", "downtown"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	got, err = storedGyms(filepath.Join(dir, "missing"))
+	if err != nil || len(got) != 0 {
+		t.Errorf("expected no gyms in a missing dir, got %v, %v", got, err)
+	}
+}
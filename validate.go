@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/reugn/go-quartz/quartz"
+)
+
+// Validate checks the config for every problem it can find and reports them
+// all at once. The gym keys are checked against counters, the result of the
+// first scrape, unless counters is nil. Gym keys of the failed sources, which
+// counters has nothing of, are not checked.
+func (cfg *Config) Validate(counters *Counters, failed ...string) error {
+	var errs []error
+
+	for key, crontab := range cfg.Schedule {
+		if err := checkCrontab(crontab); err != nil {
+			errs = append(errs, fmt.Errorf("schedule.%s: %w", key, err))
+		}
+	}
+
+	names := make(map[string]bool)
+	for i, src := range cfg.Sources {
+		name := strings.ToUpper(src.Name)
+		switch {
+		case name == "" && len(cfg.Sources) > 1:
+			errs = append(errs, fmt.Errorf("sources[%d].name: required with more than one source", i))
+		case name != "" && !sourceName.MatchString(name):
+			errs = append(errs, fmt.Errorf("sources[%d].name: %q must be letters and digits only", i, src.Name))
+		case names[name]:
+			errs = append(errs, fmt.Errorf("sources[%d].name: %q is used by another source", i, src.Name))
+		}
+		names[name] = true
+		for key, crontab := range src.Schedule {
+			if err := checkCrontab(crontab); err != nil {
+				errs = append(errs, fmt.Errorf("sources[%d].schedule.%s: %w", i, key, err))
+			}
+		}
+	}
+
+	for gymKey, gc := range cfg.Gyms {
+		for key, crontab := range gc.Schedule {
+			if err := checkCrontab(crontab); err != nil {
+				errs = append(errs, fmt.Errorf("gyms.%s.schedule.%s: %w", gymKey, key, err))
+			}
+		}
+	}
+
+	if counters != nil {
+		known := make([]string, 0, len(*counters))
+		for gymKey := range *counters {
+			known = append(known, gymKey)
+		}
+		slices.Sort(known)
+
+		if _, ok := (*counters)[cfg.Gym]; !ok && !cfg.failedGym(cfg.Gym, failed) {
+			errs = append(errs, fmt.Errorf("gym: %q is not among the scraped gyms %s", cfg.Gym, strings.Join(known, ", ")))
+		}
+		for gymKey := range cfg.Gyms {
+			if _, ok := (*counters)[gymKey]; !ok && !cfg.failedGym(gymKey, failed) {
+				errs = append(errs, fmt.Errorf("gyms.%s: not among the scraped gyms %s", gymKey, strings.Join(known, ", ")))
+			}
+		}
+	}
+
+	if err := checkWritable(cfg.Storage); err != nil {
+		errs = append(errs, fmt.Errorf("storage: %w", err))
+	}
+	if cfg.Archive.Dir != "" {
+		if err := checkWritable(cfg.Archive.Dir); err != nil {
+			errs = append(errs, fmt.Errorf("archive.dir: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// failedGym reports whether the gym key belongs to one of the failed sources.
+func (cfg *Config) failedGym(gymKey string, failed []string) bool {
+	for _, src := range cfg.Sources {
+		if src.Owns(gymKey) && slices.ContainsFunc(failed, func(name string) bool {
+			return strings.EqualFold(name, src.Name)
+		}) {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceName is what a source name may look like, as it ends up in gym keys and file names.
+var sourceName = regexp.MustCompile(`^[A-Z0-9]+$`)
+
+// checkCrontab parses the crontab the way the scheduler will.
+func checkCrontab(crontab string) error {
+	_, err := quartz.NewCronTriggerWithLoc(crontab, time.Local)
+	return err
+}
+
+// checkWritable makes sure files can be created in dir, creating it if needed.
+func checkWritable(dir string) error {
+	if dir == "" {
+		dir = "."
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".check-*")
+	if err != nil {
+		return fmt.Errorf("%q is not writable: %w", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
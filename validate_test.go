@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	cfg := &Config{
+		Gym:      "SLB",
+		Storage:  t.TempDir(),
+		Schedule: map[string]string{"weekdays": "4 */5 8-22 * * MON-FRI"},
+		Gyms: map[string]GymConfig{
+			"SBG": {Schedule: map[string]string{"evenings": "3 */2 17-21 * * MON-FRI"}},
+		},
+	}
+	counters := &Counters{"SLB": Counter{}, "SBG": Counter{}}
+
+	if err := cfg.Validate(counters); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestValidate_ReportsAllProblems(t *testing.T) {
+	// A file where the storage dir should be
+	storage := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(storage, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{
+		Gym:      "XYZ",
+		Storage:  storage,
+		Schedule: map[string]string{"weekdays": "every five minutes"},
+		Gyms: map[string]GymConfig{
+			"ABC": {Schedule: map[string]string{"evenings": "3 */2 17-21 * *"}, ClosingTime: 22 * time.Hour},
+		},
+	}
+	counters := &Counters{"SLB": Counter{}, "SBG": Counter{}}
+
+	err := cfg.Validate(counters)
+	if err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+	for _, want := range []string{"schedule.weekdays", "gyms.ABC.schedule.evenings", `gym: "XYZ"`, "SBG, SLB", "gyms.ABC:", "storage:"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to mention %q, got:\n%v", want, err)
+		}
+	}
+}
+
+func TestValidate_WithoutCounters(t *testing.T) {
+	cfg := &Config{Gym: "XYZ", Storage: t.TempDir()}
+	if err := cfg.Validate(nil); err != nil {
+		t.Errorf("expected gym keys to go unchecked without counters, got %v", err)
+	}
+}
+
+func TestValidate_FailedSources(t *testing.T) {
+	cfg := &Config{
+		Gym:     "BLDR-BKB",
+		Storage: t.TempDir(),
+		Sources: []Source{{Name: "bldr"}, {Name: "rgp"}},
+		Gyms:    map[string]GymConfig{"RGP-XYZ": {}, "RGP-SLB": {}},
+	}
+	// BLDR failed, so only the RGP gyms are checked
+	counters := &Counters{"RGP-SLB": Counter{}}
+
+	err := cfg.Validate(counters, "bldr")
+	if err == nil || !strings.Contains(err.Error(), "gyms.RGP-XYZ:") {
+		t.Fatalf("expected the missing RGP gym to be reported, got %v", err)
+	}
+	if strings.Contains(err.Error(), "BLDR-BKB") {
+		t.Errorf("expected the gym of the failed source to go unchecked, got %v", err)
+	}
+}
+
+func TestValidate_Sources(t *testing.T) {
+	cfg := &Config{
+		Gym:     "BLDR-SLB",
+		Storage: t.TempDir(),
+		Sources: []Source{
+			{Name: "bldr", PGK: "p", FID: "f"},
+			{Name: "BLDR", PGK: "p", FID: "f"},
+			{PGK: "p", FID: "f"},
+			{Name: "rope-gym", PGK: "p", FID: "f", Schedule: map[string]string{"often": "often"}},
+		},
+	}
+
+	err := cfg.Validate(nil)
+	if err == nil {
+		t.Fatal("expected an error, got nil")
+	}
+	for _, want := range []string{
+		`sources[1].name: "BLDR" is used by another source`,
+		"sources[2].name: required",
+		`sources[3].name: "rope-gym" must be letters and digits only`,
+		"sources[3].schedule.often",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to mention %q, got:\n%v", want, err)
+		}
+	}
+}